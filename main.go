@@ -10,25 +10,82 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-var Downloads = make(map[string]*utils.DownloadFile)
-var Encrypting = make(map[string]*utils.CryptFile)
+var Tasks = utils.NewTaskManager(envInt("MAX_ACTIVE_DOWNLOADS", 3))
+
+// maxBatchSize caps the URL lists and Metalink documents read by /batch.
+const maxBatchSize = 16 << 20
+
+// maxTorrentSize caps the .torrent files uploaded to /torrent.
+const maxTorrentSize = 10 << 20
+
+// cryptKDF derives the keys of files encrypted with a passphrase.
+var cryptKDF = utils.DefaultKDF
 
 func main() {
 	// Specify the directory you want to serve files from
 	dir := "./static"
 
+	// Open the task journal and pick up where the last run stopped
+	store, err := utils.OpenTaskStore("./tasks.db")
+	if err != nil {
+		log.Fatalf("Error opening task journal: %v", err)
+	}
+	defer store.Close()
+	retry, err := utils.ParseRetryPolicy(utils.DefaultRetryPolicy, func(name string) string {
+		return os.Getenv(strings.ToUpper(name))
+	})
+	if err != nil {
+		log.Fatalf("Invalid retry settings: %v", err)
+	}
+	if retry != nil {
+		Tasks.SetRetryPolicy(*retry)
+	}
+	if err := setBandwidth(func(name string) string { return os.Getenv(strings.ToUpper(name)) }); err != nil {
+		log.Fatalf("Invalid bandwidth settings: %v", err)
+	}
+	if err := setProxy(func(name string) string { return os.Getenv(strings.ToUpper(name)) }); err != nil {
+		log.Fatalf("Invalid proxy settings: %v", err)
+	}
+	Tasks.SetSSH(sshSettings())
+	torrent, err := torrentSettings()
+	if err != nil {
+		log.Fatalf("Invalid torrent settings: %v", err)
+	}
+	Tasks.SetTorrent(torrent)
+	pipeline, err := pipelineSettings()
+	if err != nil {
+		log.Fatalf("Invalid pipeline settings: %v", err)
+	}
+	Tasks.SetPipeline(pipeline)
+	kdf, err := utils.ParseKDFParams(utils.DefaultKDF, func(name string) string { return os.Getenv(strings.ToUpper(name)) })
+	if err != nil {
+		log.Fatalf("Invalid key derivation settings: %v", err)
+	}
+	if kdf != nil {
+		cryptKDF = *kdf
+	}
+	restoreTasks(store)
+	go func() {
+		for range time.Tick(2 * time.Second) {
+			if err := Tasks.Sync(store); err != nil {
+				log.Println("Error syncing task journal:", err)
+			}
+		}
+	}()
+
 	// Create a ServeMux to handle custom routes
-	mux := mux.NewRouter()
-	mux.Use(loggingMiddleware)
+	router := mux.NewRouter()
+	router.Use(loggingMiddleware)
 
 	//  Create a ServeMux to handle delete files
-	mux.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodDelete {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -52,7 +109,7 @@ func main() {
 	})
 
 	//  Create a ServeMux to handle rename files
-	mux.HandleFunc("/rename", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/rename", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -86,14 +143,13 @@ func main() {
 	})
 
 	// resume direct download task
-	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		url := r.FormValue("url")
-		if download, done := Downloads[url]; done {
-			go utils.DoDownload(Downloads, download)
+		if download, ok := lookupTask(r); ok {
+			Tasks.Resume(download.ID)
 			w.Write([]byte("Task Resumed"))
 			return
 		}
@@ -101,71 +157,145 @@ func main() {
 	})
 
 	// Pause direct downloads
-	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		url := r.FormValue("url")
-		if download, ok := Downloads[url]; ok {
-			message := download.Pause()
+		if download, ok := lookupTask(r); ok {
+			message, err := Tasks.Pause(download.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			w.Write([]byte(message))
+			return
 		}
 		w.Write([]byte("No Download Task To Pause"))
 
 	})
 
 	// create direct download task
-	mux.HandleFunc("/direct-download", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/direct-download", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
 		link := r.FormValue("url")
-		fname := r.FormValue("file_name")
-
-		if _, ok := Downloads[link]; ok {
-			w.Write([]byte("Task Already In The Queue"))
+		if _, err := url.Parse(link); err != nil {
+			err = fmt.Errorf("error parsing URL: %s", err)
+			log.Println(err)
+			w.Write([]byte(err.Error()))
 			return
 		}
+		// without a name it is detected from the response when the task starts
+		fname := utils.SanitizeName(r.FormValue("file_name"))
 
-		if fname == "" {
-			parsedURL, err := url.Parse(link)
+		download := utils.NewDownloader(link, dir, fname)
+		conflict, err := utils.ParseConflict(r.FormValue("on_conflict"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		download.Conflict = conflict
+		for _, mirror := range r.Form["mirror"] {
+			if parsed, err := url.Parse(mirror); err != nil || parsed.Host == "" {
+				http.Error(w, "invalid mirror URL: "+mirror, http.StatusBadRequest)
+				return
+			}
+			download.Mirrors = append(download.Mirrors, mirror)
+		}
+		if !applyDirectOptions(w, r, download) {
+			return
+		}
+		if checksum := r.FormValue("checksum"); checksum != "" {
+			parsed, err := utils.ParseChecksum(checksum)
 			if err != nil {
-				err = fmt.Errorf("error parsing URL: %s", err)
-				log.Println(err)
-				w.Write([]byte(err.Error()))
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			path := strings.Split(parsedURL.Path, "/")
-			fname = path[len(path)-1]
+			download.Checksum = parsed
 		}
 
-		download := utils.NewDownloader(link, dir, fname)
+		if _, ok := Tasks.FindByFname(download.Fname); ok && fname != "" {
+			w.Write([]byte("Task Already In The Queue"))
+			return
+		}
+
+		id := Tasks.Enqueue(download)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Task Added To Queue: " + id))
+	})
+
+	// queue every file of an uploaded URL list or Metalink document
+	router.HandleFunc("/batch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		data, err := batchBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entries, err := utils.ParseBatch(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		go utils.DoDownload(Downloads, download)
+		type batchTask struct {
+			ID    string `json:"id,omitempty"`
+			Url   string `json:"url"`
+			Fname string `json:"fname,omitempty"`
+			Error string `json:"error,omitempty"`
+		}
+		// read the shared options once, before queueing anything
+		options, err := readDirectOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var tasks []batchTask
+		for _, entry := range entries {
+			download := entry.Downloader(dir)
+			options.apply(download)
+			task := batchTask{Url: download.Url, Fname: download.Fname}
+			if _, ok := Tasks.FindByFname(download.Fname); ok && download.Fname != "" {
+				task.Error = "Task Already In The Queue"
+			} else {
+				task.ID = Tasks.Enqueue(download)
+			}
+			tasks = append(tasks, task)
+		}
+
+		responseData, err := json.Marshal(tasks)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("Task Added To Queue"))
+		w.Write(responseData)
 	})
 
 	// create a ServeMux to handle cancel downloads
-	mux.HandleFunc("/cancel", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/cancel", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		url := r.FormValue("url")
-		if url == "" {
-			http.Error(w, "`url` field required to stop download progress", http.StatusBadRequest)
+		if r.FormValue("id") == "" && r.FormValue("url") == "" {
+			http.Error(w, "`id` or `url` field required to stop download progress", http.StatusBadRequest)
 			return
 		}
 
-		if task, done := Downloads[url]; done {
-			task.Cancel()
+		if task, ok := lookupTask(r); ok {
+			Tasks.Cancel(task.ID)
 			w.Write([]byte("Task Cancelled..."))
-			delete(Downloads, task.Url)
 			return
 		}
 
@@ -174,51 +304,65 @@ func main() {
 	})
 
 	// create a ServeMux to handle send download status
-	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		type ResponseCreator struct {
-			Size            int64   `json:"size"`
-			DownloadedBytes int64   `json:"downloaded"`
-			Fname           string  `json:"fname"`
-			Speed           float64 `json:"speed"`
-			Url             string  `json:"url"`
-			Paused          bool    `json:"paused"`
-			Error           error   `json:"error"`
-		}
-		type crypting struct {
-			FSize       int64  `json:"fsize"`
-			Fname       string `json:"filename"`
-			Mode        string `json:"mode"`
-			CryptedSize int64  `json:"cryptedSize"`
-			Percentage  int    `json:"percentage"`
-		}
-
-		var downloadArr = []*ResponseCreator{}
-		for _, item := range Downloads {
-			downloadArr = append(downloadArr, &ResponseCreator{
-				Size:            item.Size,
-				DownloadedBytes: item.DownloadedSize,
-				Fname:           item.Fname,
-				Speed:           item.Speed(),
-				Url:             item.Url,
-				Paused:          item.IsPaused(),
-				Error:           item.Error,
-			})
-		}
-
-		var cryptingArr = []*crypting{}
-		for _, item := range Encrypting {
-			cryptingArr = append(cryptingArr, &crypting{
-				FSize:       item.FSize,
-				Fname:       item.Fname,
-				Mode:        item.Task,
-				CryptedSize: item.CryperdSize,
-				Percentage:  item.Percentage(),
-			})
+	router.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		type extracting struct {
+			ID            string `json:"id"`
+			Task          string `json:"task"`
+			FSize         int64  `json:"fsize"`
+			Fname         string `json:"filename"`
+			Dir           string `json:"dir"`
+			Mode          string `json:"mode"`
+			ExtractedSize int64  `json:"extractedSize"`
+			Percentage    int    `json:"percentage"`
+			Error         string `json:"error,omitempty"`
+		}
+
+		var downloadArr = []*utils.DownloadStatus{}
+		for _, item := range Tasks.Downloads() {
+			downloadArr = append(downloadArr, item.Status())
+		}
+
+		var cryptingArr = []*cryptStatus{}
+		for _, item := range Tasks.Crypts() {
+			cryptingArr = append(cryptingArr, newCryptStatus(item))
+		}
+		var historyArr = []*cryptStatus{}
+		for _, item := range Tasks.CryptHistory() {
+			historyArr = append(historyArr, newCryptStatus(item))
+		}
+
+		newExtracting := func(item *utils.ExtractFile) *extracting {
+			dir, err := item.Result()
+			entry := &extracting{
+				ID:            item.ID,
+				Task:          item.Download,
+				FSize:         item.FSize,
+				Fname:         item.Fname,
+				Dir:           dir,
+				Mode:          item.Mode(),
+				ExtractedSize: item.Progress(),
+				Percentage:    item.Percentage(),
+			}
+			if err != nil {
+				entry.Error = err.Error()
+			}
+			return entry
+		}
+		var extractingArr = []*extracting{}
+		for _, item := range Tasks.Extracts() {
+			extractingArr = append(extractingArr, newExtracting(item))
+		}
+		var extractHistoryArr = []*extracting{}
+		for _, item := range Tasks.ExtractHistory() {
+			extractHistoryArr = append(extractHistoryArr, newExtracting(item))
 		}
 
 		combinedData := make(map[string]interface{})
 		combinedData["downloads"] = downloadArr
 		combinedData["crypting"] = cryptingArr
+		combinedData["crypt_history"] = historyArr
+		combinedData["extracting"] = extractingArr
+		combinedData["extract_history"] = extractHistoryArr
 		responseData, err := json.Marshal(combinedData)
 		if err != nil {
 			http.Error(w, "Failed to marshal JSON", http.StatusInternalServerError)
@@ -237,7 +381,7 @@ func main() {
 	})
 
 	// create a ServeMux to handle Yt-dlp downloads
-	mux.HandleFunc("/yt-dlp", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/yt-dlp", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -249,13 +393,137 @@ func main() {
 			return
 		}
 
-		go utils.DownloadYTDLP(url, dir, Downloads)
+		download := utils.NewYtDlpDownloader(url, dir)
+		if !applyTaskOptions(w, r, download) {
+			return
+		}
+		id := Tasks.Enqueue(download)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Task Added To Queue: " + id))
+	})
+
+	// create a ServeMux to handle HLS downloads
+	router.HandleFunc("/hls", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		link := r.FormValue("url")
+		if parsed, err := url.Parse(link); err != nil || parsed.Host == "" {
+			http.Error(w, "`url` must be the URL of an HLS playlist", http.StatusBadRequest)
+			return
+		}
+		options := &utils.HLSOptions{}
+		if bandwidth := r.FormValue("max_bandwidth"); bandwidth != "" {
+			n, err := strconv.ParseInt(bandwidth, 10, 64)
+			if err != nil || n < 1 {
+				http.Error(w, "`max_bandwidth` must be a positive number of bits per second", http.StatusBadRequest)
+				return
+			}
+			options.MaxBandwidth = n
+		}
+		if resolution := r.FormValue("resolution"); resolution != "" {
+			height, err := utils.ParseResolution(resolution)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			options.MaxHeight = height
+		}
+		fname := utils.SanitizeName(r.FormValue("file_name"))
+
+		download := utils.NewHLSDownloader(link, dir, fname, options)
+		conflict, err := utils.ParseConflict(r.FormValue("on_conflict"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		download.Conflict = conflict
+		download.Connections = 4 // segments fetched in parallel
+		if !applyDirectOptions(w, r, download) {
+			return
+		}
+
+		if _, ok := Tasks.FindByFname(download.Fname); ok && fname != "" {
+			w.Write([]byte("Task Already In The Queue"))
+			return
+		}
+
+		id := Tasks.Enqueue(download)
 		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("Task Added To Queue"))
+		w.Write([]byte("Task Added To Queue: " + id))
 	})
 
-	// create a ServeMux to handle encrypt files
-	mux.HandleFunc("/sys", func(w http.ResponseWriter, r *http.Request) {
+	// create a ServeMux to handle BitTorrent downloads
+	router.HandleFunc("/torrent", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var metaInfo []byte
+		if file, _, err := r.FormFile("torrent"); err == nil {
+			defer file.Close()
+			if metaInfo, err = io.ReadAll(io.LimitReader(file, maxTorrentSize)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		magnet := r.FormValue("magnet")
+		if magnet == "" && metaInfo == nil {
+			http.Error(w, "a `torrent` file or a `magnet` link is required", http.StatusBadRequest)
+			return
+		}
+		files, err := utils.ParseFileIndices(r.FormValue("files"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fname := utils.SanitizeName(r.FormValue("file_name"))
+
+		download, err := utils.NewTorrentDownloader(magnet, metaInfo, dir, fname, files)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if download.Conflict, err = utils.ParseConflict(r.FormValue("on_conflict")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if download.Torrent.Seed, err = utils.ParseSeedLimits(Tasks.SeedLimits(), r.FormValue); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !applyTaskOptions(w, r, download) {
+			return
+		}
+
+		if _, ok := Tasks.FindByUrl(download.Url); ok {
+			w.Write([]byte("Task Already In The Queue"))
+			return
+		}
+
+		id := Tasks.Enqueue(download)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Task Added To Queue: " + id))
+	})
+
+	// create a ServeMux to handle encrypt and decrypt files
+	router.HandleFunc("/encrypt", cryptHandler(dir, "encrypt")).Methods(http.MethodPost)
+	router.HandleFunc("/decrypt", cryptHandler(dir, "decrypt")).Methods(http.MethodPost)
+
+	// stop a running encrypt or decrypt job
+	router.HandleFunc("/crypts/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if err := Tasks.CancelCrypt(mux.Vars(r)["id"]); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("Task Cancelled..."))
+	}).Methods(http.MethodPost)
+
+	// create a ServeMux to handle system stats
+	router.HandleFunc("/sys", func(w http.ResponseWriter, r *http.Request) {
 		rclone_tasks := func() int {
 			req, _ := http.NewRequest("POST", "http://127.0.0.1:5572/core/stats", nil)
 			client := &http.Client{}
@@ -316,7 +584,7 @@ func main() {
 			NetUsage:      utils.NetUsageStats(),
 			FolderCount:   folders,
 			FileCount:     files,
-			Downloads:     len(Downloads),
+			Downloads:     len(Tasks.Downloads()),
 			RcloneTrans:   rclone_tasks,
 		}
 		responseData, err := json.Marshal(res)
@@ -329,22 +597,741 @@ func main() {
 		w.Write(responseData)
 	})
 
-	// Register the file server at the "/fs" route
-	mux.PathPrefix("/fs/").Handler(http.StripPrefix("/fs/", http.FileServer(http.Dir(dir))))
+	// send the status of a single task
+	router.HandleFunc("/tasks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		task, ok := Tasks.Get(mux.Vars(r)["id"])
+		if !ok {
+			http.Error(w, utils.ErrTaskNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		responseData, err := json.Marshal(task.Status())
+		if err != nil {
+			http.Error(w, "Failed to marshal JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseData)
+	}).Methods(http.MethodGet)
+
+	// send the throughput samples of a task, one per second for the last five minutes
+	router.HandleFunc("/tasks/{id}/speed-history", func(w http.ResponseWriter, r *http.Request) {
+		type speedHistory struct {
+			Interval float64             `json:"interval"` // seconds per sample
+			Samples  []utils.SpeedSample `json:"samples"`
+		}
+		task, ok := Tasks.Get(mux.Vars(r)["id"])
+		if !ok {
+			http.Error(w, utils.ErrTaskNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		responseData, err := json.Marshal(speedHistory{Interval: utils.SpeedInterval.Seconds(), Samples: task.SpeedHistory()})
+		if err != nil {
+			http.Error(w, "Failed to marshal JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseData)
+	}).Methods(http.MethodGet)
+
+	// pause, resume, cancel or move a queued task to the front by ID
+	router.HandleFunc("/tasks/{id}/{action:pause|resume|cancel|front}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		var message string
+		var err error
+		switch vars["action"] {
+		case "pause":
+			message, err = Tasks.Pause(vars["id"])
+		case "resume":
+			message, err = "Task Resumed", Tasks.Resume(vars["id"])
+		case "cancel":
+			message, err = "Task Cancelled...", Tasks.Cancel(vars["id"])
+		case "front":
+			message, err = "Task Moved To Front", Tasks.MoveToFront(vars["id"])
+		}
+		if err == utils.ErrTaskNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(message))
+	}).Methods(http.MethodPost)
+
+	// change the priority of a task
+	router.HandleFunc("/tasks/{id}/priority", func(w http.ResponseWriter, r *http.Request) {
+		priority, err := strconv.Atoi(r.FormValue("priority"))
+		if err != nil {
+			http.Error(w, "`priority` must be a number", http.StatusBadRequest)
+			return
+		}
+		if err := Tasks.SetPriority(mux.Vars(r)["id"], priority); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("Priority Updated"))
+	}).Methods(http.MethodPost)
+
+	// change the bandwidth limit of a task
+	router.HandleFunc("/tasks/{id}/limit", func(w http.ResponseWriter, r *http.Request) {
+		limit, err := utils.ParseRate(r.FormValue("rate_limit"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		task, ok := Tasks.Get(mux.Vars(r)["id"])
+		if !ok {
+			http.Error(w, utils.ErrTaskNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		task.SetRateLimit(limit)
+		w.Write([]byte("Rate Limit Updated"))
+	}).Methods(http.MethodPost)
+
+	// send the global bandwidth limit and schedule
+	router.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		type limits struct {
+			RateLimit int64    `json:"rate_limit"`
+			Schedule  []string `json:"schedule"`
+			Current   int64    `json:"current"`
+		}
+		bandwidth := Tasks.Bandwidth()
+		limit, schedule := bandwidth.Limits()
+		res := limits{RateLimit: limit, Schedule: []string{}, Current: bandwidth.Current()}
+		for _, rule := range schedule {
+			res.Schedule = append(res.Schedule, rule.String())
+		}
+		responseData, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, "Failed to marshal JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseData)
+	}).Methods(http.MethodGet)
+
+	// change the global bandwidth limit and schedule
+	router.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		if err := setBandwidth(r.FormValue); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("Limits Updated"))
+	}).Methods(http.MethodPost)
+
+	// send the server-wide proxy
+	router.HandleFunc("/proxy", func(w http.ResponseWriter, r *http.Request) {
+		type proxySettings struct {
+			Proxy   string   `json:"proxy"`
+			NoProxy []string `json:"no_proxy"`
+		}
+		res := proxySettings{NoProxy: []string{}}
+		if proxy := Tasks.Proxy(); proxy != nil {
+			res.Proxy = proxy.Redacted()
+			if proxy.URL == "" {
+				res.Proxy = "none"
+			}
+			res.NoProxy = append(res.NoProxy, proxy.NoProxy...)
+		}
+		responseData, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, "Failed to marshal JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseData)
+	}).Methods(http.MethodGet)
+
+	// change the server-wide proxy
+	router.HandleFunc("/proxy", func(w http.ResponseWriter, r *http.Request) {
+		if err := setProxy(r.FormValue); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("Proxy Updated"))
+	}).Methods(http.MethodPost)
+
+	// send the download queue
+	router.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		type queueStatus struct {
+			Slots  int                     `json:"slots"`
+			Active int                     `json:"active"`
+			Queued []*utils.DownloadStatus `json:"queued"`
+		}
+		slots, active := Tasks.Slots()
+		res := queueStatus{Slots: slots, Active: active, Queued: []*utils.DownloadStatus{}}
+		for _, item := range Tasks.Queue() {
+			res.Queued = append(res.Queued, item.Status())
+		}
+		responseData, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, "Failed to marshal JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseData)
+	}).Methods(http.MethodGet)
+
+	// reorder the download queue or change the number of active slots
+	router.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		if slots := r.FormValue("slots"); slots != "" {
+			n, err := strconv.Atoi(slots)
+			if err != nil || n < 1 {
+				http.Error(w, "`slots` must be a positive number", http.StatusBadRequest)
+				return
+			}
+			Tasks.SetSlots(n)
+		}
+		if order := r.FormValue("order"); order != "" {
+			if err := Tasks.Reorder(strings.Split(order, ",")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Write([]byte("Queue Updated"))
+	}).Methods(http.MethodPost)
+
+	// Register the file server at the "/fs" route, hiding unfinished downloads
+	router.PathPrefix("/fs/").Handler(http.StripPrefix("/fs/", http.FileServer(utils.HidePartFiles{FileSystem: http.Dir(dir)})))
 
 	server := &http.Server{
 		Addr:    ":8080",
-		Handler: mux,
+		Handler: router,
 	}
 
 	// Start the server
 	log.Printf("Server started on :8080...")
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
 }
 
+// restoreTasks reloads the task journal and resumes unfinished work.
+func restoreTasks(store *utils.TaskStore) {
+	downloads, err := store.LoadDownloads()
+	if err != nil {
+		log.Println("Error loading download tasks:", err)
+	}
+	for _, download := range downloads {
+		switch download.State() {
+		case "downloading", "queued", "failed", "retrying":
+			Tasks.Enqueue(download)
+		default:
+			Tasks.Add(download)
+		}
+	}
+
+	crypts, err := store.LoadCrypts()
+	if err != nil {
+		log.Println("Error loading crypt tasks:", err)
+	}
+	for _, job := range crypts {
+		key, err := lookupKey(job.KeyRef)
+		if err != nil {
+			log.Printf("Cannot restart crypt task %s: %v", job.Fname, err)
+			continue
+		}
+		restarted, run := utils.RestartCrypt(job, &key)
+		if restarted == nil {
+			continue
+		}
+		Tasks.StartCrypt(restarted, run)
+	}
+	history, err := store.LoadCryptHistory()
+	if err != nil {
+		log.Println("Error loading crypt history:", err)
+	}
+	Tasks.RestoreCryptHistory(history)
+}
+
+// cryptStatus is the JSON view of a crypt job reported by /status.
+type cryptStatus struct {
+	ID          string     `json:"id"`
+	Operation   string     `json:"operation"`
+	FSize       int64      `json:"fsize"`
+	Fname       string     `json:"filename"`
+	Key         string     `json:"key,omitempty"`
+	Mode        string     `json:"mode"`
+	State       string     `json:"state"`
+	CryptedSize int64      `json:"cryptedSize"`
+	Percentage  int        `json:"percentage"`
+	Error       string     `json:"error,omitempty"`
+	Started     *time.Time `json:"started,omitempty"`
+	Finished    *time.Time `json:"finished,omitempty"`
+}
+
+func newCryptStatus(job *utils.CryptFile) *cryptStatus {
+	status := &cryptStatus{
+		ID:          job.ID,
+		Operation:   job.Operation,
+		FSize:       job.FSize,
+		Fname:       job.Fname,
+		Key:         job.KeyRef,
+		Mode:        job.Mode(),
+		State:       job.State(),
+		CryptedSize: job.Progress(),
+		Percentage:  job.Percentage(),
+	}
+	started, finished, err := job.Result()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if !started.IsZero() {
+		status.Started = &started
+	}
+	if !finished.IsZero() {
+		status.Finished = &finished
+	}
+	return status
+}
+
+// cryptHandler starts an encrypt or decrypt job of the file named by the
+// `path` form value, relative to dir, with the key named by `key` or with
+// `passphrase`.
+func cryptHandler(dir, operation string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fpath, err := staticFile(dir, r.FormValue("path"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		output := fpath + ".crypted"
+		if operation == "decrypt" {
+			output = strings.TrimSuffix(fpath, ".crypted")
+		}
+		switch {
+		case operation == "encrypt" && strings.HasSuffix(fpath, ".crypted"):
+			http.Error(w, "File is already encrypted", http.StatusBadRequest)
+			return
+		case operation == "decrypt" && !strings.HasSuffix(fpath, ".crypted"):
+			http.Error(w, "Only .crypted files can be decrypted", http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Lstat(output); err == nil {
+			http.Error(w, filepath.Base(output)+" already exists", http.StatusConflict)
+			return
+		}
+		for _, job := range Tasks.Crypts() {
+			if job.Path() == fpath {
+				http.Error(w, "File is already being processed: "+job.ID, http.StatusConflict)
+				return
+			}
+		}
+
+		ref, passphrase := r.FormValue("key"), r.FormValue("passphrase")
+		if ref != "" && passphrase != "" {
+			http.Error(w, "Use either `key` or `passphrase`", http.StatusBadRequest)
+			return
+		}
+		var job *utils.CryptFile
+		var run func() error
+		if passphrase != "" {
+			job, run = utils.PassphraseEncryptor(fpath, []byte(passphrase), cryptKDF)
+			if operation == "decrypt" {
+				job, run = utils.PassphraseDecryptor(fpath, []byte(passphrase))
+			}
+		} else {
+			// files in the versioned format name their key
+			if ref == "" && operation == "decrypt" {
+				if ref, err = utils.CryptKeyID(fpath); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if ref == "" {
+				ref = "default"
+			}
+			key, err := lookupKey(ref)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			job, run = utils.Encryptor(fpath, &key)
+			if operation == "decrypt" {
+				job, run = utils.Decryptor(fpath, &key)
+			}
+			if job != nil {
+				job.KeyRef = ref
+			}
+		}
+		if job == nil {
+			http.Error(w, "Failed to read the file", http.StatusInternalServerError)
+			return
+		}
+		id := Tasks.StartCrypt(job, run)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Task Added To Queue: " + id))
+	}
+}
+
+// staticFile resolves name to a regular file under dir, refusing names and
+// symbolic links that reach outside of it.
+func staticFile(dir, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("`path` field required")
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("`path` must be a file inside the static directory")
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	fpath, err := filepath.EvalSymlinks(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return "", fmt.Errorf("no such file: %s", name)
+	}
+	if relative, err := filepath.Rel(root, fpath); err != nil || !filepath.IsLocal(relative) {
+		return "", fmt.Errorf("`path` must be a file inside the static directory")
+	}
+	if info, err := os.Stat(fpath); err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a file", name)
+	}
+	return fpath, nil
+}
+
+// lookupKey resolves a key reference, so that keys never travel in
+// requests: `default`, or none, is the ENCRYPT_KEY environment variable and
+// any other name the ENCRYPT_KEY_<NAME> one.
+func lookupKey(ref string) ([]byte, error) {
+	if ref == utils.PassphraseKeyID {
+		return nil, fmt.Errorf("the passphrase is not kept, send it as `passphrase`")
+	}
+	name := "ENCRYPT_KEY"
+	if ref != "" && ref != "default" {
+		for _, c := range ref {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+				return nil, fmt.Errorf("invalid key name %q", ref)
+			}
+		}
+		name += "_" + strings.ToUpper(ref)
+	}
+	key := []byte(os.Getenv(name))
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	case 0:
+		return nil, fmt.Errorf("%s is not set", name)
+	}
+	return nil, fmt.Errorf("%s must be 16, 24 or 32 bytes long", name)
+}
+
+// lookupTask finds the task named by the `id` form value, or by `url` for
+// clients that predate task IDs.
+func lookupTask(r *http.Request) (*utils.DownloadFile, bool) {
+	if id := r.FormValue("id"); id != "" {
+		return Tasks.Get(id)
+	}
+	return Tasks.FindByUrl(r.FormValue("url"))
+}
+
+// taskOptions are the optional `priority`, `rate_limit`, `proxy`,
+// `no_proxy`, `extract` and `pipeline` form values of a new task. They are
+// read once per request, so that /batch applies the same ones to every task.
+type taskOptions struct {
+	priority  *int
+	rateLimit *int64
+	proxy     *utils.Proxy
+	extract   *utils.ExtractOptions
+	pipeline  *utils.Pipeline
+}
+
+func readTaskOptions(r *http.Request) (*taskOptions, error) {
+	options := &taskOptions{}
+	if priority := r.FormValue("priority"); priority != "" {
+		n, err := strconv.Atoi(priority)
+		if err != nil {
+			return nil, fmt.Errorf("`priority` must be a number")
+		}
+		options.priority = &n
+	}
+	if limit := r.FormValue("rate_limit"); limit != "" {
+		n, err := utils.ParseRate(limit)
+		if err != nil {
+			return nil, err
+		}
+		options.rateLimit = &n
+	}
+	if proxy := r.FormValue("proxy"); proxy != "" {
+		parsed, err := utils.ParseProxy(proxy, r.FormValue("no_proxy"))
+		if err != nil {
+			return nil, err
+		}
+		options.proxy = parsed
+	}
+	if extract := r.FormValue("extract"); extract != "" {
+		enabled, err := strconv.ParseBool(extract)
+		if err != nil {
+			return nil, fmt.Errorf("`extract` must be true or false")
+		}
+		if enabled {
+			options.extract = &utils.ExtractOptions{Password: r.FormValue("archive_password")}
+			options.extract.Delete, _ = strconv.ParseBool(r.FormValue("delete_archive"))
+		}
+	}
+	if steps := r.FormValue("pipeline"); steps != "" {
+		allowCommands, _ := strconv.ParseBool(os.Getenv("PIPELINE_COMMANDS"))
+		pipeline, err := utils.ParsePipeline([]byte(steps), allowCommands)
+		if err != nil {
+			return nil, err
+		}
+		options.pipeline = pipeline
+	}
+	return options, nil
+}
+
+func (o *taskOptions) apply(download *utils.DownloadFile) {
+	if o.priority != nil {
+		download.Priority = *o.priority
+	}
+	if o.rateLimit != nil {
+		download.SetRateLimit(*o.rateLimit)
+	}
+	if o.proxy != nil {
+		download.Proxy = o.proxy
+	}
+	if o.extract != nil {
+		extract := *o.extract
+		download.Extract = &extract
+	}
+	if o.pipeline != nil {
+		download.Pipeline = o.pipeline
+	}
+}
+
+// applyTaskOptions applies the taskOptions of r to a new task, answering the
+// request itself when one is invalid.
+func applyTaskOptions(w http.ResponseWriter, r *http.Request, download *utils.DownloadFile) bool {
+	options, err := readTaskOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	options.apply(download)
+	return true
+}
+
+// directOptions are the options shared by direct downloads: request
+// options, `min_speed`, `connections`, the retry policy and the taskOptions.
+type directOptions struct {
+	*taskOptions
+	request     *utils.RequestOptions
+	minSpeed    int64
+	connections int
+	retry       *utils.RetryPolicy
+}
+
+func readDirectOptions(r *http.Request) (*directOptions, error) {
+	options := &directOptions{}
+	var err error
+	if options.request, err = requestOptions(r); err != nil {
+		return nil, err
+	}
+	if minSpeed := r.FormValue("min_speed"); minSpeed != "" {
+		if options.minSpeed, err = utils.ParseRate(minSpeed); err != nil {
+			return nil, err
+		}
+	}
+	if connections := r.FormValue("connections"); connections != "" {
+		n, err := strconv.Atoi(connections)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("`connections` must be a positive number")
+		}
+		options.connections = n
+	}
+	if options.taskOptions, err = readTaskOptions(r); err != nil {
+		return nil, err
+	}
+	if options.retry, err = utils.ParseRetryPolicy(Tasks.RetryPolicy(), r.FormValue); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+func (o *directOptions) apply(download *utils.DownloadFile) {
+	download.Request = o.request
+	if o.minSpeed != 0 {
+		download.MinSpeed = o.minSpeed
+	}
+	if o.connections != 0 {
+		download.Connections = o.connections
+	}
+	o.taskOptions.apply(download)
+	download.Retry = o.retry
+}
+
+// applyDirectOptions applies the directOptions of r to a new task, answering
+// the request itself when one is invalid.
+func applyDirectOptions(w http.ResponseWriter, r *http.Request, download *utils.DownloadFile) bool {
+	options, err := readDirectOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	options.apply(download)
+	return true
+}
+
+// batchBody returns the list uploaded as `file`, sent in the `list` form
+// value or posted as the request body.
+func batchBody(r *http.Request) ([]byte, error) {
+	if file, _, err := r.FormFile("file"); err == nil {
+		defer file.Close()
+		return io.ReadAll(io.LimitReader(file, maxBatchSize))
+	}
+	if list := r.FormValue("list"); list != "" {
+		return []byte(list), nil
+	}
+	return io.ReadAll(io.LimitReader(r.Body, maxBatchSize))
+}
+
+// requestOptions reads the custom `header` lines, `cookies` string or
+// uploaded `cookies_file`, `username`, `password`, `user_agent` and the
+// uploaded `ssh_key` with its `ssh_key_passphrase` of a new direct download.
+// It returns nil when none are set.
+func requestOptions(r *http.Request) (*utils.RequestOptions, error) {
+	r.FormValue("url") // parses the form, including multipart uploads
+	options := &utils.RequestOptions{
+		UserAgent: r.FormValue("user_agent"),
+		Username:  r.FormValue("username"),
+		Password:  r.FormValue("password"),
+	}
+	if lines := r.Form["header"]; len(lines) > 0 {
+		header, err := utils.ParseHeaders(lines)
+		if err != nil {
+			return nil, err
+		}
+		options.Header = header
+	}
+	if cookies := r.FormValue("cookies"); cookies != "" {
+		options.Cookies = utils.ParseCookieString(cookies)
+	}
+	if file, _, err := r.FormFile("cookies_file"); err == nil {
+		defer file.Close()
+		cookies, err := utils.ParseCookiesFile(file)
+		if err != nil {
+			return nil, err
+		}
+		options.Cookies = append(options.Cookies, cookies...)
+	}
+	if file, _, err := r.FormFile("ssh_key"); err == nil {
+		defer file.Close()
+		key, err := io.ReadAll(io.LimitReader(file, 64<<10))
+		if err != nil {
+			return nil, err
+		}
+		options.PrivateKey = string(key)
+		options.Passphrase = r.FormValue("ssh_key_passphrase")
+	}
+
+	if options.Header == nil && options.Cookies == nil && options.UserAgent == "" && options.Username == "" && options.PrivateKey == "" {
+		return nil, nil
+	}
+	return options, nil
+}
+
+// sshSettings reads the known_hosts file and private keys of sftp:// sources
+// from SSH_KNOWN_HOSTS (default ~/.ssh/known_hosts), SSH_KEY (a comma
+// separated list of key files) and SSH_KEY_PASSPHRASE.
+func sshSettings() *utils.SSHSettings {
+	settings := &utils.SSHSettings{
+		KnownHosts: os.Getenv("SSH_KNOWN_HOSTS"),
+		Passphrase: os.Getenv("SSH_KEY_PASSPHRASE"),
+	}
+	if home, err := os.UserHomeDir(); err == nil && settings.KnownHosts == "" {
+		settings.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	for _, key := range strings.Split(os.Getenv("SSH_KEY"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			settings.Keys = append(settings.Keys, key)
+		}
+	}
+	return settings
+}
+
+// torrentSettings reads the BitTorrent client settings from TORRENT_PORT
+// (default 42069), TORRENT_NO_DHT and the default seeding limits SEED_RATIO
+// and SEED_TIME.
+func torrentSettings() (*utils.TorrentSettings, error) {
+	settings := &utils.TorrentSettings{StateDir: ".", ListenPort: envInt("TORRENT_PORT", 42069)}
+	settings.NoDHT, _ = strconv.ParseBool(os.Getenv("TORRENT_NO_DHT"))
+	seed, err := utils.ParseSeedLimits(utils.SeedLimits{}, func(name string) string { return os.Getenv(strings.ToUpper(name)) })
+	if err != nil {
+		return nil, err
+	}
+	if seed != nil {
+		settings.Seed = *seed
+	}
+	return settings, nil
+}
+
+// pipelineSettings reads the default pipeline from the JSON file named by
+// PIPELINE_FILE, and the key of its encrypt steps from ENCRYPT_KEY. Command
+// steps are allowed there, since the file is under the server owner's
+// control.
+func pipelineSettings() (*utils.PipelineSettings, error) {
+	settings := &utils.PipelineSettings{Key: []byte(os.Getenv("ENCRYPT_KEY"))}
+	if name := os.Getenv("PIPELINE_FILE"); name != "" {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		pipeline, err := utils.ParsePipeline(data, true)
+		if err != nil {
+			return nil, err
+		}
+		settings.Steps = pipeline.Steps
+	}
+	return settings, nil
+}
+
+// setProxy applies the `proxy` and `no_proxy` settings returned by get to
+// the server-wide proxy. Without a proxy the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables apply.
+func setProxy(get func(string) string) error {
+	if get("proxy") == "" {
+		Tasks.SetProxy(nil)
+		return nil
+	}
+	proxy, err := utils.ParseProxy(get("proxy"), get("no_proxy"))
+	if err != nil {
+		return err
+	}
+	Tasks.SetProxy(proxy)
+	return nil
+}
+
+// setBandwidth applies the `rate_limit` and `schedule` settings returned by
+// get to the global bandwidth limit.
+func setBandwidth(get func(string) string) error {
+	bandwidth := Tasks.Bandwidth()
+	limit, schedule := bandwidth.Limits()
+	var err error
+	if value := get("rate_limit"); value != "" {
+		if limit, err = utils.ParseRate(value); err != nil {
+			return err
+		}
+	}
+	if value := get("schedule"); value != "" {
+		if schedule, err = utils.ParseSchedule(value); err != nil {
+			return err
+		}
+	}
+	bandwidth.Set(limit, schedule)
+	return nil
+}
+
+// envInt reads a numeric setting from the environment.
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
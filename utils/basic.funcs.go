@@ -43,7 +43,7 @@ func CountFilesAndFolders(path string) (int, int) {
 		}
 		if info.IsDir() {
 			folderCount++
-		} else {
+		} else if !IsPartFile(filePath) {
 			fileCount++
 		}
 		return nil
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// BatchEntry is one file of a batch import: its URL, the mirrors serving
+// the same file and what is known about it beforehand.
+type BatchEntry struct {
+	Url      string
+	Mirrors  []string
+	Fname    string // empty to detect the name when the task starts
+	Size     int64  // 0 when unknown
+	Checksum *Checksum
+}
+
+// Downloader creates the task downloading the entry into dir.
+func (e *BatchEntry) Downloader(dir string) *DownloadFile {
+	d := NewDownloader(e.Url, dir, SanitizeName(e.Fname))
+	d.Mirrors = e.Mirrors
+	d.Size = e.Size
+	d.Checksum = e.Checksum
+	return d
+}
+
+// ParseBatch reads a Metalink v4 document or an aria2 style URL list,
+// telling them apart by content.
+func ParseBatch(data []byte) ([]*BatchEntry, error) {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		return ParseMetalink(bytes.NewReader(trimmed))
+	}
+	return ParseURLList(bytes.NewReader(data))
+}
+
+// ParseURLList reads a URL list in the aria2 input file format: one file per
+// line, tab separated URLs of the same file, and indented option lines below
+// it. `out` names the file and `checksum` takes `<algorithm>=<hex>` or
+// `<algorithm>:<hex>`; other options are ignored. Lines starting with # are
+// comments.
+func ParseURLList(r io.Reader) ([]*BatchEntry, error) {
+	var entries []*BatchEntry
+	var entry *BatchEntry
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if text[0] == ' ' || text[0] == '\t' {
+			if entry == nil {
+				return nil, fmt.Errorf("line %d: option before the first URL", line)
+			}
+			name, value, ok := strings.Cut(trimmed, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: option must look like name=value", line)
+			}
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "out":
+				entry.Fname = strings.TrimSpace(value)
+			case "checksum":
+				// aria2 writes sha-256=<hex>
+				value = strings.TrimSpace(value)
+				if !strings.Contains(value, ":") {
+					value = strings.Replace(value, "=", ":", 1)
+				}
+				checksum, err := ParseChecksum(value)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", line, err)
+				}
+				entry.Checksum = checksum
+			default:
+				log.Printf("[*] Ignoring batch option %q on line %d", name, line)
+			}
+			continue
+		}
+
+		links := strings.FieldsFunc(trimmed, func(r rune) bool { return r == '\t' })
+		for i, link := range links {
+			links[i] = strings.TrimSpace(link)
+			if err := checkBatchURL(links[i]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		entry = &BatchEntry{Url: links[0], Mirrors: links[1:]}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no URLs in the list")
+	}
+	return entries, nil
+}
+
+func checkBatchURL(link string) error {
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https" && !isFTP(link) && !isSFTP(link)) {
+		return fmt.Errorf("invalid URL %q", link)
+	}
+	return nil
+}
+
+// metalink is the part of a Metalink v4 document (RFC 5854) used here.
+type metalink struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:metalink metalink"`
+	Files   []struct {
+		Name   string `xml:"name,attr"`
+		Size   int64  `xml:"size"`
+		Hashes []struct {
+			Type  string `xml:"type,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"hash"`
+		Urls []struct {
+			Priority int    `xml:"priority,attr"`
+			Value    string `xml:",chardata"`
+		} `xml:"url"`
+	} `xml:"file"`
+}
+
+// hashPreference lists the Metalink hash types used for checksums, strongest first.
+var hashPreference = []string{"sha-512", "sha-256", "sha-1", "md5"}
+
+// ParseMetalink reads a Metalink v4 document. The URLs of each file are
+// ordered by priority, the first becoming the task URL and the others its
+// mirrors, and the strongest supported hash becomes its checksum. Files
+// without an HTTP, FTP or SFTP URL are skipped.
+func ParseMetalink(r io.Reader) ([]*BatchEntry, error) {
+	var doc metalink
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid metalink: %w", err)
+	}
+
+	var entries []*BatchEntry
+	for _, file := range doc.Files {
+		urls := file.Urls
+		sort.SliceStable(urls, func(i, j int) bool { return priority(urls[i].Priority) < priority(urls[j].Priority) })
+		var links []string
+		for _, u := range urls {
+			link := strings.TrimSpace(u.Value)
+			if checkBatchURL(link) == nil {
+				links = append(links, link)
+			}
+		}
+		if len(links) == 0 {
+			log.Printf("[*] Skipping metalink file %q without HTTP, FTP or SFTP URLs", file.Name)
+			continue
+		}
+
+		entry := &BatchEntry{Url: links[0], Mirrors: links[1:], Fname: file.Name, Size: file.Size}
+		for _, preferred := range hashPreference {
+			for _, h := range file.Hashes {
+				if entry.Checksum == nil && strings.EqualFold(h.Type, preferred) {
+					checksum, err := ParseChecksum(preferred + ":" + strings.TrimSpace(h.Value))
+					if err != nil {
+						return nil, fmt.Errorf("file %q: %w", file.Name, err)
+					}
+					entry.Checksum = checksum
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no downloadable files in the metalink")
+	}
+	return entries, nil
+}
+
+// priority orders Metalink URLs, 1 being the highest and no priority the lowest.
+func priority(p int) int {
+	if p <= 0 {
+		return 1 << 30
+	}
+	return p
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sha256Hex = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestParseURLList(t *testing.T) {
+	list := "# nightly builds\n" +
+		"https://a.example/file.iso\thttps://b.example/file.iso\n" +
+		"  out=build.iso\n" +
+		"  checksum=sha-256=" + sha256Hex + "\n" +
+		"  dir=/ignored\n" +
+		"\n" +
+		"https://a.example/notes.txt\r\n"
+	entries, err := ParseBatch([]byte(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	first := entries[0]
+	if first.Url != "https://a.example/file.iso" || !reflect.DeepEqual(first.Mirrors, []string{"https://b.example/file.iso"}) {
+		t.Fatalf("unexpected URLs %q %q", first.Url, first.Mirrors)
+	}
+	if first.Fname != "build.iso" || first.Checksum == nil || first.Checksum.String() != "sha256:"+sha256Hex {
+		t.Fatalf("unexpected options %q %v", first.Fname, first.Checksum)
+	}
+	if second := entries[1]; second.Url != "https://a.example/notes.txt" || second.Fname != "" || second.Checksum != nil {
+		t.Fatalf("unexpected second entry %+v", second)
+	}
+
+	for _, invalid := range []string{"  out=x\n", "not a url\n", "https://a.example/f\n  checksum=crc32=00\n"} {
+		if _, err := ParseURLList(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestParseMetalink(t *testing.T) {
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="example.ext">
+    <size>14471447</size>
+    <hash type="md5">d41d8cd98f00b204e9800998ecf8427e</hash>
+    <hash type="sha-256">` + sha256Hex + `</hash>
+    <url priority="2">https://mirror.example/example.ext</url>
+    <url>https://slow.example/example.ext</url>
+    <url priority="1">https://origin.example/example.ext</url>
+    <url priority="1">ftp://origin.example/example.ext</url>
+    <url priority="3">rsync://origin.example/example.ext</url>
+  </file>
+  <file name="torrent-only.ext">
+    <metaurl mediatype="torrent">https://origin.example/example.torrent</metaurl>
+  </file>
+</metalink>`
+	entries, err := ParseBatch([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.Url != "https://origin.example/example.ext" {
+		t.Fatalf("expected the highest priority URL first, got %q", entry.Url)
+	}
+	if !reflect.DeepEqual(entry.Mirrors, []string{"ftp://origin.example/example.ext", "https://mirror.example/example.ext", "https://slow.example/example.ext"}) {
+		t.Fatalf("unexpected mirrors %q", entry.Mirrors)
+	}
+	if entry.Checksum.String() != "sha256:"+sha256Hex {
+		t.Fatalf("expected the strongest hash, got %v", entry.Checksum)
+	}
+
+	download := entry.Downloader(t.TempDir())
+	if download.Size != 14471447 || download.Checksum != entry.Checksum || len(download.Mirrors) != 3 || !strings.HasSuffix(download.Fname, "/example.ext") {
+		t.Fatalf("expected the metalink details on the task, got %+v", download.Status())
+	}
+
+	if _, err := ParseBatch([]byte(`<metalink xmlns="http://www.metalinker.org/"></metalink>`)); err == nil {
+		t.Error("expected Metalink 3 documents to be rejected")
+	}
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Checksum is the expected digest of a download, written as "<algorithm>:<hex>".
+type Checksum struct {
+	Algorithm string
+	Expected  string
+}
+
+func ParseChecksum(value string) (*Checksum, error) {
+	algorithm, expected, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, fmt.Errorf("checksum must look like <algorithm>:<hex>")
+	}
+	// also accept the sha-256 spelling of Metalink and aria2
+	algorithm = strings.ReplaceAll(strings.ToLower(algorithm), "-", "")
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	expected = strings.ToLower(expected)
+	if raw, err := hex.DecodeString(expected); err != nil || len(raw) != newHash().Size() {
+		return nil, fmt.Errorf("invalid %s digest %q", algorithm, expected)
+	}
+	return &Checksum{Algorithm: algorithm, Expected: expected}, nil
+}
+
+func (c *Checksum) String() string { return c.Algorithm + ":" + c.Expected }
+
+func (c *Checksum) New() hash.Hash { return checksumAlgorithms[c.Algorithm]() }
+
+// hashPrefix feeds the first n bytes of the file at path into h, so a resumed
+// download can keep hashing where the previous run stopped.
+func hashPrefix(h hash.Hash, path string, n int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	written, err := io.CopyN(h, file, n)
+	if err != nil && written != n {
+		return err
+	}
+	return nil
+}
+
+// verify compares the digest of the finished download with the expected
+// checksum. h holds the data hashed while downloading, or is nil when the
+// whole file has to be read again.
+func (d *DownloadFile) verify(h hash.Hash) bool {
+	d.mu.Lock()
+	checksum, fname := d.Checksum, partName(d.Fname)
+	d.mu.Unlock()
+	if checksum == nil {
+		return true
+	}
+
+	if h == nil {
+		h = checksum.New()
+		file, err := os.Open(fname)
+		if err != nil {
+			log_and_set_error(d, "error hashing the downloaded file", err)
+			return false
+		}
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			log_and_set_error(d, "error hashing the downloaded file", err)
+			return false
+		}
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	d.mu.Lock()
+	d.Digest = checksum.Algorithm + ":" + digest
+	d.Verified = digest == checksum.Expected
+	d.mu.Unlock()
+
+	if digest != checksum.Expected {
+		log_and_set_error(d, "checksum mismatch", fmt.Errorf("expected %s, got %s:%s", checksum, checksum.Algorithm, digest))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseChecksum(t *testing.T) {
+	if _, err := ParseChecksum("sha256:" + strings.Repeat("ab", 32)); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"abcdef", "crc32:00000000", "md5:zz", "sha256:abcd"} {
+		if _, err := ParseChecksum(value); err == nil {
+			t.Fatalf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestChecksumAcrossPauseResume(t *testing.T) {
+	const size = 256 * 1024
+	server := slowServer(size)
+	defer server.Close()
+	sum := sha256.Sum256(bytes.Repeat([]byte("x"), size))
+
+	tasks := NewTaskManager(1)
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	download.Checksum, _ = ParseChecksum("sha256:" + hex.EncodeToString(sum[:]))
+	id := tasks.Enqueue(download)
+
+	waitFor(t, "download to start", func() bool { return download.Status().DownloadedBytes > 0 })
+	tasks.Pause(id)
+	waitFor(t, "download to pause", func() bool { return download.State() == "paused" })
+	tasks.Resume(id)
+	waitFor(t, "download to finish", func() bool { return download.State() == "completed" })
+
+	status := download.Status()
+	if !status.Verified || status.Digest != download.Checksum.String() {
+		t.Fatalf("expected a verified download, got %+v", status)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	server := slowServer(4096)
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	download.Checksum, _ = ParseChecksum("md5:" + strings.Repeat("0", 32))
+	download.Resume()
+
+	if download.State() != "failed" || !strings.Contains(download.Status().Error, "checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %+v", download.Status())
+	}
+}
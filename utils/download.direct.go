@@ -1,9 +1,22 @@
 package utils
 
-func DoDownload(Downloads map[string]*DownloadFile, download *DownloadFile) {
-	Downloads[download.Url] = download
-	if !download.Resume() {
-		delete(Downloads, download.Url)
+// doDownload runs a task taken from the queue in its slot, then hands the
+// slot to the next queued task.
+func (m *TaskManager) doDownload(download *DownloadFile) {
+	keep := download.Resume()
+
+	m.mu.Lock()
+	m.active--
+	if !keep {
+		delete(m.downloads, download.ID)
 	}
+	m.mu.Unlock()
 
+	if download.State() == "completed" {
+		go m.runPipeline(download)
+	}
+	if keep {
+		m.scheduleRetry(download)
+	}
+	m.dispatch()
 }
@@ -0,0 +1,264 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// What to do when the output file of a new task already exists.
+const (
+	ConflictOverwrite = "overwrite" // replace the existing file once the task completes
+	ConflictRename    = "rename"    // number the new file, name (1).ext
+	ConflictReject    = "reject"    // fail the task
+)
+
+// ErrFileExists is returned by the reject policy.
+var ErrFileExists = errors.New("file already exists")
+
+// ParseConflict validates an on_conflict value. An empty value keeps the
+// default: existing files with an explicit name are resumed, detected names
+// are numbered.
+func ParseConflict(value string) (string, error) {
+	switch value {
+	case "", ConflictOverwrite, ConflictRename, ConflictReject:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid conflict policy %q, expected overwrite, rename or reject", value)
+}
+
+// extensions maps common MIME types to the extension a file of that type
+// should have. Other types fall back to the mime package tables.
+var extensions = map[string]string{
+	"application/gzip":                        ".gz",
+	"application/json":                        ".json",
+	"application/pdf":                         ".pdf",
+	"application/vnd.android.package-archive": ".apk",
+	"application/x-7z-compressed":             ".7z",
+	"application/x-bittorrent":                ".torrent",
+	"application/x-gzip":                      ".gz",
+	"application/x-iso9660-image":             ".iso",
+	"application/x-rar-compressed":            ".rar",
+	"application/x-tar":                       ".tar",
+	"application/x-xz":                        ".xz",
+	"application/zip":                         ".zip",
+	"audio/mpeg":                              ".mp3",
+	"audio/ogg":                               ".ogg",
+	"image/gif":                               ".gif",
+	"image/jpeg":                              ".jpg",
+	"image/png":                               ".png",
+	"image/webp":                              ".webp",
+	"text/html":                               ".html",
+	"text/plain":                              ".txt",
+	"video/mp4":                               ".mp4",
+	"video/webm":                              ".webm",
+	"video/x-matroska":                        ".mkv",
+}
+
+// scriptExtensions name the page that served a file rather than the file itself.
+var scriptExtensions = map[string]bool{".php": true, ".asp": true, ".aspx": true, ".jsp": true, ".cgi": true}
+
+// detectName asks the origin for the start of the file and picks a name for
+// it from Content-Disposition or the URL, adding an extension from the
+// Content-Type or the content itself when the name has none.
+func (d *DownloadFile) detectName() (name string, err error) {
+	for _, link := range d.sources() {
+		if name, err = d.detectNameFrom(link); err == nil {
+			return name, nil
+		}
+	}
+	return "", err
+}
+
+func (d *DownloadFile) detectNameFrom(link string) (string, error) {
+	if d.Kind == KindHLS {
+		return hlsName(link), nil
+	}
+	if isFTP(link) || isSFTP(link) {
+		return nameFromResponse(link, http.Header{}, nil), nil
+	}
+	req, err := d.newRequest("GET", link)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Range", "bytes=0-511")
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return "", &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(resp.Body, head)
+	return nameFromResponse(link, resp.Header, head[:n]), nil
+}
+
+func nameFromResponse(link string, header http.Header, head []byte) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		// the mime package decodes RFC 5987 filename* into filename
+		name = params["filename"]
+	}
+	if name == "" {
+		if parsed, err := url.Parse(link); err == nil {
+			name = path.Base(parsed.Path)
+		}
+	}
+	name = SanitizeName(name)
+
+	ext := path.Ext(name)
+	if ext == "" || scriptExtensions[strings.ToLower(ext)] {
+		contentType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		if (contentType == "" || contentType == "application/octet-stream") && len(head) > 0 {
+			contentType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+		}
+		if guessed := extensionFor(contentType); guessed != "" {
+			name = strings.TrimSuffix(name, ext) + guessed
+		}
+	}
+	if name == "" || (strings.HasPrefix(name, ".") && path.Ext(name) == name) {
+		name = "download" + name
+	}
+	return name
+}
+
+func extensionFor(contentType string) string {
+	if ext, ok := extensions[contentType]; ok {
+		return ext
+	}
+	if contentType == "application/octet-stream" {
+		return ""
+	}
+	if exts, err := mime.ExtensionsByType(contentType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// SanitizeName turns name into a single safe path element: directories,
+// control characters and characters reserved on common filesystems are
+// dropped, and the result is limited to 255 bytes.
+func SanitizeName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	if name == "/" {
+		name = ""
+	}
+	for len(name) > 255 {
+		ext := path.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		stem := strings.TrimSuffix(name, ext)
+		_, size := utf8.DecodeLastRuneInString(stem)
+		name = stem[:len(stem)-size] + ext
+	}
+	return name
+}
+
+// resolveConflict applies policy to fname and returns the file to write to.
+// Numbered names are reserved right away by creating their .part file, so
+// that concurrent tasks can not pick the same one while nothing shows at the
+// final name until the task completes. Overwritten files are kept until then
+// too: the task starts over with an empty .part file, which the final
+// rename puts in their place.
+func resolveConflict(fname, policy string) (string, error) {
+	switch policy {
+	case ConflictOverwrite:
+		part := partName(fname)
+		if err := os.Remove(part + ".json"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if err := os.RemoveAll(part); err != nil {
+			return "", err
+		}
+		file, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return "", err
+		}
+		file.Close()
+		return fname, nil
+	case ConflictReject:
+		if _, err := os.Stat(fname); err == nil {
+			return "", fmt.Errorf("%w: %s", ErrFileExists, filepath.Base(fname))
+		}
+		return fname, nil
+	case ConflictRename:
+		ext := path.Ext(fname)
+		stem := strings.TrimSuffix(fname, ext)
+		for i := 0; ; i++ {
+			candidate := fname
+			if i > 0 {
+				candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+			}
+			if _, err := os.Lstat(candidate); err == nil {
+				continue
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+			file, err := os.OpenFile(partName(candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err == nil {
+				file.Close()
+				return candidate, nil
+			}
+			if !errors.Is(err, fs.ErrExist) {
+				return "", err
+			}
+		}
+	}
+	return fname, nil
+}
+
+// prepareName settles the output file of a task the first time it runs:
+// the name is detected when none was given, then the conflict policy is
+// applied once.
+func (d *DownloadFile) prepareName() error {
+	return d.settleName(d.detectName)
+}
+
+// settleName is prepareName with the name detected by detect.
+func (d *DownloadFile) settleName(detect func() (string, error)) error {
+	d.mu.Lock()
+	fname, policy := d.Fname, d.Conflict
+	d.mu.Unlock()
+
+	if fname == "" {
+		name, err := detect()
+		if err != nil {
+			return err
+		}
+		fname = path.Join(d.dir, name)
+		if policy == "" {
+			policy = ConflictRename
+		}
+	}
+	fname, err := resolveConflict(fname, policy)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.Fname = fname
+	d.Conflict = ""
+	d.mu.Unlock()
+	return nil
+}
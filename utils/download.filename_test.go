@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNameFromResponse(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	cases := []struct {
+		link, disposition, contentType string
+		head                           []byte
+		want                           string
+	}{
+		{"http://host/download.php?id=1", `attachment; filename="report.pdf"`, "application/pdf", nil, "report.pdf"},
+		{"http://host/get", `attachment; filename*=UTF-8''%E2%82%AC%20rates.csv`, "", nil, "€ rates.csv"},
+		{"http://host/files/archive.zip", "", "", nil, "archive.zip"},
+		{"http://host/download.php", "", "application/zip", nil, "download.zip"},
+		{"http://host/", "", "", png, "download.png"},
+		{"http://host/image", "", "application/octet-stream", png, "image.png"},
+		{"http://host/x", `attachment; filename="../../etc/passwd"`, "", nil, "passwd"},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		if c.disposition != "" {
+			header.Set("Content-Disposition", c.disposition)
+		}
+		if c.contentType != "" {
+			header.Set("Content-Type", c.contentType)
+		}
+		if got := nameFromResponse(c.link, header, c.head); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.link, got, c.want)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	for name, want := range map[string]string{
+		`a<b>:c"d|e?f*.txt`: "abcdef.txt",
+		"..\\..\\boot.ini":  "boot.ini",
+		" .hidden. ":        "hidden",
+		"tab\there":         "tabhere",
+		"..":                "",
+	} {
+		if got := SanitizeName(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+	if got := SanitizeName(strings.Repeat("a", 300) + ".mkv"); len(got) != 255 || !strings.HasSuffix(got, ".mkv") {
+		t.Errorf("expected a 255 byte name keeping the extension, got %d bytes", len(got))
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "file.txt")
+	os.WriteFile(fname, []byte("old"), 0644)
+
+	if _, err := resolveConflict(fname, ConflictReject); !errors.Is(err, ErrFileExists) {
+		t.Fatalf("expected reject to fail, got %v", err)
+	}
+	for _, want := range []string{"file (1).txt", "file (2).txt"} {
+		got, err := resolveConflict(fname, ConflictRename)
+		if err != nil || filepath.Base(got) != want {
+			t.Fatalf("expected %s, got %s %v", want, got, err)
+		}
+		// the name is reserved through the .part file, out of sight
+		if _, err := os.Stat(got); !os.IsNotExist(err) {
+			t.Fatalf("expected nothing at %s until the task completes", want)
+		}
+	}
+	os.WriteFile(partName(fname), []byte("stale"), 0644)
+	os.WriteFile(partName(fname)+".json", []byte("{}"), 0600)
+	if got, err := resolveConflict(fname, ConflictOverwrite); err != nil || got != fname {
+		t.Fatalf("expected overwrite to keep the name, got %s %v", got, err)
+	}
+	if got, _ := os.ReadFile(fname); string(got) != "old" {
+		t.Fatal("expected overwrite to keep the old file until the task completes")
+	}
+	if info, err := os.Stat(partName(fname)); err != nil || info.Size() != 0 {
+		t.Fatalf("expected an empty .part file, got %v %v", info, err)
+	}
+	if _, err := os.Stat(partName(fname) + ".json"); !os.IsNotExist(err) {
+		t.Fatal("expected the stale sidecar to be removed")
+	}
+}
+
+func TestOverwriteKeepsFileOnFailure(t *testing.T) {
+	var available atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("fresh"))
+	}))
+	defer server.Close()
+
+	fname := filepath.Join(t.TempDir(), "data.bin")
+	os.WriteFile(fname, []byte("good copy"), 0644)
+
+	download := NewDownloader(server.URL+"/dl", filepath.Dir(fname), "data.bin")
+	download.Conflict = ConflictOverwrite
+	download.Resume()
+	if download.State() != "failed" {
+		t.Fatalf("expected the download to fail, got %s", download.State())
+	}
+	if got, _ := os.ReadFile(fname); string(got) != "good copy" {
+		t.Fatalf("expected the existing file to be kept, got %q", got)
+	}
+
+	available.Store(true)
+	download = NewDownloader(server.URL+"/dl", filepath.Dir(fname), "data.bin")
+	download.Conflict = ConflictOverwrite
+	download.Resume()
+	if got, _ := os.ReadFile(fname); download.State() != "completed" || string(got) != "fresh" {
+		t.Fatalf("expected the file to be replaced, got %s %q", download.State(), got)
+	}
+}
+
+func TestDetectedNameIsNumbered(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="data.bin"`)
+		w.Write([]byte("fresh"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "data.bin"), []byte("someone else's file"), 0644)
+
+	download := NewDownloader(server.URL+"/dl", dir, "")
+	download.Resume()
+
+	if download.State() != "completed" || download.Status().Fname != filepath.Join(dir, "data (1).bin") {
+		t.Fatalf("expected data (1).bin to be downloaded, got %+v", download.Status())
+	}
+	if got, _ := os.ReadFile(download.Fname); string(got) != "fresh" {
+		t.Fatalf("unexpected content %q", got)
+	}
+}
@@ -0,0 +1,360 @@
+package utils
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ftpTimeout bounds connecting and every command on the control connection.
+const ftpTimeout = 30 * time.Second
+
+// ftpTLSConfig is the base TLS configuration of ftps:// sources.
+var ftpTLSConfig = &tls.Config{}
+
+// FTPError is a negative reply of an FTP server.
+type FTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *FTPError) Error() string { return fmt.Sprintf("ftp: %d %s", e.Code, e.Message) }
+
+func isFTP(link string) bool {
+	return strings.HasPrefix(link, "ftp://") || strings.HasPrefix(link, "ftps://")
+}
+
+// ftpConn is the control connection of an FTP session in binary mode.
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+	tls  *tls.Config // set when the data connections are encrypted
+}
+
+// dialFTP connects and logs in to the server of link, with the credentials of
+// the URL or anonymously. ftps:// negotiates TLS with AUTH TLS, or connects
+// over TLS right away on port 990.
+func dialFTP(link *url.URL) (*ftpConn, error) {
+	host := link.Hostname()
+	port := link.Port()
+	if port == "" {
+		port = "21"
+	}
+	var config *tls.Config
+	if link.Scheme == "ftps" {
+		config = ftpTLSConfig.Clone()
+		config.ServerName = host
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(1) // data connections reuse the session
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), ftpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil && port == "990" {
+		conn = tls.Client(conn, config)
+	}
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	if _, _, err := c.cmd(220, ""); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if config != nil {
+		if _, ok := conn.(*tls.Conn); !ok {
+			if _, _, err := c.cmd(234, "AUTH TLS"); err != nil {
+				c.Close()
+				return nil, err
+			}
+			c.conn = tls.Client(conn, config)
+			c.text = textproto.NewConn(c.conn)
+		}
+		if _, _, err := c.cmd(200, "PBSZ 0"); err != nil {
+			c.Close()
+			return nil, err
+		}
+		if _, _, err := c.cmd(200, "PROT P"); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.tls = config
+	}
+
+	if err := c.login(link.User); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, _, err := c.cmd(200, "TYPE I"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkFTPLine refuses a user, password or path with a line break, which
+// the decoded URL may hold and which would end the command sent with it and
+// start another one on the control connection.
+func checkFTPLine(link *url.URL) error {
+	values := []string{link.Path}
+	if link.User != nil {
+		password, _ := link.User.Password()
+		values = append(values, link.User.Username(), password)
+	}
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("the FTP user, password and path can not contain line breaks")
+		}
+	}
+	return nil
+}
+
+func (c *ftpConn) login(user *url.Userinfo) error {
+	username, password := "anonymous", "anonymous@"
+	if user != nil {
+		username = user.Username()
+		if p, ok := user.Password(); ok {
+			password = p
+		}
+	}
+	code, message, err := c.cmd(0, "USER %s", username)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230:
+		return nil
+	case 331, 332:
+		_, _, err = c.cmd(230, "PASS %s", password)
+		return err
+	}
+	return &FTPError{Code: code, Message: message}
+}
+
+// cmd sends a command, unless format is empty, and reads the reply. A reply
+// other than code, or of another class when code is a single digit, is
+// returned as an *FTPError; 0 accepts any reply.
+func (c *ftpConn) cmd(code int, format string, args ...any) (int, string, error) {
+	c.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	if format != "" {
+		if err := c.text.PrintfLine(format, args...); err != nil {
+			return 0, "", err
+		}
+	}
+	got, message, err := c.text.ReadResponse(code)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return got, message, &FTPError{Code: protoErr.Code, Message: protoErr.Msg}
+	}
+	return got, message, err
+}
+
+// size returns the size of the file at name, or -1 when the server does not tell.
+func (c *ftpConn) size(name string) int64 {
+	_, message, err := c.cmd(213, "SIZE %s", name)
+	if err != nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(message), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// modTime returns the modification time of the file at name as sent by
+// MDTM, or "" when the server does not tell.
+func (c *ftpConn) modTime(name string) string {
+	_, message, err := c.cmd(213, "MDTM %s", name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(message)
+}
+
+// passive opens a data connection in extended passive mode, falling back to
+// PASV for servers without EPSV. The data connection always goes to the
+// host of the control connection.
+func (c *ftpConn) passive() (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	port, err := c.epsv()
+	if err != nil {
+		if port, err = c.pasv(); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), ftpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if c.tls != nil {
+		conn = tls.Client(conn, c.tls)
+	}
+	return conn, nil
+}
+
+// epsv parses "229 Entering Extended Passive Mode (|||6446|)".
+func (c *ftpConn) epsv() (int, error) {
+	_, message, err := c.cmd(229, "EPSV")
+	if err != nil {
+		return 0, err
+	}
+	start, end := strings.Index(message, "(|||"), strings.LastIndex(message, "|)")
+	if start < 0 || end < start+4 {
+		return 0, fmt.Errorf("ftp: invalid EPSV reply %q", message)
+	}
+	port, err := strconv.Atoi(message[start+4 : end])
+	if err != nil {
+		return 0, fmt.Errorf("ftp: invalid EPSV reply %q", message)
+	}
+	return port, nil
+}
+
+// pasv parses "227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)".
+func (c *ftpConn) pasv() (int, error) {
+	_, message, err := c.cmd(227, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	start, end := strings.Index(message, "("), strings.LastIndex(message, ")")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("ftp: invalid PASV reply %q", message)
+	}
+	fields := strings.Split(message[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("ftp: invalid PASV reply %q", message)
+	}
+	high, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	low, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("ftp: invalid PASV reply %q", message)
+	}
+	return high<<8 | low, nil
+}
+
+// retrieve starts downloading name from offset. It returns the offset the
+// server agreed to, 0 when it refused REST.
+func (c *ftpConn) retrieve(name string, offset int64) (*ftpData, int64, error) {
+	conn, err := c.passive()
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		if _, _, err := c.cmd(350, "REST %d", offset); err != nil {
+			log.Printf("[*] FTP server refused REST, downloading from the start: %v", err)
+			offset = 0
+		}
+	}
+	if _, _, err := c.cmd(1, "RETR %s", name); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	// the transfer may last longer than any command
+	c.conn.SetDeadline(time.Time{})
+	return &ftpData{Conn: conn, control: c}, offset, nil
+}
+
+func (c *ftpConn) Close() error {
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	c.text.PrintfLine("QUIT")
+	return c.conn.Close()
+}
+
+// ftpData is the data connection of a RETR. It only reports io.EOF once the
+// server confirmed the whole file was sent.
+type ftpData struct {
+	net.Conn
+	control *ftpConn
+	done    bool
+}
+
+func (f *ftpData) Read(p []byte) (int, error) {
+	n, err := f.Conn.Read(p)
+	if err == io.EOF && !f.done {
+		f.done = true
+		f.Conn.Close()
+		if _, _, err := f.control.cmd(2, ""); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// resumeFTP downloads the rest of the file from an ftp:// or ftps:// link,
+// continuing with REST from the end of the .part file. The MDTM time of the
+// file stands in for Last-Modified to notice when the file changed.
+func (d *DownloadFile) resumeFTP(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		log_and_set_error(d, "error parsing the FTP URL", err)
+		return true
+	}
+	name := u.Path
+	if name == "" || strings.HasSuffix(name, "/") {
+		log_and_set_error(d, "error resuming download", fmt.Errorf("%s is not a file", path.Base(name)))
+		return true
+	}
+	if err := checkFTPLine(u); err != nil {
+		log_and_set_error(d, "error resuming download", err)
+		return true
+	}
+
+	conn, err := dialFTP(u)
+	if err != nil {
+		log_and_set_error(d, "error connecting to the FTP server", err)
+		return true
+	}
+	defer conn.Close()
+	size, modified := conn.size(name), conn.modTime(name)
+
+	var offset int64
+	if info, err := os.Stat(d.partName()); err == nil {
+		offset = info.Size()
+	}
+	offset, ok := d.resumeOffset(link, offset, size, modified)
+	if !ok {
+		log_and_set_error(d, "error resuming download", ErrMirrorMismatch)
+		return true
+	}
+
+	flags := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+	var data io.ReadCloser = io.NopCloser(strings.NewReader(""))
+	if offset == 0 || offset != size {
+		retr, agreed, err := conn.retrieve(name, offset)
+		if err != nil {
+			log_and_set_error(d, "error starting the FTP transfer", err)
+			return true
+		}
+		defer retr.Close()
+		data, offset = retr, agreed
+	}
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	if size < 0 {
+		size = 0 // unknown
+	}
+	d.mu.Lock()
+	d.Origin = link
+	d.ETag, d.LastModified = "", modified
+	d.Size = size
+	d.Started = time.Now()
+	d.mu.Unlock()
+	atomic.StoreInt64(&d.DownloadedSize, offset)
+
+	slow := d.watchSpeed(data)
+	defer slow.Stop()
+	return d.receive(data, flags, slow)
+}
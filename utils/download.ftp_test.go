@@ -0,0 +1,294 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ftpServer is a minimal in-process FTP server serving files in passive mode.
+type ftpServer struct {
+	listener net.Listener
+	files    map[string][]byte
+	user     string
+	password string
+	tls      *tls.Config // enables AUTH TLS when set
+	noEPSV   bool
+	delay    atomic.Int64 // nanoseconds to wait between chunks of 4 KiB
+
+	mu    sync.Mutex
+	rests []int64
+}
+
+func newFTPServer(t *testing.T, files map[string][]byte) *ftpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ftpServer{listener: listener, files: files}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ftpServer) url(scheme, name string) string {
+	credentials := ""
+	if s.user != "" {
+		credentials = s.user + ":" + s.password + "@"
+	}
+	return scheme + "://" + credentials + s.listener.Addr().String() + name
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...any) { fmt.Fprintf(conn, format+"\r\n", args...) }
+	reply("220 ready")
+
+	var user string
+	var offset int64
+	var loggedIn, protected bool
+	var passive net.Listener
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		switch strings.ToUpper(command) {
+		case "AUTH":
+			if s.tls == nil {
+				reply("502 no TLS")
+				continue
+			}
+			reply("234 proceed")
+			tlsConn := tls.Server(conn, s.tls)
+			conn, reader = tlsConn, bufio.NewReader(tlsConn)
+		case "PBSZ":
+			reply("200 ok")
+		case "PROT":
+			protected = arg == "P"
+			reply("200 ok")
+		case "USER":
+			user = arg
+			reply("331 password please")
+		case "PASS":
+			if s.user != "" && (user != s.user || arg != s.password) {
+				reply("530 login incorrect")
+				continue
+			}
+			loggedIn = true
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 binary")
+		case "SIZE", "MDTM", "RETR":
+			content, ok := s.files[arg]
+			if !loggedIn || !ok {
+				reply("550 no such file")
+				continue
+			}
+			switch strings.ToUpper(command) {
+			case "SIZE":
+				reply("213 %d", len(content))
+			case "MDTM":
+				reply("213 20240102030405")
+			case "RETR":
+				s.retrieve(conn, passive, content[offset:], protected, reply)
+				passive, offset = nil, 0
+			}
+		case "EPSV", "PASV":
+			if s.noEPSV && command == "EPSV" {
+				reply("500 not understood")
+				continue
+			}
+			if passive, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			port := passive.Addr().(*net.TCPAddr).Port
+			if command == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				reply("227 Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			s.mu.Lock()
+			s.rests = append(s.rests, offset)
+			s.mu.Unlock()
+			reply("350 restarting")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *ftpServer) retrieve(conn net.Conn, passive net.Listener, content []byte, protected bool, reply func(string, ...any)) {
+	if passive == nil {
+		reply("425 use PASV first")
+		return
+	}
+	defer passive.Close()
+	reply("150 opening data connection")
+	data, err := passive.Accept()
+	if err != nil {
+		return
+	}
+	if protected {
+		data = tls.Server(data, s.tls)
+	}
+	for len(content) > 0 {
+		n := min(len(content), 4096)
+		if _, err := data.Write(content[:n]); err != nil {
+			data.Close()
+			reply("426 transfer aborted")
+			return
+		}
+		content = content[n:]
+		time.Sleep(time.Duration(s.delay.Load()))
+	}
+	data.Close()
+	reply("226 transfer complete")
+}
+
+func (s *ftpServer) restOffsets() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.rests...)
+}
+
+func TestFTPDownload(t *testing.T) {
+	content := make([]byte, 100*1024+3)
+	rand.Read(content)
+	server := newFTPServer(t, map[string][]byte{"/pub/file.bin": content})
+	server.user, server.password = "alice", "s3cret"
+	server.noEPSV = true
+
+	download := NewDownloader(server.url("ftp", "/pub/file.bin"), t.TempDir(), "")
+	download.Resume()
+
+	if download.State() != "completed" {
+		t.Fatalf("expected the download to complete, got %s: %v", download.State(), download.Error)
+	}
+	got, err := os.ReadFile(download.Fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) || !strings.HasSuffix(download.Fname, "/file.bin") {
+		t.Fatalf("unexpected download %s", download.Fname)
+	}
+	if status := download.Status(); strings.Contains(status.Url, "s3cret") || status.Size != int64(len(content)) {
+		t.Fatalf("expected the size and a redacted URL, got %q %d", status.Url, status.Size)
+	}
+
+	download = NewDownloader(strings.Replace(server.url("ftp", "/pub/file.bin"), "s3cret", "wrong", 1), t.TempDir(), "file.bin")
+	download.Resume()
+	if download.State() != "failed" || !strings.Contains(download.Error.Error(), "530") {
+		t.Fatalf("expected the login to fail, got %s: %v", download.State(), download.Error)
+	}
+
+	for _, link := range []string{
+		server.url("ftp", "/pub/file.bin%0D%0ADELE%20/pub/file.bin"),
+		strings.Replace(server.url("ftp", "/pub/file.bin"), "alice", "alice%0D%0ADELE%20%2Fpub%2Ffile.bin", 1),
+		strings.Replace(server.url("ftp", "/pub/file.bin"), "s3cret", "s3cret%0ADELE%20%2Fpub%2Ffile.bin", 1),
+	} {
+		download = NewDownloader(link, t.TempDir(), "file.bin")
+		download.Resume()
+		if download.State() != "failed" || !strings.Contains(download.Error.Error(), "line breaks") {
+			t.Fatalf("expected %s to be refused, got %s: %v", link, download.State(), download.Error)
+		}
+	}
+}
+
+func TestFTPPauseResumeCancel(t *testing.T) {
+	content := make([]byte, 512*1024)
+	rand.Read(content)
+	server := newFTPServer(t, map[string][]byte{"/file.bin": content})
+	server.delay.Store(int64(5 * time.Millisecond))
+
+	download := NewDownloader(server.url("ftp", "/file.bin"), t.TempDir(), "file.bin")
+	done := make(chan bool)
+	go func() { done <- download.Resume() }()
+	waitFor(t, "download to start", func() bool { return download.Status().DownloadedBytes > 0 })
+	download.Pause()
+	<-done
+	if download.State() != "paused" {
+		t.Fatalf("expected the download to pause, got %s", download.State())
+	}
+
+	server.delay.Store(0)
+	download.Resume()
+	if download.State() != "completed" {
+		t.Fatalf("expected the download to complete, got %s: %v", download.State(), download.Error)
+	}
+	if rests := server.restOffsets(); len(rests) != 1 || rests[0] == 0 {
+		t.Fatalf("expected the download to resume with REST, got %v", rests)
+	}
+	got, err := os.ReadFile(download.Fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content does not match")
+	}
+
+	server.delay.Store(int64(5 * time.Millisecond))
+	download = NewDownloader(server.url("ftp", "/file.bin"), t.TempDir(), "other.bin")
+	go func() { done <- download.Resume() }()
+	waitFor(t, "download to start", func() bool { return download.Status().DownloadedBytes > 0 })
+	download.Cancel()
+	<-done
+	if download.State() != "canceled" {
+		t.Fatalf("expected the download to be canceled, got %s", download.State())
+	}
+}
+
+func TestFTPS(t *testing.T) {
+	// borrow the certificate of a TLS test server, valid for 127.0.0.1
+	certified := httptest.NewTLSServer(nil)
+	defer certified.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(certified.Certificate())
+	defer func(config *tls.Config) { ftpTLSConfig = config }(ftpTLSConfig)
+	ftpTLSConfig = &tls.Config{RootCAs: roots}
+
+	content := []byte("encrypted all the way")
+	server := newFTPServer(t, map[string][]byte{"/file.txt": content})
+	server.tls = certified.TLS
+
+	download := NewDownloader(server.url("ftps", "/file.txt"), t.TempDir(), "file.txt")
+	download.Resume()
+	if download.State() != "completed" {
+		t.Fatalf("expected the download to complete, got %s: %v", download.State(), download.Error)
+	}
+	got, err := os.ReadFile(download.Fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content does not match")
+	}
+}
@@ -0,0 +1,620 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ffmpegPath is the ffmpeg binary used to remux HLS downloads.
+var ffmpegPath = "ffmpeg"
+
+// maxPlaylistSize caps the playlists and keys read for HLS tasks.
+const maxPlaylistSize = 8 << 20
+
+// HLSOptions pick the variant of an HLS master playlist: the highest
+// bandwidth within the limits, or the lowest one when none fits. The variant
+// picked on the first run is recorded so that resumes stay on it.
+type HLSOptions struct {
+	MaxBandwidth int64       `json:"max_bandwidth,omitempty"` // bits per second
+	MaxHeight    int         `json:"max_height,omitempty"`    // pixels
+	Variant      *HLSVariant `json:"variant,omitempty"`
+}
+
+// HLSVariant is a stream of a master playlist.
+type HLSVariant struct {
+	Playlist   string `json:"playlist"`
+	Bandwidth  int64  `json:"bandwidth,omitempty"`
+	Resolution string `json:"resolution,omitempty"`
+	height     int
+}
+
+// HLSStatus is the progress of an HLS task reported by /status.
+type HLSStatus struct {
+	Variant       *HLSVariant `json:"variant,omitempty"`
+	SegmentsDone  int         `json:"segments_done"`
+	SegmentsTotal int         `json:"segments_total"`
+}
+
+// NewHLSDownloader creates a task downloading the HLS stream of the playlist
+// at url. With an empty fname the name is taken from the playlist URL.
+func NewHLSDownloader(url, dir, fname string, options *HLSOptions) *DownloadFile {
+	d := NewDownloader(url, dir, fname)
+	d.Kind = KindHLS
+	d.HLS = options
+	return d
+}
+
+// ParseResolution reads a resolution limit such as "720", "720p" or
+// "1280x720" and returns its height.
+func ParseResolution(value string) (int, error) {
+	value = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "p")
+	if _, height, ok := strings.Cut(value, "x"); ok {
+		value = height
+	}
+	height, err := strconv.Atoi(value)
+	if err != nil || height <= 0 {
+		return 0, fmt.Errorf("invalid resolution %q, expected a height such as 720 or 1280x720", value)
+	}
+	return height, nil
+}
+
+// hlsSegment is a media segment, or the initialization section of fMP4
+// streams, and where it is saved in the working directory.
+type hlsSegment struct {
+	uri    string
+	offset int64 // byte range, length -1 for the whole resource
+	length int64
+	key    *hlsKey
+	file   string
+}
+
+// hlsKey decrypts AES-128 segments.
+type hlsKey struct {
+	uri string
+	iv  []byte
+}
+
+type hlsPlaylist struct {
+	variants []*HLSVariant
+	segments []*hlsSegment
+	live     bool // no #EXT-X-ENDLIST, only the segments listed are downloaded
+}
+
+// parsePlaylist reads a master or media playlist, resolving its URIs
+// against base.
+func parsePlaylist(base *url.URL, r io.Reader) (*hlsPlaylist, error) {
+	playlist := &hlsPlaylist{live: true}
+	resolve := func(uri string) (string, error) {
+		ref, err := url.Parse(uri)
+		if err != nil {
+			return "", fmt.Errorf("invalid URI %q in playlist", uri)
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+
+	var variant *HLSVariant
+	var key *hlsKey
+	var sequence, nextOffset int64
+	rangeOffset, rangeLength := int64(0), int64(-1)
+	scanner := bufio.NewScanner(r)
+	for line := 0; scanner.Scan(); {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if line++; line == 1 && text != "#EXTM3U" {
+			return nil, errors.New("not an HLS playlist, missing #EXTM3U")
+		}
+		tag, value, _ := strings.Cut(text, ":")
+		switch {
+		case tag == "#EXT-X-STREAM-INF":
+			attrs := parseAttributes(value)
+			variant = &HLSVariant{Resolution: attrs["RESOLUTION"]}
+			variant.Bandwidth, _ = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			if _, height, ok := strings.Cut(variant.Resolution, "x"); ok {
+				variant.height, _ = strconv.Atoi(height)
+			}
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			sequence, _ = strconv.ParseInt(value, 10, 64)
+		case tag == "#EXT-X-ENDLIST":
+			playlist.live = false
+		case tag == "#EXT-X-KEY":
+			attrs := parseAttributes(value)
+			switch attrs["METHOD"] {
+			case "NONE":
+				key = nil
+			case "AES-128":
+				uri, err := resolve(attrs["URI"])
+				if err != nil {
+					return nil, err
+				}
+				key = &hlsKey{uri: uri}
+				if iv := attrs["IV"]; iv != "" {
+					raw, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+					if err != nil || len(raw) != aes.BlockSize {
+						return nil, fmt.Errorf("invalid IV %q in playlist", iv)
+					}
+					key.iv = raw
+				}
+			default:
+				return nil, fmt.Errorf("unsupported encryption method %q", attrs["METHOD"])
+			}
+		case tag == "#EXT-X-MAP":
+			attrs := parseAttributes(value)
+			uri, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			init := &hlsSegment{uri: uri, length: -1, file: fmt.Sprintf("init-%05d.mp4", len(playlist.segments))}
+			if byteRange := attrs["BYTERANGE"]; byteRange != "" {
+				if init.length, init.offset, err = parseByteRange(byteRange, 0); err != nil {
+					return nil, err
+				}
+			}
+			playlist.segments = append(playlist.segments, init)
+		case tag == "#EXT-X-BYTERANGE":
+			var err error
+			if rangeLength, rangeOffset, err = parseByteRange(value, nextOffset); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(text, "#"):
+			// #EXTINF and the tags not needed to fetch the stream
+		case variant != nil:
+			uri, err := resolve(text)
+			if err != nil {
+				return nil, err
+			}
+			variant.Playlist = uri
+			playlist.variants = append(playlist.variants, variant)
+			variant = nil
+		default:
+			uri, err := resolve(text)
+			if err != nil {
+				return nil, err
+			}
+			segment := &hlsSegment{uri: uri, offset: rangeOffset, length: rangeLength, file: fmt.Sprintf("seg-%05d.ts", len(playlist.segments))}
+			if key != nil {
+				segment.key = &hlsKey{uri: key.uri, iv: key.iv}
+				if segment.key.iv == nil {
+					// the media sequence number is the default IV
+					segment.key.iv = make([]byte, aes.BlockSize)
+					binary.BigEndian.PutUint64(segment.key.iv[8:], uint64(sequence))
+				}
+			}
+			playlist.segments = append(playlist.segments, segment)
+			nextOffset = rangeOffset + rangeLength
+			sequence++
+			rangeOffset, rangeLength = 0, -1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(playlist.variants) == 0 && len(playlist.segments) == 0 {
+		return nil, errors.New("empty HLS playlist")
+	}
+	return playlist, nil
+}
+
+// parseAttributes reads an attribute list such as
+// BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2".
+func parseAttributes(list string) map[string]string {
+	attrs := make(map[string]string)
+	for list != "" {
+		name, rest, ok := strings.Cut(list, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+			_, rest, _ = strings.Cut(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(name)] = value
+		list = rest
+	}
+	return attrs
+}
+
+// parseByteRange reads "<length>[@<offset>]", the offset defaulting to next.
+func parseByteRange(value string, next int64) (length, offset int64, err error) {
+	lengthText, offsetText, hasOffset := strings.Cut(value, "@")
+	length, err = strconv.ParseInt(lengthText, 10, 64)
+	offset = next
+	if err == nil && hasOffset {
+		offset, err = strconv.ParseInt(offsetText, 10, 64)
+	}
+	if err != nil || length < 0 || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid byte range %q in playlist", value)
+	}
+	return length, offset, nil
+}
+
+// pickVariant returns the highest bandwidth variant within the limits of
+// options, or the lowest bandwidth one when none fits.
+func pickVariant(variants []*HLSVariant, options *HLSOptions) *HLSVariant {
+	sorted := append([]*HLSVariant(nil), variants...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Bandwidth > sorted[j].Bandwidth })
+	if options == nil {
+		return sorted[0]
+	}
+	for _, variant := range sorted {
+		if options.MaxBandwidth > 0 && variant.Bandwidth > options.MaxBandwidth {
+			continue
+		}
+		if options.MaxHeight > 0 && variant.height > options.MaxHeight {
+			continue
+		}
+		return variant
+	}
+	return sorted[len(sorted)-1]
+}
+
+// hlsName names the output of a playlist after it, or after its directory
+// for the usual generic playlist names.
+func hlsName(link string) string {
+	ext := ".ts"
+	if _, err := exec.LookPath(ffmpegPath); err == nil {
+		ext = ".mp4"
+	}
+	var name string
+	if parsed, err := url.Parse(link); err == nil {
+		name = strings.TrimSuffix(path.Base(parsed.Path), path.Ext(parsed.Path))
+		switch strings.ToLower(name) {
+		case "index", "master", "playlist", "prog_index", "chunklist", "manifest":
+			name = path.Base(path.Dir(parsed.Path))
+		}
+	}
+	if name = SanitizeName(name); name == "" || name == "." || name == "/" {
+		name = "stream"
+	}
+	return name + ext
+}
+
+// fetchPlaylist downloads and parses the playlist at link.
+func (d *DownloadFile) fetchPlaylist(ctx context.Context, link string) (*hlsPlaylist, error) {
+	data, err := d.fetch(ctx, link, 0, -1, false)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	return parsePlaylist(base, bytes.NewReader(data))
+}
+
+// mediaPlaylist returns the media playlist of the task, picking a variant
+// of a master playlist on the first run.
+func (d *DownloadFile) mediaPlaylist(ctx context.Context) (*hlsPlaylist, error) {
+	d.mu.Lock()
+	if d.HLS == nil {
+		d.HLS = &HLSOptions{}
+	}
+	options := *d.HLS
+	d.mu.Unlock()
+	if options.Variant != nil {
+		return d.fetchPlaylist(ctx, options.Variant.Playlist)
+	}
+
+	playlist, err := d.fetchPlaylist(ctx, d.Url)
+	if err != nil || len(playlist.variants) == 0 {
+		return playlist, err
+	}
+	variant := pickVariant(playlist.variants, &options)
+	log.Printf("[*] HLS variant %s (%d b/s, %s): %s", redactURL(variant.Playlist), variant.Bandwidth, variant.Resolution, redactURL(d.Url))
+	d.mu.Lock()
+	d.HLS.Variant = variant
+	d.mu.Unlock()
+	if playlist, err = d.fetchPlaylist(ctx, variant.Playlist); err == nil && len(playlist.variants) > 0 {
+		err = errors.New("variant playlist is a master playlist")
+	}
+	return playlist, err
+}
+
+// fetch downloads a whole resource, or length bytes from offset. The bytes
+// of segments count in the progress of the task, playlists and keys are
+// limited to maxPlaylistSize.
+func (d *DownloadFile) fetch(ctx context.Context, link string, offset, length int64, segment bool) ([]byte, error) {
+	req, err := d.newRequest("GET", link)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if length >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	var data bytes.Buffer
+	buffer := make([]byte, copyBufferSize)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			d.throttle(n)
+			data.Write(buffer[:n])
+			if segment {
+				d.addProgress(n)
+			} else if data.Len() > maxPlaylistSize {
+				return nil, fmt.Errorf("%s is too large for a playlist or key", redactURL(link))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if length >= 0 && resp.StatusCode == http.StatusOK {
+		// the server ignored the range
+		if offset+length > int64(data.Len()) {
+			return nil, fmt.Errorf("byte range %d@%d beyond the end of %s", length, offset, redactURL(link))
+		}
+		return data.Bytes()[offset : offset+length], nil
+	}
+	return data.Bytes(), nil
+}
+
+// hlsKeys fetches every key once.
+type hlsKeys struct {
+	d    *DownloadFile
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func (k *hlsKeys) get(ctx context.Context, uri string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[uri]; ok {
+		return key, nil
+	}
+	key, err := k.d.fetch(ctx, uri, 0, -1, false)
+	if err != nil {
+		return nil, fmt.Errorf("fetching the key: %w", err)
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid AES-128 key of %d bytes", len(key))
+	}
+	k.keys[uri] = key
+	return key, nil
+}
+
+// decryptSegment decrypts an AES-128 CBC segment and removes its PKCS#7 padding.
+func decryptSegment(data, key, iv []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted segment is not a multiple of the block size")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("invalid padding, wrong key or IV")
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+// fetchHLSSegment downloads, decrypts and saves one segment into dir. The
+// file only appears once complete, which is what resumes go by.
+func (d *DownloadFile) fetchHLSSegment(ctx context.Context, segment *hlsSegment, dir string, keys *hlsKeys) error {
+	data, err := d.fetch(ctx, segment.uri, segment.offset, segment.length, true)
+	if err != nil {
+		return err
+	}
+	if segment.key != nil {
+		key, err := keys.get(ctx, segment.key.uri)
+		if err != nil {
+			return err
+		}
+		if data, err = decryptSegment(data, key, segment.key.iv); err != nil {
+			return err
+		}
+	}
+
+	name := filepath.Join(dir, segment.file)
+	if err := os.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// resumeHLS downloads the segments of the media playlist that are not in
+// the working directory yet, the .part directory of the task, then joins
+// them into the output file.
+func (d *DownloadFile) resumeHLS() bool {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	playlist, err := d.mediaPlaylist(ctx)
+	if err != nil {
+		log_and_set_error(d, "error loading the HLS playlist", err)
+		return true
+	}
+	if playlist.live {
+		log.Printf("[*] Live HLS playlist, downloading the %d segments listed: %s", len(playlist.segments), redactURL(d.Url))
+	}
+
+	work := d.partName()
+	// the rename conflict policy reserves the name with an empty .part file
+	if info, err := os.Stat(work); err == nil && info.Mode().IsRegular() && info.Size() == 0 {
+		os.Remove(work)
+	}
+	if err := os.MkdirAll(work, 0755); err != nil {
+		log_and_set_error(d, "error creating the working directory", err)
+		return true
+	}
+	var pending []*hlsSegment
+	var downloaded int64
+	for _, segment := range playlist.segments {
+		if info, err := os.Stat(filepath.Join(work, segment.file)); err == nil {
+			downloaded += info.Size()
+		} else {
+			pending = append(pending, segment)
+		}
+	}
+	d.mu.Lock()
+	d.hlsDone, d.hlsTotal = len(playlist.segments)-len(pending), len(playlist.segments)
+	d.Size = 0 // unknown until the stream is joined
+	d.Started = time.Now()
+	d.mu.Unlock()
+	atomic.StoreInt64(&d.DownloadedSize, downloaded)
+
+	// a pool of workers takes the pending segments in order
+	workers := max(d.Connections, 1)
+	jobs := make(chan *hlsSegment)
+	keys := &hlsKeys{d: d, keys: make(map[string][]byte)}
+	var failure error
+	var once sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for segment := range jobs {
+				if err := d.fetchHLSSegment(ctx, segment, work, keys); err != nil {
+					once.Do(func() {
+						failure = fmt.Errorf("segment %s: %w", segment.file, err)
+						stop()
+					})
+					continue
+				}
+				d.mu.Lock()
+				d.hlsDone++
+				d.mu.Unlock()
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, segment := range pending {
+			select {
+			case jobs <- segment:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-d.CancelChan:
+		stop()
+		<-finished
+		d.setCanceled()
+		return true
+	case <-d.PauseChan:
+		stop()
+		<-finished
+		d.setPaused()
+		return true
+	case <-finished:
+	}
+	if failure != nil {
+		log_and_set_error(d, "error downloading the HLS stream", failure)
+		return true
+	}
+
+	if err := d.joinHLS(work, playlist.segments); err != nil {
+		log_and_set_error(d, "error joining the HLS segments", err)
+		return true
+	}
+	d.setCompleted()
+	return true
+}
+
+// joinHLS concatenates the segments, remuxes them with ffmpeg when it is
+// available and the output is not a .ts file, and moves the result into place.
+func (d *DownloadFile) joinHLS(work string, segments []*hlsSegment) error {
+	joined := filepath.Join(work, "joined.ts")
+	out, err := os.Create(joined)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		file, err := os.Open(filepath.Join(work, segment.file))
+		if err == nil {
+			_, err = io.Copy(out, file)
+			file.Close()
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// without an extension ffmpeg can not tell the format to write, so the
+	// joined stream is kept as it is
+	result := joined
+	if ext := strings.ToLower(filepath.Ext(d.Fname)); ext != ".ts" && ext != "" {
+		if ffmpeg, err := exec.LookPath(ffmpegPath); err == nil {
+			remuxed := filepath.Join(work, "remuxed"+ext)
+			output, err := exec.Command(ffmpeg, "-y", "-loglevel", "error", "-i", joined, "-c", "copy", remuxed).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(output))
+			}
+			result = remuxed
+		}
+	}
+
+	if err := syncFile(result); err != nil {
+		return err
+	}
+	if err := os.Rename(result, d.Fname); err != nil {
+		return err
+	}
+	if err := syncFile(filepath.Dir(d.Fname)); err != nil {
+		log.Println("Error syncing the download directory:", err)
+	}
+	if err := os.RemoveAll(work); err != nil {
+		log.Println("Error removing the HLS working directory:", err)
+	}
+	os.Remove(work + ".json")
+
+	if info, err := os.Stat(d.Fname); err == nil {
+		d.mu.Lock()
+		d.Size = info.Size()
+		d.mu.Unlock()
+		atomic.StoreInt64(&d.DownloadedSize, info.Size())
+	}
+	return nil
+}
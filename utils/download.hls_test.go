@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// hlsServer serves a master playlist at /show/master.m3u8 with a 720p
+// variant and an AES-128 encrypted 360p one, six segments each. Segments
+// from block on are held until release is closed.
+type hlsServer struct {
+	*httptest.Server
+	key      []byte
+	segments map[string][]byte // plain content by path
+	block    int
+	release  chan struct{}
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func newHLSServer(t *testing.T) *hlsServer {
+	s := &hlsServer{
+		key:      []byte("0123456789abcdef"),
+		segments: make(map[string][]byte),
+		block:    -1,
+		release:  make(chan struct{}),
+		requests: make(map[string]int),
+	}
+	playlists := map[string]string{
+		"/show/master.m3u8": "#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS=\"avc1.4d401f,mp4a.40.2\"\n" +
+			"hi/index.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\n" +
+			"lo/index.m3u8\n",
+	}
+	for _, variant := range []string{"hi", "lo"} {
+		var playlist strings.Builder
+		playlist.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:7\n")
+		if variant == "lo" {
+			playlist.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/lo.key\"\n")
+		}
+		for i := 0; i < 6; i++ {
+			if variant == "lo" && i == 5 {
+				playlist.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/lo.key\",IV=0x000102030405060708090a0b0c0d0e0f\n")
+			}
+			name := fmt.Sprintf("%s/%d.ts", variant, i)
+			fmt.Fprintf(&playlist, "#EXTINF:4.0,\n%d.ts\n", i)
+			s.segments["/show/"+name] = bytes.Repeat([]byte(name), 1000+i)
+		}
+		playlist.WriteString("#EXT-X-ENDLIST\n")
+		playlists["/show/"+variant+"/index.m3u8"] = playlist.String()
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		s.mu.Unlock()
+		if playlist, ok := playlists[r.URL.Path]; ok {
+			w.Write([]byte(playlist))
+			return
+		}
+		if r.URL.Path == "/keys/lo.key" {
+			w.Write(s.key)
+			return
+		}
+		plain, ok := s.segments[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var index int
+		fmt.Sscanf(filepath.Base(r.URL.Path), "%d.ts", &index)
+		if s.block >= 0 && index >= s.block {
+			select {
+			case <-s.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if strings.Contains(r.URL.Path, "/lo/") {
+			iv := make([]byte, aes.BlockSize)
+			iv[15] = byte(7 + index)
+			if index == 5 {
+				iv = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+			}
+			plain = encryptSegment(plain, s.key, iv)
+		}
+		w.Write(plain)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *hlsServer) stream(variant string) []byte {
+	var stream []byte
+	for i := 0; i < 6; i++ {
+		stream = append(stream, s.segments[fmt.Sprintf("/show/%s/%d.ts", variant, i)]...)
+	}
+	return stream
+}
+
+func (s *hlsServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func encryptSegment(plain, key, iv []byte) []byte {
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append(append([]byte(nil), plain...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+func withFFmpeg(t *testing.T, path string) {
+	previous := ffmpegPath
+	ffmpegPath = path
+	t.Cleanup(func() { ffmpegPath = previous })
+}
+
+func TestHLSVariantAndDecryption(t *testing.T) {
+	withFFmpeg(t, filepath.Join(t.TempDir(), "no-ffmpeg"))
+	server := newHLSServer(t)
+
+	dir := t.TempDir()
+	download := NewHLSDownloader(server.URL+"/show/master.m3u8", dir, "", &HLSOptions{MaxHeight: 480})
+	download.Connections = 3
+	download.Resume()
+
+	if download.State() != "completed" {
+		t.Fatalf("expected the download to complete, got %s: %v", download.State(), download.Error)
+	}
+	if download.Fname != filepath.Join(dir, "show.ts") {
+		t.Fatalf("expected the stream to be named after its directory, got %s", download.Fname)
+	}
+	got, err := os.ReadFile(download.Fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, server.stream("lo")) {
+		t.Fatal("expected the decrypted segments of the 360p variant in order")
+	}
+	status := download.Status()
+	if status.HLS == nil || status.HLS.SegmentsDone != 6 || status.HLS.SegmentsTotal != 6 || status.HLS.Variant.Bandwidth != 800000 {
+		t.Fatalf("unexpected HLS status %+v", status.HLS)
+	}
+	if status.Percentage != 100 || status.Size != int64(len(got)) {
+		t.Fatalf("unexpected progress %v%% of %d", status.Percentage, status.Size)
+	}
+	if server.count("/keys/lo.key") != 1 {
+		t.Fatalf("expected the key to be fetched once, got %d", server.count("/keys/lo.key"))
+	}
+	if _, err := os.Stat(partName(download.Fname)); !os.IsNotExist(err) {
+		t.Fatal("expected the working directory to be removed")
+	}
+}
+
+func TestHLSPauseResume(t *testing.T) {
+	withFFmpeg(t, filepath.Join(t.TempDir(), "no-ffmpeg"))
+	server := newHLSServer(t)
+	server.block = 3
+
+	download := NewHLSDownloader(server.URL+"/show/master.m3u8", t.TempDir(), "show.ts", nil)
+	download.Connections = 2
+	done := make(chan bool)
+	go func() { done <- download.Resume() }()
+	waitFor(t, "three segments", func() bool { return download.Status().HLS.SegmentsDone == 3 })
+	download.Pause()
+	<-done
+	if download.State() != "paused" {
+		t.Fatalf("expected the download to pause, got %s: %v", download.State(), download.Error)
+	}
+	if percentage := download.Percentage(); percentage != 50 {
+		t.Fatalf("expected 3 of 6 segments to be done, got %v%%", percentage)
+	}
+
+	close(server.release)
+	download.Resume()
+	if download.State() != "completed" {
+		t.Fatalf("expected the download to complete, got %s: %v", download.State(), download.Error)
+	}
+	for i := 0; i < 3; i++ {
+		if n := server.count(fmt.Sprintf("/show/hi/%d.ts", i)); n != 1 {
+			t.Fatalf("expected segment %d to be kept across the pause, fetched %d times", i, n)
+		}
+	}
+	got, err := os.ReadFile(download.Fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, server.stream("hi")) {
+		t.Fatal("expected the segments of the 720p variant in order")
+	}
+}
+
+func TestHLSRemux(t *testing.T) {
+	// a stand-in for ffmpeg that copies its input and leaves a mark
+	script := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n{ printf remuxed; cat \"$5\"; } > \"$8\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	withFFmpeg(t, script)
+	server := newHLSServer(t)
+
+	dir := t.TempDir()
+	download := NewHLSDownloader(server.URL+"/show/hi/index.m3u8", dir, "", nil)
+	download.Resume()
+
+	if download.State() != "completed" {
+		t.Fatalf("expected the download to complete, got %s: %v", download.State(), download.Error)
+	}
+	if download.Fname != filepath.Join(dir, "hi.mp4") {
+		t.Fatalf("expected an .mp4 output when ffmpeg is available, got %s", download.Fname)
+	}
+	got, err := os.ReadFile(download.Fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append([]byte("remuxed"), server.stream("hi")...)) {
+		t.Fatal("expected the joined stream to go through ffmpeg")
+	}
+
+	download = NewHLSDownloader(server.URL+"/show/hi/index.m3u8", dir, "episode", nil)
+	download.Resume()
+	if got, _ := os.ReadFile(download.Fname); download.State() != "completed" || !bytes.Equal(got, server.stream("hi")) {
+		t.Fatalf("expected a name without extension to keep the joined stream, got %s: %v", download.State(), download.Error)
+	}
+}
+
+func TestParseResolution(t *testing.T) {
+	for value, want := range map[string]int{"720": 720, "1080p": 1080, "1280x720": 720} {
+		if got, err := ParseResolution(value); err != nil || got != want {
+			t.Fatalf("ParseResolution(%q) = %d, %v", value, got, err)
+		}
+	}
+	if _, err := ParseResolution("hd"); err == nil {
+		t.Fatal("expected an invalid resolution to be rejected")
+	}
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrMirrorMismatch is returned when a mirror can not continue the
+	// download started on another source: it serves a different size or
+	// ignores byte ranges.
+	ErrMirrorMismatch = errors.New("mirror does not serve the same file")
+	// ErrSlowMirror is returned when a source stays below the minimum speed of the task.
+	ErrSlowMirror = errors.New("source is slower than the minimum speed")
+)
+
+// slowGrace is how long a source may stay below the minimum speed.
+const slowGrace = 15 * time.Second
+
+// sources returns the URL of the task followed by its mirrors.
+func (d *DownloadFile) sources() []string {
+	return append([]string{d.Url}, d.Mirrors...)
+}
+
+// source returns the index of the source in use out of n.
+func (d *DownloadFile) source(n int) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.Source % n
+}
+
+// failOver moves to the next source after a failed attempt, as long as
+// tried is less than the number of sources. A checksum mismatch is not
+// blamed on the source since the whole file was checked.
+func (d *DownloadFile) failOver(tried int, sources []string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Error == nil || d.paused || d.canceled || d.Completed || d.Digest != "" || tried >= len(sources) {
+		return false
+	}
+	d.Source = (d.Source + 1) % len(sources)
+	log.Printf("[*] Switching to %s: %v", redactURL(sources[d.Source]), d.Error)
+	d.Error = nil
+	return true
+}
+
+// validatedBy reports whether link is the source the partial data and
+// validators of the task came from.
+func (d *DownloadFile) validatedBy(link string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Origin == "" {
+		return link == d.Url
+	}
+	return link == d.Origin
+}
+
+// sameFile reports whether link, reporting a total size, can continue the
+// partial download. The origin is checked with If-Range instead.
+func (d *DownloadFile) sameFile(link string, total int64) bool {
+	if d.validatedBy(link) {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.Size <= 0 || total < 0 || total == d.Size
+}
+
+// probeSources asks every source for the file size and range support and
+// returns the size and the sources serving it with ranges, in order.
+func (d *DownloadFile) probeSources() (int64, []string) {
+	var size int64
+	var usable []string
+	for _, link := range d.sources() {
+		if isFTP(link) || isSFTP(link) {
+			continue
+		}
+		n, header, ok := d.probeRanges(link)
+		if !ok {
+			continue
+		}
+		if size == 0 {
+			size = n
+			if d.validatorsChanged(header, link) {
+				d.restart("Remote file changed")
+			}
+			d.setValidators(header, link)
+		} else if n != size {
+			log.Printf("[*] Skipping mirror %s: size %d instead of %d", redactURL(link), n, size)
+			continue
+		}
+		usable = append(usable, link)
+	}
+	return size, usable
+}
+
+// speedWatch closes a response body when the task stays below its minimum
+// speed, which unblocks a stalled read.
+type speedWatch struct {
+	done    chan struct{}
+	tripped atomic.Bool
+}
+
+func (d *DownloadFile) watchSpeed(body io.Closer) *speedWatch {
+	w := &speedWatch{done: make(chan struct{})}
+	d.mu.Lock()
+	minSpeed := d.MinSpeed
+	d.mu.Unlock()
+	if minSpeed <= 0 {
+		return w
+	}
+
+	started := time.Now()
+	go func() {
+		ticker := time.NewTicker(SpeedInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case now := <-ticker.C:
+				if now.Sub(started) >= slowGrace && d.history.current(now) < float64(minSpeed) {
+					w.tripped.Store(true)
+					body.Close()
+					return
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func (w *speedWatch) Stop()         { close(w.done) }
+func (w *speedWatch) Tripped() bool { return w.tripped.Load() }
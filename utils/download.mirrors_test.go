@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rangeCounter serves content and counts the range requests it receives.
+func rangeCounter(content []byte, ranges *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+			atomic.AddInt32(ranges, 1)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func TestMirrorFailoverKeepsProgress(t *testing.T) {
+	content := make([]byte, 256*1024)
+	rand.Read(content)
+
+	// the primary drops the connection halfway through
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer primary.Close()
+	var resumed int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes="+strconv.Itoa(len(content)/2)+"-" {
+			atomic.AddInt32(&resumed, 1)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer mirror.Close()
+
+	download := NewDownloader(primary.URL+"/file.bin", t.TempDir(), "file.bin")
+	download.Mirrors = []string{mirror.URL + "/file.bin"}
+	download.Resume()
+
+	if download.State() != "completed" {
+		t.Fatalf("expected the download to complete on the mirror, got %s: %v", download.State(), download.Error)
+	}
+	if atomic.LoadInt32(&resumed) != 1 {
+		t.Fatal("expected the mirror to continue from the bytes already downloaded")
+	}
+	if source := download.Status().Source; source != mirror.URL+"/file.bin" {
+		t.Fatalf("expected the mirror to be the current source, got %q", source)
+	}
+	got, err := os.ReadFile(download.Fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content does not match")
+	}
+}
+
+func TestSegmentedDownloadFromMirrors(t *testing.T) {
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	var primaryRanges, mirrorRanges, otherRanges int32
+	primary := rangeCounter(content, &primaryRanges)
+	defer primary.Close()
+	mirror := rangeCounter(content, &mirrorRanges)
+	defer mirror.Close()
+	// a mirror serving another file is left out
+	other := rangeCounter(content[:1000], &otherRanges)
+	defer other.Close()
+
+	download := NewDownloader(primary.URL+"/file.bin", t.TempDir(), "file.bin")
+	download.Mirrors = []string{other.URL + "/file.bin", mirror.URL + "/file.bin"}
+	download.Connections = 4
+	download.Resume()
+
+	if download.Error != nil {
+		t.Fatal(download.Error)
+	}
+	if atomic.LoadInt32(&primaryRanges) == 0 || atomic.LoadInt32(&mirrorRanges) == 0 {
+		t.Fatalf("expected ranges from both sources, got %d and %d", primaryRanges, mirrorRanges)
+	}
+	if atomic.LoadInt32(&otherRanges) != 0 {
+		t.Fatal("expected the mirror with a different size to be skipped")
+	}
+	got, err := os.ReadFile(download.Fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content does not match")
+	}
+}
+
+func TestMirrorWithDifferentSizeIsRejected(t *testing.T) {
+	content := make([]byte, 64*1024)
+	rand.Read(content)
+	var ranges int32
+	other := rangeCounter(content[:1000], &ranges)
+	defer other.Close()
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer primary.Close()
+
+	dir := t.TempDir()
+	download := NewDownloader(primary.URL+"/file.bin", dir, "file.bin")
+	download.Mirrors = []string{other.URL + "/file.bin"}
+	download.Size = int64(len(content))
+	if err := os.WriteFile(download.partName(), content[:100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	download.Resume()
+
+	if download.State() != "failed" {
+		t.Fatalf("expected the download to fail, got %s", download.State())
+	}
+	if info, _ := os.Stat(download.partName()); info == nil || info.Size() != 100 {
+		t.Fatal("expected the partial file to be left untouched")
+	}
+}
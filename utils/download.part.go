@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Downloads are written to a hidden .part file next to their final name,
+// with the task metadata in a .part.json sidecar, and only renamed into
+// place once they are complete and verified.
+const (
+	partSuffix    = ".part"
+	sidecarSuffix = ".part.json"
+)
+
+// IsPartFile reports whether name is the data or sidecar file of an
+// unfinished download.
+func IsPartFile(name string) bool {
+	name = filepath.Base(name)
+	return strings.HasPrefix(name, ".") && (strings.HasSuffix(name, partSuffix) || strings.HasSuffix(name, sidecarSuffix))
+}
+
+func partName(fname string) string {
+	return filepath.Join(filepath.Dir(fname), "."+filepath.Base(fname)+partSuffix)
+}
+
+// partName returns the file the task writes to until it completes.
+func (d *DownloadFile) partName() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return partName(d.Fname)
+}
+
+// adoptPartial turns a file left at the final name by older versions into
+// the .part file, so that it is resumed.
+func (d *DownloadFile) adoptPartial() {
+	part := d.partName()
+	if _, err := os.Stat(part); err == nil {
+		return
+	}
+	if info, err := os.Stat(d.Fname); err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+		if err := os.Rename(d.Fname, part); err != nil {
+			log.Println("Error adopting the partial file:", err)
+		}
+	}
+}
+
+// partSidecar is the metadata saved next to a .part file: enough to tell
+// what the file is and how far it got. Request options, proxies and other
+// secrets stay in the journal, since the sidecar sits in the served folder.
+type partSidecar struct {
+	Url          string           `json:"url"`
+	Size         int64            `json:"size"`
+	Downloaded   int64            `json:"downloaded"`
+	Segments     []sidecarSegment `json:"segments,omitempty"`
+	ETag         string           `json:"etag,omitempty"`
+	LastModified string           `json:"last_modified,omitempty"`
+	State        string           `json:"state"`
+}
+
+type sidecarSegment struct {
+	Start      int64 `json:"start"`
+	End        int64 `json:"end"`
+	Downloaded int64 `json:"downloaded"`
+}
+
+// writeSidecar saves the task metadata next to the .part file.
+func (d *DownloadFile) writeSidecar() {
+	record := d.record(d.ID)
+	sidecar := &partSidecar{
+		Url:          redactURL(record.Url),
+		Size:         record.Size,
+		Downloaded:   record.DownloadedSize,
+		ETag:         record.ETag,
+		LastModified: record.LastModified,
+		State:        record.State,
+	}
+	for _, seg := range record.Segments {
+		sidecar.Segments = append(sidecar.Segments, sidecarSegment{Start: seg.Start, End: seg.End, Downloaded: seg.Downloaded})
+	}
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err == nil {
+		err = os.WriteFile(d.partName()+".json", data, 0600)
+	}
+	if err != nil {
+		log.Println("Error writing the task sidecar:", err)
+	}
+}
+
+// commitPart flushes the .part file to disk and renames it to its final
+// name, removing the sidecar.
+func (d *DownloadFile) commitPart() error {
+	part := d.partName()
+	if err := syncFile(part); err != nil {
+		return err
+	}
+	if err := os.Rename(part, d.Fname); err != nil {
+		return err
+	}
+	if err := syncFile(filepath.Dir(d.Fname)); err != nil {
+		log.Println("Error syncing the download directory:", err)
+	}
+	if err := os.Remove(part + ".json"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println("Error removing the task sidecar:", err)
+	}
+	return nil
+}
+
+func syncFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// finishPart updates the sidecar of a task that stopped before completing,
+// or removes the .part file and sidecar of a canceled one, which will not be
+// resumed.
+func (d *DownloadFile) finishPart() {
+	d.mu.Lock()
+	state, fname := d.state(), d.Fname
+	d.mu.Unlock()
+	part := partName(fname)
+	if fname == "" || state == "completed" {
+		return
+	}
+	if state == "canceled" {
+		if err := os.RemoveAll(part); err != nil {
+			log.Println("Error removing the partial file:", err)
+		}
+		if err := os.Remove(part + ".json"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Error removing the task sidecar:", err)
+		}
+		return
+	}
+	if _, err := os.Stat(part); err != nil {
+		return
+	}
+	d.writeSidecar()
+}
+
+// HidePartFiles serves a file system without the files of unfinished downloads.
+type HidePartFiles struct {
+	http.FileSystem
+}
+
+func (h HidePartFiles) Open(name string) (http.File, error) {
+	if IsPartFile(name) {
+		return nil, fs.ErrNotExist
+	}
+	file, err := h.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return partHidingFile{file}, nil
+}
+
+type partHidingFile struct {
+	http.File
+}
+
+func (f partHidingFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if !IsPartFile(info.Name()) {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPartFileRenamedOnCompletion(t *testing.T) {
+	server := slowServer(128 * 1024)
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	download.SetRateLimit(64 * 1024)
+	download.Request = &RequestOptions{Username: "bob", Password: "hunter2", Cookies: ParseCookieString("session=secret")}
+	done := make(chan bool)
+	go func() { done <- download.Resume() }()
+
+	waitFor(t, "download to start", func() bool { return download.Status().DownloadedBytes > 0 })
+	download.Pause()
+	<-done
+	if _, err := os.Stat(download.Fname); !os.IsNotExist(err) {
+		t.Fatal("expected nothing at the final name while the download is unfinished")
+	}
+	data, err := os.ReadFile(download.partName() + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sidecar partSidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil || sidecar.Url != server.URL || sidecar.State != "paused" || sidecar.Downloaded == 0 {
+		t.Fatalf("unexpected sidecar %s %v", data, err)
+	}
+	if strings.Contains(string(data), "hunter2") || strings.Contains(string(data), "secret") {
+		t.Fatalf("expected no credentials in the sidecar, got %s", data)
+	}
+	if info, err := os.Stat(download.partName() + ".json"); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected a private sidecar, got %v %v", info.Mode(), err)
+	}
+
+	download.SetRateLimit(0)
+	download.Resume()
+	if info, err := os.Stat(download.Fname); err != nil || info.Size() != 128*1024 {
+		t.Fatalf("expected the complete file at its final name, got %v %v", info, err)
+	}
+	for _, name := range []string{download.partName(), download.partName() + ".json"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be gone", filepath.Base(name))
+		}
+	}
+}
+
+func TestPartFileRemovedOnCancel(t *testing.T) {
+	server := slowServer(128 * 1024)
+	defer server.Close()
+
+	for _, paused := range []bool{false, true} {
+		download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+		download.SetRateLimit(64 * 1024)
+		done := make(chan bool)
+		go func() { done <- download.Resume() }()
+
+		waitFor(t, "download to start", func() bool { return download.Status().DownloadedBytes > 0 })
+		if paused {
+			// a paused task is canceled without running
+			download.Pause()
+			<-done
+			download.Cancel()
+		} else {
+			download.Cancel()
+			<-done
+		}
+		if download.State() != "canceled" {
+			t.Fatalf("expected the task to be canceled, got %s", download.State())
+		}
+		for _, name := range []string{download.Fname, download.partName(), download.partName() + ".json"} {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Fatalf("paused=%v: expected %s to be gone", paused, filepath.Base(name))
+			}
+		}
+	}
+}
+
+func TestPartFileKeptOnChecksumMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tampered"))
+	}))
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.txt")
+	download.Checksum, _ = ParseChecksum("md5:" + strings.Repeat("0", 32))
+	download.Resume()
+	if _, err := os.Stat(download.Fname); !os.IsNotExist(err) {
+		t.Fatal("expected a file failing its checksum to stay unpublished")
+	}
+	if got, _ := os.ReadFile(download.partName()); string(got) != "tampered" {
+		t.Fatalf("expected the data in the .part file, got %q", got)
+	}
+}
+
+func TestPartFilesHidden(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "done.bin"), []byte("done"), 0644)
+	os.WriteFile(partName(filepath.Join(dir, "busy.bin")), []byte("busy"), 0644)
+	os.WriteFile(partName(filepath.Join(dir, "busy.bin"))+".json", []byte("{}"), 0644)
+
+	if files, _ := CountFilesAndFolders(dir); files != 1 {
+		t.Fatalf("expected 1 file, got %d", files)
+	}
+
+	server := httptest.NewServer(http.FileServer(HidePartFiles{FileSystem: http.Dir(dir)}))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(listing), "done.bin") || strings.Contains(string(listing), "busy.bin") {
+		t.Fatalf("unexpected listing %s", listing)
+	}
+	if resp, _ := http.Get(server.URL + "/.busy.bin.part"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the .part file to be hidden, got %s", resp.Status)
+	}
+}
+
+func TestPartFileKeptWhenYtDlpFails(t *testing.T) {
+	// yt-dlp is stood in for by a script that prints the info, then fails
+	// half way through the video
+	ytDlp := filepath.Join(t.TempDir(), "yt-dlp")
+	script := `#!/bin/sh
+if [ "$2" = "-s" ]; then echo '{"filename":"video.mp4","filesize":1024}'; exit 0; fi
+printf 'half a video'
+echo 'ERROR: unable to download video data: HTTP Error 403: Forbidden' >&2
+exit 1
+`
+	if err := os.WriteFile(ytDlp, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { ytDlpPath = path }(ytDlpPath)
+	ytDlpPath = ytDlp
+
+	download := NewYtDlpDownloader("https://example.com/watch", t.TempDir())
+	download.Resume()
+	if download.State() == "completed" || download.Error == nil || !strings.Contains(download.Error.Error(), "HTTP Error 403") {
+		t.Fatalf("expected the task to fail with the yt-dlp error, got %s %v", download.State(), download.Error)
+	}
+	if _, err := os.Stat(download.Fname); !os.IsNotExist(err) {
+		t.Fatal("expected the truncated video to stay unpublished")
+	}
+	if got, _ := os.ReadFile(download.partName()); string(got) != "half a video" {
+		t.Fatalf("expected the data in the .part file, got %q", got)
+	}
+}
@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Segment is one byte range of a multi-connection download.
+type Segment struct {
+	Index      int
+	Start      int64
+	End        int64 // inclusive
+	Downloaded int64
+	Source     string `json:"source,omitempty"` // mirror the segment is fetched from
+	Error      error  `json:"-"`
+}
+
+func (s *Segment) Size() int64      { return s.End - s.Start + 1 }
+func (s *Segment) Progress() int64  { return atomic.LoadInt64(&s.Downloaded) }
+func (s *Segment) IsComplete() bool { return s.Progress() >= s.Size() }
+
+// probeRanges asks link for the file size, its validators and whether it
+// accepts byte ranges.
+func (d *DownloadFile) probeRanges(link string) (int64, http.Header, bool) {
+	req, err := d.newRequest("HEAD", link)
+	if err != nil {
+		return 0, nil, false
+	}
+	resp, err := d.client().Do(req)
+	if err != nil {
+		log.Println("Error probing range support:", err)
+		return 0, nil, false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength <= 0 {
+		return 0, nil, false
+	}
+	return resp.ContentLength, resp.Header, true
+}
+
+// splitSegments divides size bytes into n contiguous ranges.
+func splitSegments(size int64, n int) []*Segment {
+	if int64(n) > size {
+		n = int(size)
+	}
+	chunk := size / int64(n)
+	segments := make([]*Segment, n)
+	for i := range segments {
+		start := int64(i) * chunk
+		end := start + chunk - 1
+		if i == n-1 {
+			end = size - 1
+		}
+		segments[i] = &Segment{Index: i, Start: start, End: end}
+	}
+	return segments
+}
+
+// resumeSegmented downloads the missing ranges in parallel, spreading the
+// segments over sources and moving a segment to the next source when one fails.
+func (d *DownloadFile) resumeSegmented(size int64, sources []string) bool {
+	flags := os.O_WRONLY | os.O_CREATE
+	d.mu.Lock()
+	if d.Segments == nil || d.Size != size {
+		d.Segments = splitSegments(size, d.Connections)
+		flags |= os.O_TRUNC
+	}
+	d.Size = size
+	var downloaded int64
+	for _, seg := range d.Segments {
+		downloaded += seg.Progress()
+	}
+	atomic.StoreInt64(&d.DownloadedSize, downloaded)
+	d.Started = time.Now()
+	segments := d.Segments
+	d.mu.Unlock()
+
+	outputFile, err := os.OpenFile(d.partName(), flags, 0644)
+	if err != nil {
+		log_and_set_error(d, "error opening the output file", err)
+		return true
+	}
+	defer outputFile.Close()
+
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, seg := range segments {
+		if seg.IsComplete() {
+			continue
+		}
+		wg.Add(1)
+		go func(seg *Segment, first int) {
+			defer wg.Done()
+			for tried := 0; tried < len(sources); tried++ {
+				link := sources[(first+tried)%len(sources)]
+				d.mu.Lock()
+				seg.Source = link
+				d.mu.Unlock()
+				seg.Error = d.fetchSegment(seg, link, size, outputFile, stop)
+				if seg.Error == nil || errors.Is(seg.Error, ErrContentChanged) || stopped(stop) {
+					return
+				}
+				log.Printf("[*] Segment %d failed on %s: %v", seg.Index, link, seg.Error)
+			}
+		}(seg, i)
+	}
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-d.CancelChan:
+		close(stop)
+		<-finished
+		d.setCanceled()
+		return true
+	case <-d.PauseChan:
+		close(stop)
+		<-finished
+		d.setPaused()
+		return true
+	case <-finished:
+	}
+
+	for _, seg := range segments {
+		if errors.Is(seg.Error, ErrContentChanged) {
+			d.restart("Remote file changed")
+		}
+		if seg.Error != nil {
+			log_and_set_error(d, fmt.Sprintf("error downloading segment %d", seg.Index), seg.Error)
+			return true
+		}
+	}
+
+	if !d.verify(nil) {
+		return true
+	}
+	if err := d.commitPart(); err != nil {
+		log_and_set_error(d, "error moving the file into place", err)
+		return true
+	}
+	d.setCompleted()
+	return true
+}
+
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// fetchSegment downloads the remaining bytes of seg of a file of size bytes
+// from link and writes them at their offset in out.
+func (d *DownloadFile) fetchSegment(seg *Segment, link string, size int64, out *os.File, stop <-chan struct{}) error {
+	req, err := d.newRequest("GET", link)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.Start+seg.Progress(), seg.End))
+	if validator := d.ifRange(link); validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+
+	// a mirror that answers differently is skipped, the origin changed the file
+	changed := ErrContentChanged
+	if !d.validatedBy(link) {
+		changed = ErrMirrorMismatch
+	}
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return changed
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	start, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if start != seg.Start+seg.Progress() || (total >= 0 && total != size) {
+		return changed
+	}
+
+	buffer := make([]byte, copyBufferSize)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		n, err := resp.Body.Read(buffer)
+		if remaining := seg.Size() - seg.Progress(); int64(n) > remaining {
+			n = int(remaining)
+		}
+		if n > 0 {
+			d.throttle(n)
+			if _, err := out.WriteAt(buffer[:n], seg.Start+seg.Progress()); err != nil {
+				return err
+			}
+			atomic.AddInt64(&seg.Downloaded, int64(n))
+			d.addProgress(n)
+		}
+
+		if seg.IsComplete() {
+			return nil
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
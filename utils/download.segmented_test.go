@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSegmentedDownload(t *testing.T) {
+	content := make([]byte, 1<<20+7)
+	rand.Read(content)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	download := NewDownloader(server.URL+"/file.bin", t.TempDir(), "file.bin")
+	download.Connections = 4
+	download.Resume()
+
+	if download.Error != nil {
+		t.Fatal(download.Error)
+	}
+	if len(download.Segments) != 4 {
+		t.Fatalf("expected 4 segments, got %d", len(download.Segments))
+	}
+	got, err := os.ReadFile(download.Fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content does not match")
+	}
+}
+
+func TestSegmentedDownloadFallback(t *testing.T) {
+	content := []byte("no ranges here")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	download := NewDownloader(server.URL+"/file.txt", dir, "file.txt")
+	download.Connections = 4
+	download.Resume()
+
+	if download.Segments != nil {
+		t.Fatal("expected single stream download")
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content does not match")
+	}
+}
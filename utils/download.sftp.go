@@ -0,0 +1,347 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTimeout bounds connecting and authenticating to an SSH server.
+const sshTimeout = 30 * time.Second
+
+// sftpBuffer is read from the server at once, letting the client pipeline its requests.
+const sftpBuffer = 256 << 10
+
+// SSHSettings are the server-wide known hosts and keys of sftp:// sources.
+type SSHSettings struct {
+	KnownHosts string   // known_hosts file host keys are checked against
+	Keys       []string // private key files offered to every host
+	Passphrase string   // passphrase of encrypted keys
+}
+
+func (m *TaskManager) SetSSH(settings *SSHSettings) {
+	m.mu.Lock()
+	m.ssh = settings
+	m.mu.Unlock()
+}
+
+// SSH returns the server-wide SSH settings, nil when none are set.
+func (m *TaskManager) SSH() *SSHSettings {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ssh
+}
+
+func isSFTP(link string) bool { return strings.HasPrefix(link, "sftp://") }
+
+// sshConfig authenticates as the user of link, or the username of the
+// request options, with the password of either, the private key of the
+// task and the server-wide keys. Host keys must be in the known_hosts file.
+func (d *DownloadFile) sshConfig(link *url.URL) (*ssh.ClientConfig, error) {
+	d.mu.Lock()
+	options, defaultSSH := d.Request, d.defaultSSH
+	d.mu.Unlock()
+	settings := &SSHSettings{}
+	if defaultSSH != nil && defaultSSH() != nil {
+		settings = defaultSSH()
+	}
+	if options == nil {
+		options = &RequestOptions{}
+	}
+
+	if settings.KnownHosts == "" {
+		return nil, errors.New("no known_hosts file to check the host key against")
+	}
+	hostKeys, err := knownhosts.New(settings.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	user, password := link.User.Username(), ""
+	if p, ok := link.User.Password(); ok {
+		password = p
+	}
+	if user == "" {
+		user = options.Username
+	}
+	if password == "" {
+		password = options.Password
+	}
+	if user == "" {
+		return nil, errors.New("sftp URLs need a user, as in sftp://user@host/path")
+	}
+
+	var signers []ssh.Signer
+	if options.PrivateKey != "" {
+		signer, err := parsePrivateKey([]byte(options.PrivateKey), options.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("task private key: %w", err)
+		}
+		signers = append(signers, signer)
+	}
+	for _, file := range settings.Keys {
+		data, err := os.ReadFile(file)
+		if err == nil {
+			var signer ssh.Signer
+			if signer, err = parsePrivateKey(data, settings.Passphrase); err == nil {
+				signers = append(signers, signer)
+				continue
+			}
+		}
+		return nil, fmt.Errorf("private key %s: %w", file, err)
+	}
+
+	var methods []ssh.AuthMethod
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if password != "" {
+		methods = append(methods, ssh.Password(password), ssh.KeyboardInteractive(
+			func(_, _ string, questions []string, _ []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+	return &ssh.ClientConfig{User: user, Auth: methods, HostKeyCallback: hostKeys, Timeout: sshTimeout}, nil
+}
+
+func parsePrivateKey(data []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// sftpClient is an SFTP session over its SSH connection.
+type sftpClient struct {
+	*sftp.Client
+	conn *ssh.Client
+}
+
+func (d *DownloadFile) dialSFTP(link *url.URL) (*sftpClient, error) {
+	config, err := d.sshConfig(link)
+	if err != nil {
+		return nil, err
+	}
+	host := link.Host
+	if link.Port() == "" {
+		host = net.JoinHostPort(link.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", host, config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sftpClient{Client: client, conn: conn}, nil
+}
+
+func (c *sftpClient) Close() error {
+	c.Client.Close()
+	return c.conn.Close()
+}
+
+// resumeSFTP downloads the file of an sftp:// link from the end of the
+// .part file, or mirrors the tree when link is a directory. The
+// modification time of the file stands in for Last-Modified.
+func (d *DownloadFile) resumeSFTP(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		log_and_set_error(d, "error parsing the SFTP URL", err)
+		return true
+	}
+	client, err := d.dialSFTP(u)
+	if err != nil {
+		log_and_set_error(d, "error connecting to the SFTP server", err)
+		return true
+	}
+	defer client.Close()
+
+	info, err := client.Stat(u.Path)
+	if err != nil {
+		log_and_set_error(d, "error resuming download", err)
+		return true
+	}
+	if info.IsDir() {
+		return d.pullTree(client, link, u.Path)
+	}
+
+	size, modified := info.Size(), info.ModTime().UTC().Format(http.TimeFormat)
+	var offset int64
+	if info, err := os.Stat(d.partName()); err == nil {
+		offset = info.Size()
+	}
+	offset, ok := d.resumeOffset(link, offset, size, modified)
+	if !ok {
+		log_and_set_error(d, "error resuming download", ErrMirrorMismatch)
+		return true
+	}
+
+	file, err := client.Open(u.Path)
+	if err != nil {
+		log_and_set_error(d, "error opening the remote file", err)
+		return true
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		log_and_set_error(d, "error resuming download", err)
+		return true
+	}
+	flags := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	d.mu.Lock()
+	d.Origin = link
+	d.ETag, d.LastModified = "", modified
+	d.Size = size
+	d.Started = time.Now()
+	d.mu.Unlock()
+	atomic.StoreInt64(&d.DownloadedSize, offset)
+
+	slow := d.watchSpeed(file)
+	defer slow.Stop()
+	return d.receive(bufio.NewReaderSize(file, sftpBuffer), flags, slow)
+}
+
+// remoteFile is a file of a directory pull and where it is saved.
+type remoteFile struct {
+	path  string
+	local string
+	size  int64
+}
+
+// pullTree mirrors the remote directory root into the task directory, one
+// file after the other. Files already there with the remote size are
+// skipped and partial ones continue from their .part file. Symbolic links
+// are not followed.
+func (d *DownloadFile) pullTree(client *sftpClient, link, root string) bool {
+	if d.Checksum != nil {
+		log_and_set_error(d, "error resuming download", errors.New("a checksum can not be checked against a directory"))
+		return true
+	}
+	base := filepath.Clean(d.Fname)
+
+	var files []remoteFile
+	var total, done int64
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			log_and_set_error(d, "error listing the remote directory", err)
+			return true
+		}
+		info := walker.Stat()
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		rel := strings.TrimPrefix(path.Clean(walker.Path()), path.Clean(root))
+		local := filepath.Join(base, filepath.FromSlash(rel))
+		if !strings.HasPrefix(local, base+string(filepath.Separator)) {
+			continue
+		}
+		files = append(files, remoteFile{path: walker.Path(), local: local, size: info.Size()})
+		total += info.Size()
+		if existing, err := os.Stat(local); err == nil && existing.Size() == info.Size() {
+			done += info.Size()
+		} else if part, err := os.Stat(partName(local)); err == nil && part.Size() <= info.Size() {
+			done += part.Size()
+		}
+	}
+
+	if err := os.MkdirAll(base, 0755); err != nil {
+		log_and_set_error(d, "error creating the output directory", err)
+		return true
+	}
+	// the folder now holds the name the rename conflict policy reserved with
+	// an empty .part file
+	if info, err := os.Stat(partName(base)); err == nil && info.Mode().IsRegular() && info.Size() == 0 {
+		os.Remove(partName(base))
+	}
+	d.mu.Lock()
+	d.Origin = link
+	d.Size = total
+	d.Started = time.Now()
+	d.mu.Unlock()
+	atomic.StoreInt64(&d.DownloadedSize, done)
+
+	for _, file := range files {
+		if existing, err := os.Stat(file.local); err == nil && existing.Size() == file.size {
+			continue
+		}
+		if !d.pullFile(client, file) {
+			return true
+		}
+	}
+	d.setCompleted()
+	return true
+}
+
+// pullFile downloads one file of a directory pull through its .part file.
+func (d *DownloadFile) pullFile(client *sftpClient, file remoteFile) bool {
+	part := partName(file.local)
+	var offset int64
+	if info, err := os.Stat(part); err == nil && info.Size() <= file.size {
+		offset = info.Size()
+	}
+
+	remote, err := client.Open(file.path)
+	if err != nil {
+		log_and_set_error(d, "error opening the remote file", err)
+		return false
+	}
+	defer remote.Close()
+	if _, err := remote.Seek(offset, io.SeekStart); err != nil {
+		log_and_set_error(d, "error resuming download", err)
+		return false
+	}
+	if err := os.MkdirAll(filepath.Dir(file.local), 0755); err != nil {
+		log_and_set_error(d, "error creating the output directory", err)
+		return false
+	}
+	flags := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	out, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		log_and_set_error(d, "error opening the output file", err)
+		return false
+	}
+	defer out.Close()
+
+	slow := d.watchSpeed(remote)
+	defer slow.Stop()
+	if !d.transfer(bufio.NewReaderSize(remote, sftpBuffer), out, slow) {
+		return false
+	}
+	if err := out.Sync(); err != nil {
+		log_and_set_error(d, "error writing to the output file", err)
+		return false
+	}
+	if err := os.Rename(part, file.local); err != nil {
+		log_and_set_error(d, "error moving the file into place", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newSigner(t *testing.T) (ssh.Signer, ed25519.PrivateKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, key
+}
+
+// sftpServer starts an SSH server with the sftp subsystem, serving the local
+// file system to alice with the password "secret" or the authorized key. It
+// returns its address and a known_hosts file listing its host key.
+func sftpServer(t *testing.T, authorized ssh.PublicKey) (string, string) {
+	hostKey, _ := newSigner(t)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "alice" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == "alice" && authorized != nil && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	addr := listener.Addr().String()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return addr, knownHosts
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				if req.Type != "subsystem" || len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					return
+				}
+				server.Serve()
+				server.Close()
+			}
+		}()
+	}
+}
+
+func TestSFTPPasswordResume(t *testing.T) {
+	addr, knownHosts := sftpServer(t, nil)
+	content := make([]byte, 256*1024)
+	rand.Read(content)
+	remote := filepath.Join(t.TempDir(), "build.bin")
+	if err := os.WriteFile(remote, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	download := NewDownloader("sftp://alice:secret@"+addr+remote, t.TempDir(), "build.bin")
+	download.defaultSSH = func() *SSHSettings { return &SSHSettings{KnownHosts: knownHosts} }
+	download.SetRateLimit(64 * 1024)
+	done := make(chan bool)
+	go func() { done <- download.Resume() }()
+	waitFor(t, "download to start", func() bool { return download.Status().DownloadedBytes > 0 })
+	download.Pause()
+	<-done
+	paused := download.Status().DownloadedBytes
+	if paused == 0 || paused == int64(len(content)) {
+		t.Fatalf("expected a partial download, got %d bytes", paused)
+	}
+
+	// change the part already downloaded, keeping the size and time of the
+	// file: a resumed download keeps the old bytes
+	changed := append(bytes.Repeat([]byte("x"), int(paused)), content[paused:]...)
+	info, _ := os.Stat(remote)
+	os.WriteFile(remote, changed, 0644)
+	os.Chtimes(remote, info.ModTime(), info.ModTime())
+
+	download.SetRateLimit(0)
+	download.Resume()
+	if download.State() != "completed" {
+		t.Fatalf("expected the download to complete, got %s: %v", download.State(), download.Error)
+	}
+	got, err := os.ReadFile(download.Fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("expected the download to continue from the partial file")
+	}
+	if strings.Contains(download.Status().Url, "secret") {
+		t.Fatal("expected the password to be redacted")
+	}
+}
+
+func TestSFTPKeyTreePull(t *testing.T) {
+	signer, key := newSigner(t)
+	addr, knownHosts := sftpServer(t, signer.PublicKey())
+	root := filepath.Join(t.TempDir(), "artifacts")
+	files := map[string]string{
+		"linux/app":        "linux build",
+		"windows/app.exe":  "windows build",
+		"checksums.txt":    "sums",
+		"empty/nested/.ok": "",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		os.WriteFile(filepath.Join(root, name), []byte(content), 0644)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	download := NewDownloader("sftp://alice@"+addr+root+"/", dir, "")
+	download.Request = &RequestOptions{PrivateKey: string(pem.EncodeToMemory(block))}
+	download.defaultSSH = func() *SSHSettings { return &SSHSettings{KnownHosts: knownHosts} }
+	download.Resume()
+
+	if download.State() != "completed" {
+		t.Fatalf("expected the pull to complete, got %s: %v", download.State(), download.Error)
+	}
+	if download.Fname != dir+"/artifacts" || download.Status().DownloadedBytes != download.Status().Size {
+		t.Fatalf("unexpected result %s %+v", download.Fname, download.Status())
+	}
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(dir, "artifacts", name))
+		if err != nil || string(got) != content {
+			t.Fatalf("expected %s to be mirrored, got %q %v", name, got, err)
+		}
+	}
+	if _, err := os.Stat(partName(download.Fname)); !os.IsNotExist(err) {
+		t.Fatal("expected the reserved name to be released")
+	}
+	if download.Request.Status().PrivateKey != redacted {
+		t.Fatal("expected the private key to be redacted")
+	}
+}
+
+func TestSFTPUnknownHostKey(t *testing.T) {
+	addr, _ := sftpServer(t, nil)
+	other, _ := newSigner(t)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{knownhosts.Normalize(addr)}, other.PublicKey())+"\n"), 0600)
+
+	download := NewDownloader("sftp://alice:secret@"+addr+"/etc/hostname", t.TempDir(), "hostname")
+	download.defaultSSH = func() *SSHSettings { return &SSHSettings{KnownHosts: knownHosts} }
+	download.Resume()
+	var keyErr *knownhosts.KeyError
+	if download.State() != "failed" || !errors.As(download.Error, &keyErr) {
+		t.Fatalf("expected the host key to be rejected, got %s: %v", download.State(), download.Error)
+	}
+}
@@ -0,0 +1,567 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/anacrolix/torrent/types"
+)
+
+// torrentPoll is how often the progress of torrent tasks is refreshed.
+var torrentPoll = time.Second
+
+// TorrentSettings configure the BitTorrent client shared by the torrent
+// tasks of a TaskManager. The client starts with the first torrent task, so
+// changes to the client settings only apply before then.
+type TorrentSettings struct {
+	StateDir   string     // where the piece completion database is kept
+	ListenPort int        // 0 picks a free port
+	NoDHT      bool       // rely on trackers only
+	Seed       SeedLimits // default seeding limits of completed torrents
+
+	configure func(*torrent.ClientConfig)
+}
+
+// SeedLimits stop seeding a completed torrent at the first limit reached.
+// Without any limit completed torrents are not seeded.
+type SeedLimits struct {
+	Ratio float64       `json:"ratio,omitempty"` // bytes uploaded per byte downloaded
+	Time  time.Duration `json:"time,omitempty"`
+}
+
+func (l SeedLimits) enabled() bool { return l.Ratio > 0 || l.Time > 0 }
+
+// TorrentOptions are the torrent and file selection of a torrent task.
+type TorrentOptions struct {
+	MetaInfo []byte      `json:"metainfo,omitempty"` // the .torrent file, or the metadata fetched for a magnet link
+	Files    []int       `json:"files,omitempty"`    // indices of the files to download, every file when empty
+	Seed     *SeedLimits `json:"seed,omitempty"`     // overrides the TaskManager limits when set
+	Uploaded int64       `json:"uploaded,omitempty"` // bytes uploaded so far, across restarts
+}
+
+// TorrentStatus is the swarm of a torrent task reported by /status.
+type TorrentStatus struct {
+	InfoHash   string               `json:"info_hash"`
+	Peers      int                  `json:"peers"`       // connected peers
+	Seeders    int                  `json:"seeders"`     // connected peers with the whole torrent
+	KnownPeers int                  `json:"known_peers"` // peers heard of from trackers, DHT and PEX
+	Uploaded   int64                `json:"uploaded"`
+	Ratio      float64              `json:"ratio"`
+	Seeding    bool                 `json:"seeding"`
+	Files      []*TorrentFileStatus `json:"files,omitempty"`
+}
+
+type TorrentFileStatus struct {
+	Index      int    `json:"index"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Downloaded int64  `json:"downloaded"`
+	Selected   bool   `json:"selected"`
+}
+
+// NewTorrentDownloader creates a task downloading the torrent of a .torrent
+// file, or of a magnet link when metaInfo is nil. files selects the files to
+// download by index, every file when empty. With an empty fname the task is
+// named after the torrent.
+func NewTorrentDownloader(magnet string, metaInfo []byte, dir, fname string, files []int) (*DownloadFile, error) {
+	for _, index := range files {
+		if index < 0 {
+			return nil, fmt.Errorf("invalid file index %d", index)
+		}
+	}
+	if metaInfo != nil {
+		mi, err := metainfo.Load(bytes.NewReader(metaInfo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid torrent file: %w", err)
+		}
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			return nil, fmt.Errorf("invalid torrent file: %w", err)
+		}
+		for _, index := range files {
+			if index >= len(info.UpvertedFiles()) {
+				return nil, fmt.Errorf("the torrent has no file %d", index)
+			}
+		}
+		magnet = mi.Magnet(nil, &info).String()
+	} else if _, err := metainfo.ParseMagnetUri(magnet); err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+
+	d := NewDownloader(magnet, dir, fname)
+	d.Kind = KindTorrent
+	d.Torrent = &TorrentOptions{MetaInfo: metaInfo, Files: files}
+	return d, nil
+}
+
+// torrentClient is the BitTorrent client of a TaskManager. Every task gives
+// its torrent a file storage of its own, sharing the piece completion
+// database.
+type torrentClient struct {
+	*torrent.Client
+	completion storage.PieceCompletion
+}
+
+func (m *TaskManager) SetTorrent(settings *TorrentSettings) {
+	m.mu.Lock()
+	m.torrentSettings = settings
+	m.mu.Unlock()
+}
+
+// SeedLimits returns the default seeding limits of completed torrents.
+func (m *TaskManager) SeedLimits() SeedLimits {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.torrentSettings == nil {
+		return SeedLimits{}
+	}
+	return m.torrentSettings.Seed
+}
+
+// torrentClient returns the BitTorrent client, starting it on first use.
+func (m *TaskManager) torrentClient() (*torrentClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.torrent != nil {
+		return m.torrent, nil
+	}
+	settings := TorrentSettings{StateDir: "."}
+	if m.torrentSettings != nil {
+		settings = *m.torrentSettings
+	}
+
+	completion, err := storage.NewBoltPieceCompletion(settings.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	config := torrent.NewDefaultClientConfig()
+	config.Seed = true
+	config.ListenPort = settings.ListenPort
+	config.NoDHT = settings.NoDHT
+	// tasks open their own storage, this one only keeps the client from
+	// creating a database in the working directory
+	config.DefaultStorage = storage.NewFileOpts(storage.NewFileClientOpts{ClientBaseDir: settings.StateDir, PieceCompletion: completion})
+	if settings.configure != nil {
+		settings.configure(config)
+	}
+	client, err := torrent.NewClient(config)
+	if err != nil {
+		completion.Close()
+		return nil, err
+	}
+	m.torrent = &torrentClient{Client: client, completion: completion}
+	return m.torrent, nil
+}
+
+// torrentName names the data of a torrent after its info.
+func torrentName(info *metainfo.Info) string {
+	if name := SanitizeName(info.BestName()); name != "" {
+		return name
+	}
+	return "torrent"
+}
+
+// partStorage keeps the data of a torrent being downloaded into dir in a
+// hidden .part directory named after its info hash.
+func (c *torrentClient) partStorage(dir string) storage.ClientImpl {
+	return storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir: dir,
+		TorrentDirMaker: func(base string, _ *metainfo.Info, infoHash metainfo.Hash) string {
+			return torrentPart(base, infoHash)
+		},
+		FilePathMaker: func(opts storage.FilePathMakerOpts) string {
+			return filepath.Join(append([]string{torrentName(opts.Info)}, opts.File.BestPath()...)...)
+		},
+		PieceCompletion: c.completion,
+	})
+}
+
+// seedStorage serves a completed torrent from its final name.
+func (c *torrentClient) seedStorage(fname string) storage.ClientImpl {
+	return storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir: filepath.Dir(fname),
+		FilePathMaker: func(opts storage.FilePathMakerOpts) string {
+			return filepath.Join(append([]string{filepath.Base(fname)}, opts.File.BestPath()...)...)
+		},
+		PieceCompletion: c.completion,
+	})
+}
+
+func torrentPart(dir string, infoHash metainfo.Hash) string {
+	return partName(filepath.Join(dir, infoHash.HexString()))
+}
+
+func torrentSpec(magnet string, metaInfo []byte) (*torrent.TorrentSpec, error) {
+	if metaInfo == nil {
+		return torrent.TorrentSpecFromMagnetUri(magnet)
+	}
+	mi, err := metainfo.Load(bytes.NewReader(metaInfo))
+	if err != nil {
+		return nil, err
+	}
+	return torrent.TorrentSpecFromMetaInfoErr(mi)
+}
+
+// addTorrent adds the torrent of the task to the client with store.
+func (d *DownloadFile) addTorrent(client *torrentClient, store storage.ClientImpl) (*torrent.Torrent, error) {
+	d.mu.Lock()
+	metaInfo := d.Torrent.MetaInfo
+	d.mu.Unlock()
+	spec, err := torrentSpec(d.Url, metaInfo)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := client.Torrent(spec.InfoHash); ok {
+		return nil, errors.New("the torrent is already active in another task")
+	}
+	spec.Storage = store
+	t, _, err := client.AddTorrentSpec(spec)
+	return t, err
+}
+
+// resumeTorrent downloads the selected files of the torrent into its .part
+// directory, moves them into place and hands the torrent over to seeding.
+// Pausing or canceling drops the torrent from the client, the piece
+// completion database remembers the pieces already verified.
+func (d *DownloadFile) resumeTorrent() bool {
+	d.mu.Lock()
+	torrents := d.torrents
+	d.mu.Unlock()
+	if torrents == nil {
+		log_and_set_error(d, "error starting the torrent", errors.New("no BitTorrent client"))
+		return true
+	}
+	client, err := torrents()
+	if err != nil {
+		log_and_set_error(d, "error starting the BitTorrent client", err)
+		return true
+	}
+	t, err := d.addTorrent(client, client.partStorage(d.dir))
+	if err != nil {
+		log_and_set_error(d, "error adding the torrent", err)
+		return true
+	}
+	d.mu.Lock()
+	d.Started = time.Now()
+	d.torrentStatus = &TorrentStatus{InfoHash: t.InfoHash().HexString(), Uploaded: d.Torrent.Uploaded}
+	d.mu.Unlock()
+
+	selected, done := d.fetchTorrent(t)
+	t.Drop()
+	if !done {
+		return true
+	}
+	if err := d.commitTorrent(t.Info(), t.InfoHash(), selected); err != nil {
+		log_and_set_error(d, "error moving the torrent into place", err)
+		return true
+	}
+	d.setCompleted()
+	log.Printf("[*] Torrent completed: %s", d.Fname)
+	d.startSeeding(client, selected)
+	return true
+}
+
+// fetchTorrent waits for the info of the torrent, selects its files and
+// follows the download until the selected files are complete. It returns
+// the selection and whether the files completed before the task was
+// paused, canceled or failed.
+func (d *DownloadFile) fetchTorrent(t *torrent.Torrent) ([]bool, bool) {
+	// magnet links need the metadata from the swarm first
+	select {
+	case <-t.GotInfo():
+	case <-d.CancelChan:
+		d.setCanceled()
+		return nil, false
+	case <-d.PauseChan:
+		d.setPaused()
+		return nil, false
+	}
+
+	d.mu.Lock()
+	indices, metaInfo := d.Torrent.Files, d.Torrent.MetaInfo
+	d.mu.Unlock()
+	files := t.Files()
+	selected := make([]bool, len(files))
+	for _, index := range indices {
+		if index >= len(files) {
+			log_and_set_error(d, "error selecting files", fmt.Errorf("the torrent has no file %d", index))
+			return nil, false
+		}
+		selected[index] = true
+	}
+	for i, file := range files {
+		if len(indices) == 0 || selected[i] {
+			selected[i] = true
+			file.Download()
+		} else {
+			file.SetPriority(types.PiecePriorityNone)
+		}
+	}
+
+	// keep the metadata so that restarts do not need the swarm for it
+	if metaInfo == nil {
+		data, err := bencode.Marshal(t.Metainfo())
+		if err != nil {
+			log_and_set_error(d, "error saving the torrent metadata", err)
+			return nil, false
+		}
+		d.mu.Lock()
+		d.Torrent.MetaInfo = data
+		d.mu.Unlock()
+	}
+	if err := d.settleName(func() (string, error) { return torrentName(t.Info()), nil }); err != nil {
+		log_and_set_error(d, "error choosing the output file", err)
+		return nil, false
+	}
+
+	base := d.uploaded()
+	ticker := time.NewTicker(torrentPoll)
+	defer ticker.Stop()
+	for {
+		if d.updateTorrent(t, selected, base, false) {
+			return selected, true
+		}
+		select {
+		case <-d.CancelChan:
+			d.setCanceled()
+			return nil, false
+		case <-d.PauseChan:
+			d.setPaused()
+			return nil, false
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *DownloadFile) uploaded() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.Torrent.Uploaded
+}
+
+// updateTorrent refreshes the progress and swarm of the task, base being
+// the bytes uploaded before t was added. Once the task completed only the
+// swarm is refreshed. It reports whether the selected files are complete.
+func (d *DownloadFile) updateTorrent(t *torrent.Torrent, selected []bool, base int64, seeding bool) bool {
+	stats := t.Stats()
+	status := &TorrentStatus{
+		InfoHash:   t.InfoHash().HexString(),
+		Peers:      stats.ActivePeers,
+		Seeders:    stats.ConnectedSeeders,
+		KnownPeers: stats.TotalPeers,
+		Uploaded:   base + stats.BytesWrittenData.Int64(),
+		Seeding:    seeding,
+	}
+	d.mu.Lock()
+	if d.Completed {
+		// pieces shared with files left out cannot be checked once those
+		// are gone, so the files keep their state from the download
+		status.Files = d.torrentStatus.Files
+		if d.Size > 0 {
+			status.Ratio = float64(status.Uploaded) / float64(d.Size)
+		}
+		d.Torrent.Uploaded = status.Uploaded
+		d.torrentStatus = status
+		d.mu.Unlock()
+		return true
+	}
+	d.mu.Unlock()
+
+	var size, completed int64
+	for i, file := range t.Files() {
+		entry := &TorrentFileStatus{Index: i, Path: file.DisplayPath(), Size: file.Length(), Downloaded: file.BytesCompleted(), Selected: selected[i]}
+		status.Files = append(status.Files, entry)
+		if entry.Selected {
+			size += entry.Size
+			completed += entry.Downloaded
+		}
+	}
+	if size > 0 {
+		status.Ratio = float64(status.Uploaded) / float64(size)
+	}
+
+	d.mu.Lock()
+	d.Size = size
+	d.Torrent.Uploaded = status.Uploaded
+	d.torrentStatus = status
+	d.mu.Unlock()
+	if delta := completed - d.downloaded(); delta > 0 {
+		d.addProgress(int(delta))
+	} else {
+		atomic.StoreInt64(&d.DownloadedSize, completed)
+	}
+	return completed == size && verified(t, selected)
+}
+
+// verified reports whether every piece of the selected files passed its
+// hash check. The completed bytes of a file also count chunks of pieces
+// that are still being checked.
+func verified(t *torrent.Torrent, selected []bool) bool {
+	for i, file := range t.Files() {
+		for piece := file.BeginPieceIndex(); selected[i] && piece < file.EndPieceIndex(); piece++ {
+			if !t.PieceState(piece).Complete {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// commitTorrent moves the completed torrent out of its .part directory,
+// leaving out the files that were not selected.
+func (d *DownloadFile) commitTorrent(info *metainfo.Info, infoHash metainfo.Hash, selected []bool) error {
+	part := torrentPart(d.dir, infoHash)
+	root := filepath.Join(part, torrentName(info))
+	for i, file := range info.UpvertedFiles() {
+		if !selected[i] && info.IsDir() {
+			// pieces shared with selected files leave parts of them behind
+			path := filepath.Join(append([]string{root}, file.BestPath()...)...)
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	if err := os.Rename(root, d.Fname); err != nil {
+		return err
+	}
+	// the rename conflict policy reserves the name with an empty .part file
+	if stat, err := os.Stat(partName(d.Fname)); err == nil && stat.Mode().IsRegular() && stat.Size() == 0 {
+		os.Remove(partName(d.Fname))
+	}
+	if err := syncFile(filepath.Dir(d.Fname)); err != nil {
+		log.Println("Error syncing the download directory:", err)
+	}
+	return os.RemoveAll(part)
+}
+
+// seedLimits returns the seeding limits of the task.
+func (d *DownloadFile) seedLimits() SeedLimits {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Torrent.Seed != nil {
+		return *d.Torrent.Seed
+	}
+	if d.defaultSeed != nil {
+		return d.defaultSeed()
+	}
+	return SeedLimits{}
+}
+
+// startSeeding serves the completed torrent from its final name until a
+// seeding limit is reached or stopSeeding is called.
+func (d *DownloadFile) startSeeding(client *torrentClient, selected []bool) {
+	limits := d.seedLimits()
+	if !limits.enabled() {
+		return
+	}
+	t, err := d.addTorrent(client, client.seedStorage(d.Fname))
+	if err != nil {
+		log.Println("Error seeding the torrent:", err)
+		return
+	}
+	stop := make(chan struct{})
+	d.mu.Lock()
+	d.seedStop = stop
+	status := *d.torrentStatus
+	status.Seeding = true
+	d.torrentStatus = &status
+	d.mu.Unlock()
+
+	go func() {
+		defer t.Drop()
+		<-t.GotInfo()
+		for i, file := range t.Files() {
+			if !selected[i] {
+				file.SetPriority(types.PiecePriorityNone)
+			}
+		}
+		base, started := d.uploaded(), time.Now()
+		ticker := time.NewTicker(torrentPoll)
+		defer ticker.Stop()
+	seed:
+		for {
+			d.updateTorrent(t, selected, base, true)
+			d.mu.Lock()
+			ratio := d.torrentStatus.Ratio
+			d.mu.Unlock()
+			if (limits.Ratio > 0 && ratio >= limits.Ratio) || (limits.Time > 0 && time.Since(started) >= limits.Time) {
+				log.Printf("[*] Seeding limit reached: %s", d.Fname)
+				break
+			}
+			select {
+			case <-stop:
+				break seed
+			case <-ticker.C:
+			}
+		}
+		d.updateTorrent(t, selected, base, false)
+		d.stopSeeding()
+	}()
+}
+
+// stopSeeding stops seeding a completed torrent.
+func (d *DownloadFile) stopSeeding() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seedStop != nil {
+		close(d.seedStop)
+		d.seedStop = nil
+	}
+}
+
+// ParseFileIndices reads a comma separated list of file indices such as
+// "0,2,5".
+func ParseFileIndices(list string) ([]int, error) {
+	var indices []int
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		index, err := strconv.Atoi(field)
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid file index %q", field)
+		}
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
+// ParseSeedLimits reads the `seed_ratio` and `seed_time` settings returned by
+// get on top of base. A limit of 0 removes it. It returns nil when neither is
+// set.
+func ParseSeedLimits(base SeedLimits, get func(string) string) (*SeedLimits, error) {
+	if get("seed_ratio") == "" && get("seed_time") == "" {
+		return nil, nil
+	}
+	limits := base
+	if value := get("seed_ratio"); value != "" {
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil || ratio < 0 {
+			return nil, fmt.Errorf("seed_ratio must be a positive number such as 1.5")
+		}
+		limits.Ratio = ratio
+	}
+	if value := get("seed_time"); value != "" {
+		if value == "0" {
+			limits.Time = 0
+		} else if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+			return nil, fmt.Errorf("seed_time must be a positive duration such as 2h")
+		} else {
+			limits.Time = duration
+		}
+	}
+	return &limits, nil
+}
@@ -0,0 +1,270 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"golang.org/x/time/rate"
+)
+
+// localPeers keeps test clients on IPv4 TCP without port forwarding.
+func localPeers(config *torrent.ClientConfig) {
+	config.ListenPort = 0
+	config.NoDHT = true
+	config.DisableIPv6 = true
+	config.DisableUTP = true
+	config.NoDefaultPortForwarding = true
+}
+
+// torrentTracker starts an HTTP tracker handing out every peer that
+// announced. Stopped peers are kept: the task client announces a stop for
+// the torrent it downloaded with and a start for the one it seeds with, in
+// no particular order.
+func torrentTracker(t *testing.T) string {
+	var mu sync.Mutex
+	swarms := make(map[string]map[string][]byte) // info hash, peer ID, compact address
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		infoHash, peerID := query.Get("info_hash"), query.Get("peer_id")
+		port, _ := strconv.Atoi(query.Get("port"))
+		mu.Lock()
+		if swarms[infoHash] == nil {
+			swarms[infoHash] = make(map[string][]byte)
+		}
+		swarms[infoHash][peerID] = append(net.IPv4(127, 0, 0, 1).To4(), byte(port>>8), byte(port))
+		var peers []byte
+		for id, addr := range swarms[infoHash] {
+			if id != peerID {
+				peers = append(peers, addr...)
+			}
+		}
+		mu.Unlock()
+		data, _ := bencode.Marshal(map[string]interface{}{"interval": 1, "peers": string(peers)})
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce"
+}
+
+// torrentSeeder builds a torrent of files announced to tracker and seeds it,
+// uploading at most limit bytes per second when limit is set.
+func torrentSeeder(t *testing.T, tracker string, files map[string][]byte, limit int) (*metainfo.MetaInfo, *torrent.Client) {
+	root := filepath.Join(t.TempDir(), "release")
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		if err := os.WriteFile(filepath.Join(root, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := metainfo.Info{PieceLength: 32 << 10}
+	if err := info.BuildFromFilePath(root); err != nil {
+		t.Fatal(err)
+	}
+	mi := &metainfo.MetaInfo{Announce: tracker}
+	var err error
+	if mi.InfoBytes, err = bencode.Marshal(info); err != nil {
+		t.Fatal(err)
+	}
+
+	config := torrent.NewDefaultClientConfig()
+	localPeers(config)
+	config.Seed = true
+	config.DefaultStorage = storage.NewFileWithCompletion(filepath.Dir(root), storage.NewMapPieceCompletion())
+	if limit > 0 {
+		config.UploadRateLimiter = rate.NewLimiter(rate.Limit(limit), 32<<10)
+	}
+	client, err := torrent.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	seed, err := client.AddTorrent(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed.VerifyData()
+	return mi, client
+}
+
+func torrentManager(t *testing.T, seed SeedLimits) *TaskManager {
+	defer func(poll time.Duration) { t.Cleanup(func() { torrentPoll = poll }) }(torrentPoll)
+	torrentPoll = 20 * time.Millisecond
+	m := NewTaskManager(1)
+	m.SetTorrent(&TorrentSettings{StateDir: t.TempDir(), Seed: seed, configure: localPeers})
+	t.Cleanup(func() {
+		if m.torrent != nil {
+			m.torrent.Close()
+			m.torrent.completion.Close()
+		}
+	})
+	return m
+}
+
+func randomBytes(n int) []byte {
+	content := make([]byte, n)
+	rand.Read(content)
+	return content
+}
+
+func TestTorrentSelectedFilesAndSeeding(t *testing.T) {
+	tracker := torrentTracker(t)
+	files := map[string][]byte{
+		"a/one.bin": randomBytes(200 << 10),
+		"b/two.bin": randomBytes(100 << 10),
+		"notes.txt": []byte("release notes"),
+	}
+	mi, seeder := torrentSeeder(t, tracker, files, 0)
+	var metaInfo bytes.Buffer
+	mi.Write(&metaInfo)
+
+	m := torrentManager(t, SeedLimits{Time: time.Hour})
+	dir := t.TempDir()
+	// files are sorted by path: a/one.bin, b/two.bin, notes.txt
+	download, err := NewTorrentDownloader("", metaInfo.Bytes(), dir, "", []int{0, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Add(download)
+	download.Resume()
+
+	if download.State() != "completed" {
+		t.Fatalf("expected the torrent to complete, got %s: %v", download.State(), download.Error)
+	}
+	if download.Fname != filepath.Join(dir, "release") {
+		t.Fatalf("expected the torrent to be named after its info, got %s", download.Fname)
+	}
+	for _, name := range []string{"a/one.bin", "notes.txt"} {
+		got, err := os.ReadFile(filepath.Join(download.Fname, name))
+		if err != nil || !bytes.Equal(got, files[name]) {
+			t.Fatalf("expected %s to be downloaded: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(download.Fname, "b/two.bin")); !os.IsNotExist(err) {
+		t.Fatal("expected the file left out of the selection to be removed")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected the .part directory to be removed, got %v", entries)
+	}
+	status := download.Status()
+	if status.Percentage != 100 || status.Size != int64(len(files["a/one.bin"])+len(files["notes.txt"])) {
+		t.Fatalf("unexpected progress %v%% of %d", status.Percentage, status.Size)
+	}
+	if !status.Torrent.Seeding || len(status.Torrent.Files) != 3 || status.Torrent.Files[1].Selected {
+		t.Fatalf("unexpected torrent status %+v", status.Torrent)
+	}
+
+	// with the original seeder gone, a new peer gets the files from the task
+	seeder.Close()
+	config := torrent.NewDefaultClientConfig()
+	localPeers(config)
+	config.DataDir = t.TempDir()
+	leecher, err := torrent.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	leech, _ := leecher.AddTorrent(mi)
+	<-leech.GotInfo()
+	leech.Files()[0].Download()
+	// the last piece of one.bin is shared with two.bin, which was left out
+	pieces := int64(len(files["a/one.bin"]) / (32 << 10) * (32 << 10))
+	waitFor(t, "the task to upload", func() bool { return download.Status().Torrent.Uploaded >= pieces })
+	if ratio := download.Status().Torrent.Ratio; ratio < 0.9 {
+		t.Fatalf("expected the ratio to follow the upload, got %v", ratio)
+	}
+
+	if err := m.Cancel(download.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "seeding to stop", func() bool { return !download.Status().Torrent.Seeding })
+}
+
+func TestTorrentMagnetPauseResumeCancel(t *testing.T) {
+	tracker := torrentTracker(t)
+	content := randomBytes(512 << 10)
+	mi, _ := torrentSeeder(t, tracker, map[string][]byte{"image.iso": content}, 256<<10)
+	info, _ := mi.UnmarshalInfo()
+	magnet := mi.Magnet(nil, &info).String()
+
+	m := torrentManager(t, SeedLimits{})
+	dir := t.TempDir()
+	download, err := NewTorrentDownloader(magnet, nil, dir, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Add(download)
+	done := make(chan bool)
+	go func() { done <- download.Resume() }()
+	waitFor(t, "download to start", func() bool { return download.Status().DownloadedBytes > 0 })
+	download.Pause()
+	<-done
+	if download.State() != "paused" {
+		t.Fatalf("expected the torrent to pause, got %s: %v", download.State(), download.Error)
+	}
+	if download.record(download.ID).Torrent.MetaInfo == nil {
+		t.Fatal("expected the metadata of the magnet link to be kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "release", "image.iso")); err == nil {
+		t.Fatal("expected the data to stay in the .part directory until complete")
+	}
+
+	download.Resume()
+	if download.State() != "completed" {
+		t.Fatalf("expected the torrent to complete, got %s: %v", download.State(), download.Error)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "release", "image.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content does not match")
+	}
+	if download.Status().Torrent.Seeding {
+		t.Fatal("expected no seeding without limits")
+	}
+
+	other, _ := NewTorrentDownloader(magnet, nil, t.TempDir(), "", nil)
+	m.Add(other)
+	go func() { done <- other.Resume() }()
+	waitFor(t, "download to start", func() bool { return other.Status().Size > 0 })
+	if err := m.Cancel(other.ID); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if other.State() != "canceled" {
+		t.Fatalf("expected the torrent to be canceled, got %s", other.State())
+	}
+}
+
+func TestNewTorrentDownloaderRejectsInvalidInput(t *testing.T) {
+	if _, err := NewTorrentDownloader("https://example.com/file.torrent", nil, t.TempDir(), "", nil); err == nil {
+		t.Fatal("expected a URL that is not a magnet link to be rejected")
+	}
+	mi, _ := torrentSeeder(t, "http://127.0.0.1:1/announce", map[string][]byte{"file": []byte("x")}, 0)
+	var metaInfo bytes.Buffer
+	mi.Write(&metaInfo)
+	if _, err := NewTorrentDownloader("", metaInfo.Bytes(), t.TempDir(), "", []int{1}); err == nil {
+		t.Fatal("expected a file index beyond the torrent to be rejected")
+	}
+	if indices, err := ParseFileIndices("0, 2,5"); err != nil || len(indices) != 3 || indices[2] != 5 {
+		t.Fatalf("unexpected indices %v %v", indices, err)
+	}
+	values := map[string]string{"seed_ratio": "2.5", "seed_time": "0"}
+	limits, err := ParseSeedLimits(SeedLimits{Ratio: 1, Time: time.Hour}, func(name string) string { return values[name] })
+	if err != nil || *limits != (SeedLimits{Ratio: 2.5}) {
+		t.Fatalf("unexpected seeding limits %+v %v", limits, err)
+	}
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrContentChanged is returned when the origin no longer serves the file a
+// partial download was started from.
+var ErrContentChanged = errors.New("remote file changed since the download started")
+
+// ifRange returns the validator to send with a Range request to link so
+// that the origin only honours it while the file is unchanged. Weak ETags
+// can not be used for ranges, Last-Modified is used instead. Mirrors other
+// than the one the validators came from get none.
+func (d *DownloadFile) ifRange(link string) string {
+	if !d.validatedBy(link) {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ETag != "" && !strings.HasPrefix(d.ETag, "W/") {
+		return d.ETag
+	}
+	return d.LastModified
+}
+
+// setValidators records the ETag and Last-Modified of the file being
+// downloaded from link.
+func (d *DownloadFile) setValidators(header http.Header, link string) {
+	d.mu.Lock()
+	d.Origin = link
+	d.ETag = header.Get("ETag")
+	d.LastModified = header.Get("Last-Modified")
+	d.mu.Unlock()
+}
+
+// validatorsChanged reports whether header, received from link, describes a
+// different file than the one recorded by setValidators.
+func (d *DownloadFile) validatorsChanged(header http.Header, link string) bool {
+	if !d.validatedBy(link) {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ETag != "" && header.Get("ETag") != "" {
+		return d.ETag != header.Get("ETag")
+	}
+	if d.LastModified != "" && header.Get("Last-Modified") != "" {
+		return d.LastModified != header.Get("Last-Modified")
+	}
+	return false
+}
+
+// parseContentRange reads a Content-Range header such as "bytes 0-499/1234",
+// "bytes 0-499/*" or "bytes */1234". Unknown parts are returned as -1.
+func parseContentRange(value string) (start, end, total int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", value)
+	spec, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	span, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total < 0 {
+			return 0, 0, 0, invalid
+		}
+	}
+	if span == "*" {
+		return -1, -1, total, nil
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start || (total >= 0 && end >= total) {
+		return 0, 0, 0, invalid
+	}
+	return start, end, total, nil
+}
+
+// resumeOffset returns the offset to continue a .part file of offset bytes
+// from with link, a source without If-Range, and whether link serves that
+// file. size and modified are what link reports of the file, -1 and "" when
+// unknown. The offset is 0 when the file changed on the source the download
+// started from; false means link is a mirror serving another file.
+func (d *DownloadFile) resumeOffset(link string, offset, size int64, modified string) (int64, bool) {
+	if offset > 0 && d.validatedBy(link) {
+		d.mu.Lock()
+		changed := d.LastModified != "" && modified != "" && d.LastModified != modified
+		d.mu.Unlock()
+		if changed || (size >= 0 && offset > size) {
+			d.restart("Remote file changed")
+			return 0, true
+		}
+	}
+	return offset, offset == 0 || d.sameFile(link, size)
+}
+
+// restart forgets the partial download so the next run starts from zero.
+func (d *DownloadFile) restart(reason string) {
+	log.Printf("[*] %s, restarting from zero: %s", reason, redactURL(d.Url))
+	d.mu.Lock()
+	d.Segments = nil
+	d.ETag = ""
+	d.LastModified = ""
+	d.mu.Unlock()
+}
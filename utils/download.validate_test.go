@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// versionedServer serves content with an ETag through http.ServeContent,
+// which implements Range and If-Range.
+type versionedServer struct {
+	mu      sync.Mutex
+	content []byte
+	etag    string
+}
+
+func (s *versionedServer) set(content []byte, etag string) {
+	s.mu.Lock()
+	s.content, s.etag = content, etag
+	s.mu.Unlock()
+}
+
+func (s *versionedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, etag := s.content, s.etag
+	s.mu.Unlock()
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+}
+
+func TestResumeRestartsWhenContentChanged(t *testing.T) {
+	for _, connections := range []int{1, 4} {
+		origin := &versionedServer{}
+		origin.set(bytes.Repeat([]byte("a"), 256*1024), `"v1"`)
+		server := httptest.NewServer(origin)
+
+		download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+		download.Connections = connections
+		download.SetRateLimit(64 * 1024)
+		done := make(chan bool)
+		go func() { done <- download.Resume() }()
+
+		waitFor(t, "download to start", func() bool { return download.Status().DownloadedBytes > 0 })
+		download.Pause()
+		<-done
+		if download.Status().ETag != `"v1"` {
+			t.Fatalf("expected the ETag to be recorded, got %q", download.Status().ETag)
+		}
+
+		changed := bytes.Repeat([]byte("b"), 128*1024)
+		origin.set(changed, `"v2"`)
+		download.SetRateLimit(0)
+		download.Resume()
+		if download.State() != "completed" {
+			// segmented downloads notice the change on a segment and retry
+			download.Resume()
+		}
+
+		got, err := os.ReadFile(download.Fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, changed) {
+			t.Fatalf("connections=%d: expected the new version of the file, got %d bytes", connections, len(got))
+		}
+		server.Close()
+	}
+}
+
+func TestResumeRestartsWhenIfRangeIgnored(t *testing.T) {
+	origin := &versionedServer{}
+	origin.set(bytes.Repeat([]byte("a"), 256*1024), `"v1"`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("If-Range")
+		origin.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	download.SetRateLimit(64 * 1024)
+	done := make(chan bool)
+	go func() { done <- download.Resume() }()
+	waitFor(t, "download to start", func() bool { return download.Status().DownloadedBytes > 0 })
+	download.Pause()
+	<-done
+
+	// same size, so the range is still served, but with another ETag
+	changed := bytes.Repeat([]byte("b"), 256*1024)
+	origin.set(changed, `"v2"`)
+	download.SetRateLimit(0)
+	if !download.Resume() || !errors.Is(download.Error, ErrContentChanged) {
+		t.Fatalf("expected a retryable restart, got %+v", download.Status())
+	}
+	download.Resume()
+
+	got, _ := os.ReadFile(download.Fname)
+	if download.State() != "completed" || !bytes.Equal(got, changed) {
+		t.Fatalf("expected the new version of the file, got %s with %d bytes", download.State(), len(got))
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	for value, want := range map[string][3]int64{
+		"bytes 0-499/1234": {0, 499, 1234},
+		"bytes 500-999/*":  {500, 999, -1},
+		"bytes */1234":     {-1, -1, 1234},
+	} {
+		start, end, total, err := parseContentRange(value)
+		if err != nil || [3]int64{start, end, total} != want {
+			t.Fatalf("%q: got %d-%d/%d %v, want %v", value, start, end, total, err, want)
+		}
+	}
+	for _, value := range []string{"", "0-499/1234", "bytes 500-100/1234", "bytes 0-1234/1234", "bytes a-b/c"} {
+		if _, _, _, err := parseContentRange(value); err == nil {
+			t.Fatalf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestResumeAgainstServerWithoutRanges(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 4096)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content) // ignores Range
+	}))
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	if err := os.WriteFile(download.Fname, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	download.Resume()
+
+	got, _ := os.ReadFile(download.Fname)
+	if download.State() != "completed" || !bytes.Equal(got, content) {
+		t.Fatalf("expected the file to be downloaded from scratch, got %s with %d bytes", download.State(), len(got))
+	}
+}
+
+func TestResumeReadsSizeFromContentRange(t *testing.T) {
+	content := bytes.Repeat([]byte("y"), 4096)
+	server := httptest.NewServer(&versionedServer{content: content, etag: `"v1"`})
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	if err := os.WriteFile(download.Fname, content[:1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	download.Resume()
+
+	got, _ := os.ReadFile(download.Fname)
+	if status := download.Status(); status.Size != 4096 || !bytes.Equal(got, content) {
+		t.Fatalf("expected a 4096 byte file, got size %d and %d bytes", status.Size, len(got))
+	}
+}
+
+func TestResumeRejectsMisplacedRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-9/10")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	if err := os.WriteFile(download.Fname, []byte("01234"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	download.Resume()
+
+	got, _ := os.ReadFile(download.partName())
+	if download.State() != "failed" || string(got) != "01234" {
+		t.Fatalf("expected the misplaced range to be rejected, got %s with %q", download.State(), got)
+	}
+}
+
+func TestResumeRestartsWhenPartialFileTooLarge(t *testing.T) {
+	content := []byte("short")
+	server := httptest.NewServer(&versionedServer{content: content, etag: `"v1"`})
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	if err := os.WriteFile(download.Fname, []byte("much longer stale content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !download.Resume() || !errors.Is(download.Error, ErrContentChanged) {
+		t.Fatalf("expected a retryable restart, got %+v", download.Status())
+	}
+	download.Resume()
+
+	got, _ := os.ReadFile(download.Fname)
+	if download.State() != "completed" || !bytes.Equal(got, content) {
+		t.Fatalf("expected the file to be downloaded again, got %s with %q", download.State(), got)
+	}
+}
@@ -2,88 +2,160 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-func DownloadYTDLP(url, dir string, Downloads map[string]*DownloadFile) {
-	cmd := exec.Command("yt-dlp", url, "-s", "--print-json")
+// ytDlpPath is the yt-dlp program, replaced in tests.
+var ytDlpPath = "yt-dlp"
+
+// maxYtDlpErrorLines is the number of lines of yt-dlp's error output kept in
+// the error of a failed task.
+const maxYtDlpErrorLines = 5
+
+// ytDlpInfo holds the fields of yt-dlp's --print-json output we care about.
+type ytDlpInfo struct {
+	Filename       string  `json:"filename"`
+	Filesize       float64 `json:"filesize"`
+	FilesizeApprox float64 `json:"filesize_approx"`
+}
+
+// NewYtDlpDownloader creates a task that downloads url with yt-dlp. The file
+// name and size are only known once the task runs.
+func NewYtDlpDownloader(url, dir string) *DownloadFile {
+	return &DownloadFile{
+		Url:        url,
+		Kind:       KindYtDlp,
+		dir:        dir,
+		Started:    time.Now(),
+		CancelChan: make(chan bool, 1),
+		PauseChan:  make(chan bool, 1),
+	}
+}
+
+func (d *DownloadFile) resumeYtDlp() bool {
+	proxyArgs := d.ytDlpProxyArgs()
+	cmd := exec.Command(ytDlpPath, append([]string{d.Url, "-s", "--print-json"}, proxyArgs...)...)
 
 	// Capture the command's output
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Println("Error running yt-dlp:", err)
-		return
+		log_and_set_error(d, "error running yt-dlp", err)
+		return true
 	}
 
 	// Write the JSON output to a temporary file
 	jsonFile, err := writeJSON(output)
 	if err != nil {
-		log.Println("Error occurred:", err)
-		return
+		log_and_set_error(d, "error writing yt-dlp info", err)
+		return true
 	}
 	defer os.Remove(jsonFile) // Delete the temporary JSON file
 
 	// Load file info from the JSON
 	info, err := getInfo(jsonFile)
 	if err != nil {
-		log.Println("Error loading data:", err)
-		return
+		log_and_set_error(d, "error loading yt-dlp info", err)
+		return true
 	}
 
 	// Run yt-dlp to download the video based on the JSON file
-	cmd = exec.Command("yt-dlp", "--load-info-json", jsonFile, "-o", "-", "-q")
+	cmd = exec.Command(ytDlpPath, append([]string{"--load-info-json", jsonFile, "-o", "-", "-q"}, proxyArgs...)...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Println("Error creating stdout pipe:", err)
-		return
+		log_and_set_error(d, "error creating stdout pipe", err)
+		return true
 	}
+	// keep the end of the error output, to tell why yt-dlp failed
+	var stderr []string
+	errOutput := &lineWriter{logf: func(format string, args ...interface{}) {
+		stderr = appendLog(stderr, fmt.Sprintf(format, args...))
+	}}
+	cmd.Stderr = errOutput
 
 	// starting command
 	if err := cmd.Start(); err != nil {
-		log.Println("Error starting the command:", err)
-		return
+		log_and_set_error(d, "error starting yt-dlp", err)
+		return true
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+
+	d.mu.Lock()
+	d.Fname = path.Join(d.dir, path.Base(info.Filename))
+	d.Size = int64(info.Filesize)
+	if d.Size == 0 {
+		d.Size = int64(info.FilesizeApprox)
 	}
+	d.Started = time.Now()
+	fname := d.Fname
+	d.mu.Unlock()
 
 	// create output file
-	file, err := os.Create(path.Join(dir, info.Fname))
+	file, err := os.Create(partName(fname))
 	if err != nil {
-		log.Println("Error creating the output file:", err)
-		return
+		stop()
+		log_and_set_error(d, "error creating the output file", err)
+		return true
 	}
 	defer file.Close()
 
-	buffer := make([]byte, 1024)
-	info.Started = time.Now()
-	defer delete(Downloads, info.Url)
-	Downloads[url] = info
+	buffer := make([]byte, copyBufferSize)
+	atomic.StoreInt64(&d.DownloadedSize, 0)
 	for {
 		select {
-		case <-info.CancelChan:
-			log.Println("Download canceled.", info.Fname)
-			return
+		case <-d.CancelChan:
+			stop()
+			d.setCanceled()
+			return true
 		default:
 			n, err := stdout.Read(buffer)
 			if err != nil && err != io.EOF {
-				log.Println("Error reading from stdout:", err)
-				return
+				stop()
+				log_and_set_error(d, "error reading from yt-dlp", err)
+				return true
 			}
 			if n == 0 {
-				return
+				// the output is only complete if yt-dlp says so; the
+				// .part file is kept otherwise
+				err := cmd.Wait()
+				errOutput.flush()
+				if err != nil {
+					if len(stderr) > maxYtDlpErrorLines {
+						stderr = stderr[len(stderr)-maxYtDlpErrorLines:]
+					}
+					if len(stderr) > 0 {
+						err = fmt.Errorf("%w: %s", err, strings.Join(stderr, "\n"))
+					}
+					log_and_set_error(d, "yt-dlp failed", err)
+					return true
+				}
+				if err := d.commitPart(); err != nil {
+					log_and_set_error(d, "error moving the file into place", err)
+					return true
+				}
+				d.setCompleted()
+				return true
 			}
 
+			d.throttle(n)
 			_, err = file.Write(buffer[:n])
-			info.DownloadedSize += int64(n)
+			d.addProgress(n)
 
 			if err != nil {
-				log.Println("Error writing to the output file:", err)
-				return
+				stop()
+				log_and_set_error(d, "error writing to the output file", err)
+				return true
 			}
 		}
 	}
@@ -116,20 +188,19 @@ func writeJSON(jsonBytes []byte) (string, error) {
 	return fname, nil
 }
 
-func getInfo(jsonFile string) (*DownloadFile, error) {
+func getInfo(jsonFile string) (*ytDlpInfo, error) {
 	file, err := os.Open(jsonFile)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	var data DownloadFile
+	var data ytDlpInfo
 	decoder := json.NewDecoder(file)
 	err = decoder.Decode(&data)
 	if err != nil {
 		return nil, err
 	}
-	data.CancelChan = make(chan bool)
 
 	return &data, nil
 }
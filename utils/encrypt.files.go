@@ -3,40 +3,73 @@ package utils
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// errCryptCanceled ends a crypt job stopped with Cancel.
+var errCryptCanceled = errors.New("crypt job canceled")
+
+// CryptFile is an encrypt or decrypt job. CryperdSize counts the bytes of the
+// input read so far and is only accessed atomically; Task, Error, Canceled
+// and the times are guarded by mu, since /status reads them while the job
+// runs.
 type CryptFile struct {
+	mu          sync.Mutex
+	ID          string
 	FSize       int64
 	Fname       string
 	CryperdSize int64
+	Operation   string // "encrypt" or "decrypt"
+	KeyRef      string // name of the key, to run the job again after a restart
 	fpath       string
-	key         *[]byte
+	key         *[]byte // the passphrase of passphrase jobs
+	passphrase  bool
+	kdf         *KDFParams // derives the key of passphrase encryptions
 	Task        string
+	Error       error
+	Canceled    bool
+	Started     time.Time
+	Finished    time.Time
+	cancel      chan struct{}
 }
 
 func Encryptor(fpath string, key *[]byte) (*CryptFile, func() error) {
-	// Get file size
-	fileInfo, err := os.Stat(fpath)
-	if err != nil || os.IsNotExist(err) {
-		fmt.Printf("Error getting file information: %v\n", err)
-		return nil, nil
+	return newCrypt(fpath, key, "encrypt")
+}
+
+func Decryptor(fpath string, key *[]byte) (*CryptFile, func() error) {
+	return newCrypt(fpath, key, "decrypt")
+}
+
+// PassphraseEncryptor encrypts with a key derived from passphrase and a
+// random salt by params, which are recorded in the file.
+func PassphraseEncryptor(fpath string, passphrase []byte, params KDFParams) (*CryptFile, func() error) {
+	obj, run := newCrypt(fpath, &passphrase, "encrypt")
+	if obj != nil {
+		obj.KeyRef, obj.passphrase, obj.kdf = PassphraseKeyID, true, &params
 	}
-	obj := &CryptFile{
-		fpath: fpath,
-		key:   key,
-		FSize: fileInfo.Size(),
-		Fname: filepath.Base(fpath),
+	return obj, run
+}
+
+// PassphraseDecryptor decrypts a file written by PassphraseEncryptor, with
+// the parameters recorded in it.
+func PassphraseDecryptor(fpath string, passphrase []byte) (*CryptFile, func() error) {
+	obj, run := newCrypt(fpath, &passphrase, "decrypt")
+	if obj != nil {
+		obj.KeyRef, obj.passphrase = PassphraseKeyID, true
 	}
-	return obj, obj.encrypt
+	return obj, run
 }
 
-func Decryptor(fpath string, key *[]byte) (*CryptFile, func() error) {
+func newCrypt(fpath string, key *[]byte, operation string) (*CryptFile, func() error) {
 	// Get file size
 	fileInfo, err := os.Stat(fpath)
 	if err != nil || os.IsNotExist(err) {
@@ -44,12 +77,50 @@ func Decryptor(fpath string, key *[]byte) (*CryptFile, func() error) {
 		return nil, nil
 	}
 	obj := &CryptFile{
-		fpath: fpath,
-		key:   key,
-		FSize: fileInfo.Size(),
-		Fname: filepath.Base(fpath),
+		fpath:     fpath,
+		key:       key,
+		FSize:     fileInfo.Size(),
+		Fname:     filepath.Base(fpath),
+		Operation: operation,
+		cancel:    make(chan struct{}),
+	}
+	return obj, obj.run
+}
+
+// RestartCrypt rebuilds the job of a crypt task restored from the journal.
+func RestartCrypt(cr *CryptFile, key *[]byte) (*CryptFile, func() error) {
+	operation := cr.Operation
+	if operation == "" && cr.Task == "Decrypting" {
+		operation = "decrypt"
+	}
+	restarted, run := Encryptor(cr.fpath, key)
+	if operation == "decrypt" {
+		restarted, run = Decryptor(cr.fpath, key)
+	}
+	if restarted != nil {
+		restarted.KeyRef = cr.KeyRef
+	}
+	return restarted, run
+}
+
+// run does the job and records how it ended.
+func (cr *CryptFile) run() error {
+	cr.mu.Lock()
+	cr.Started, cr.Finished, cr.Error = time.Now(), time.Time{}, nil
+	cr.mu.Unlock()
+	atomic.StoreInt64(&cr.CryperdSize, 0)
+
+	var err error
+	if cr.Operation == "decrypt" {
+		err = cr.decrypt()
+	} else {
+		err = cr.encrypt()
 	}
-	return obj, obj.decrypt
+
+	cr.mu.Lock()
+	cr.Task, cr.Error, cr.Finished = "", err, time.Now()
+	cr.mu.Unlock()
+	return err
 }
 
 func (cr *CryptFile) encrypt() error {
@@ -65,54 +136,15 @@ func (cr *CryptFile) encrypt() error {
 	}
 	defer input.Close()
 
-	// Create AES cipher block
-	block, err := aes.NewCipher(*cr.key)
-	if err != nil {
-		return err
-	}
-
-	// Create AES cipher mode
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return err
-	}
-	stream := cipher.NewCFBEncrypter(block, iv)
-
-	outputFile := cr.fpath + ".crypted"
-
-	// Create output file
-	output, err := os.Create(outputFile)
+	header, err := newStreamHeader(cryptKeyID(cr.KeyRef), cr.kdf)
 	if err != nil {
 		return err
 	}
-	defer output.Close()
-
-	// Write IV to output file
-	if _, err := output.Write(iv); err != nil {
-		return err
-	}
-
-	// Encrypt and write each block
-	buffer := make([]byte, 4096) // Adjust block size as needed :)
-	cr.CryperdSize = 0
-	cr.Task = "Encrypting"
-	for {
-		n, err := input.Read(buffer)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		stream.XORKeyStream(buffer[:n], buffer[:n])
-		cr.CryperdSize += int64(n) // Update Encrypted Chunk Size
-		if _, err := output.Write(buffer[:n]); err != nil {
-			return err
-		}
-	}
-	cr.Task = ""
 
-	return nil
+	cr.setTask("Encrypting")
+	return writeCryptOutput(cr.fpath+".crypted", func(output io.Writer) error {
+		return cr.sealStream(input, output, header)
+	})
 }
 
 func (cr *CryptFile) decrypt() error {
@@ -127,11 +159,43 @@ func (cr *CryptFile) decrypt() error {
 	}
 	defer input.Close()
 
+	header, err := readStreamHeader(input)
+	if errors.Is(err, errLegacyFormat) {
+		if cr.passphrase {
+			return fmt.Errorf("%s was encrypted with a key, not a passphrase", cr.Fname)
+		}
+		if _, err := input.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return cr.decryptLegacy(input)
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case header.KDF != nil && !cr.passphrase:
+		return fmt.Errorf("%s is protected by a passphrase", cr.Fname)
+	case header.KDF == nil && cr.passphrase:
+		return fmt.Errorf("%s was encrypted with the %q key, not a passphrase", cr.Fname, header.KeyID)
+	case header.KDF == nil && cr.KeyRef != "" && cryptKeyID(cr.KeyRef) != header.KeyID:
+		return fmt.Errorf("%s was encrypted with the %q key", cr.Fname, header.KeyID)
+	}
+
+	cr.setTask("Decrypting")
+	return writeCryptOutput(strings.TrimSuffix(cr.fpath, ".crypted"), func(output io.Writer) error {
+		return cr.openStream(input, output, header)
+	})
+}
+
+// decryptLegacy decrypts the AES-CFB format written before the header was
+// introduced.
+func (cr *CryptFile) decryptLegacy(input io.Reader) error {
 	// Read IV from input file
 	iv := make([]byte, aes.BlockSize)
 	if _, err := io.ReadFull(input, iv); err != nil {
 		return err
 	}
+	atomic.AddInt64(&cr.CryperdSize, int64(len(iv)))
 
 	// Create AES cipher block
 	block, err := aes.NewCipher(*cr.key)
@@ -142,38 +206,131 @@ func (cr *CryptFile) decrypt() error {
 	// Create AES cipher mode
 	stream := cipher.NewCFBDecrypter(block, iv)
 
-	outputFile := strings.TrimSuffix(cr.fpath, ".crypted")
+	cr.setTask("Decrypting")
+	return writeCryptOutput(strings.TrimSuffix(cr.fpath, ".crypted"), func(output io.Writer) error {
+		return cr.xorStream(input, output, stream)
+	})
+}
+
+// PassphraseKeyID is the key ID of files encrypted with a passphrase.
+const PassphraseKeyID = "passphrase"
 
-	// Create output file
-	output, err := os.Create(outputFile)
-	if err != nil {
-		return err
+// cryptKeyID is the key ID recorded for a key reference.
+func cryptKeyID(ref string) string {
+	if ref == "" {
+		return "default"
 	}
-	defer output.Close()
+	return ref
+}
 
-	// Decrypt and write each block
-	buffer := make([]byte, 4096) // Adjust block size as needed
-	cr.CryperdSize = 0
-	cr.Task = "Decrypting"
+// xorStream passes the rest of input through stream into output, stopping
+// when the job is canceled.
+func (cr *CryptFile) xorStream(input io.Reader, output io.Writer, stream cipher.Stream) error {
+	buffer := make([]byte, 4096) // Adjust block size as needed :)
 	for {
+		select {
+		case <-cr.cancel:
+			return errCryptCanceled
+		default:
+		}
 		n, err := input.Read(buffer)
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
 			return err
 		}
 		stream.XORKeyStream(buffer[:n], buffer[:n])
-		cr.CryperdSize += int64(n)
+		atomic.AddInt64(&cr.CryperdSize, int64(n)) // Update Encrypted Chunk Size
 		if _, err := output.Write(buffer[:n]); err != nil {
 			return err
 		}
 	}
-	cr.Task = ""
+}
+
+// writeCryptOutput writes the output of a job to a hidden .part file and
+// renames it into place once complete, so that a failed or canceled job
+// leaves nothing behind.
+func writeCryptOutput(target string, write func(io.Writer) error) error {
+	part := partName(target)
+	output, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	err = write(output)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(part, target)
+	}
+	if err != nil {
+		os.Remove(part)
+	}
+	return err
+}
+
+// Cancel stops the job, removing its partial output. It has no effect on a
+// job that is done.
+func (cr *CryptFile) Cancel() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.Canceled && cr.cancel != nil {
+		cr.Canceled = true
+		close(cr.cancel)
+	}
+}
+
+// State is queued before the job starts, running while it runs, then
+// completed, failed or canceled.
+func (cr *CryptFile) State() string {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	switch {
+	case cr.Task != "" || !cr.Started.IsZero() && cr.Finished.IsZero():
+		return "running"
+	case cr.Finished.IsZero():
+		return "queued"
+	case errors.Is(cr.Error, errCryptCanceled):
+		return "canceled"
+	case cr.Error != nil:
+		return "failed"
+	}
+	return "completed"
+}
 
-	return nil
+// Result returns when the job started and finished, and the error it failed
+// with, if any.
+func (cr *CryptFile) Result() (started, finished time.Time, err error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.Started, cr.Finished, cr.Error
 }
 
+// Percentage is the share of the input read so far.
 func (cr *CryptFile) Percentage() int {
-	return int((cr.CryperdSize / cr.FSize) * 100)
+	if cr.FSize == 0 {
+		if cr.State() == "completed" {
+			return 100
+		}
+		return 0
+	}
+	return int(cr.Progress() * 100 / cr.FSize)
+}
+
+// Path is the file the job reads.
+func (cr *CryptFile) Path() string { return cr.fpath }
+
+func (cr *CryptFile) Progress() int64 { return atomic.LoadInt64(&cr.CryperdSize) }
+
+func (cr *CryptFile) Mode() string {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.Task
+}
+
+func (cr *CryptFile) setTask(task string) {
+	cr.mu.Lock()
+	cr.Task = task
+	cr.mu.Unlock()
 }
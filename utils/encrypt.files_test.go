@@ -1,7 +1,15 @@
 package utils
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -26,3 +34,289 @@ func TestNewDecryptor(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCryptJobHistory(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	dir := t.TempDir()
+	plain := bytes.Repeat([]byte("GoMirrorServer "), 100000)
+	fpath := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(fpath, plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks := NewTaskManager(1)
+	job, run := Encryptor(fpath, &key)
+	atomic.StoreInt64(&job.CryperdSize, job.FSize/2)
+	if job.Percentage() != 50 || job.State() != "queued" {
+		t.Fatalf("expected a queued job at 50%%, got %s at %d%%", job.State(), job.Percentage())
+	}
+	job.KeyRef = "default"
+	tasks.StartCrypt(job, run)
+	waitFor(t, "the encryption", func() bool { return len(tasks.CryptHistory()) == 1 })
+	if job.State() != "completed" || job.Percentage() != 100 || len(tasks.Crypts()) != 0 {
+		t.Fatalf("unexpected %s job at %d%%", job.State(), job.Percentage())
+	}
+	if _, err := os.Stat(partName(fpath + ".crypted")); !os.IsNotExist(err) {
+		t.Fatal("expected no part file to be left")
+	}
+
+	os.Remove(fpath)
+	job, run = Decryptor(fpath+".crypted", &key)
+	if err := tasks.RunCrypt(job, run); err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, _ := os.ReadFile(fpath); !bytes.Equal(decrypted, plain) || job.Percentage() != 100 {
+		t.Fatalf("unexpected decryption at %d%%", job.Percentage())
+	}
+
+	// a canceled job leaves no output behind
+	os.Remove(fpath + ".crypted")
+	job, run = Encryptor(fpath, &key)
+	job.Cancel()
+	if err := tasks.RunCrypt(job, run); !errors.Is(err, errCryptCanceled) || job.State() != "canceled" {
+		t.Fatalf("expected a canceled job, got %s: %v", job.State(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected only the plain file, got %d entries", len(entries))
+	}
+
+	// the history survives a restart through the journal
+	store, err := OpenTaskStore(filepath.Join(t.TempDir(), "tasks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := tasks.Sync(store); err != nil {
+		t.Fatal(err)
+	}
+	history, err := store.LoadCryptHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Operation != "encrypt" || history[0].KeyRef != "default" || history[1].Operation != "decrypt" || history[2].State() != "canceled" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	if crypts, _ := store.LoadCrypts(); len(crypts) != 0 {
+		t.Fatalf("expected no crypt task to restart, got %d", len(crypts))
+	}
+}
+
+// encryptTemp encrypts content in a temporary folder and returns the path
+// of the .crypted file.
+func encryptTemp(t *testing.T, key []byte, content []byte) string {
+	t.Helper()
+	fpath := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(fpath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, run := Encryptor(fpath, &key)
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(fpath)
+	return fpath + ".crypted"
+}
+
+func decryptTemp(key []byte, fpath string) ([]byte, error) {
+	job, run := Decryptor(fpath, &key)
+	if err := run(); err != nil {
+		return nil, err
+	}
+	if job.Percentage() != 100 {
+		return nil, fmt.Errorf("decryption stopped at %d%%", job.Percentage())
+	}
+	return os.ReadFile(strings.TrimSuffix(fpath, ".crypted"))
+}
+
+func TestCryptStreamRoundTrip(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	for _, size := range []int{0, 1, streamChunkSize, 2*streamChunkSize + 100} {
+		content := bytes.Repeat([]byte{0x5a}, size)
+		encrypted := encryptTemp(t, key, content)
+		if id, err := CryptKeyID(encrypted); err != nil || id != "default" {
+			t.Fatalf("unexpected key ID %q: %v", id, err)
+		}
+		decrypted, err := decryptTemp(key, encrypted)
+		if err != nil || !bytes.Equal(decrypted, content) {
+			t.Fatalf("%d bytes did not round trip: %v", size, err)
+		}
+	}
+}
+
+func TestCryptStreamRejectsTampering(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	content := bytes.Repeat([]byte("chunked "), 3*streamChunkSize/8)
+	sealed := streamChunkSize + 16
+	headerLen := len(streamMagic) + 1 + 4 + 1 + len("default") + 1 + streamSaltLen + 1 // no KDF
+
+	for name, tamper := range map[string]func([]byte) []byte{
+		"header": func(b []byte) []byte { b[headerLen-1] ^= 1; return b },
+		"data":   func(b []byte) []byte { b[headerLen+sealed+10] ^= 1; return b },
+		"reordered": func(b []byte) []byte {
+			first := append([]byte(nil), b[headerLen:headerLen+sealed]...)
+			copy(b[headerLen:], b[headerLen+sealed:headerLen+2*sealed])
+			copy(b[headerLen+sealed:], first)
+			return b
+		},
+		"truncated at a chunk": func(b []byte) []byte { return b[:headerLen+2*sealed] },
+		"truncated in a chunk": func(b []byte) []byte { return b[:len(b)-5] },
+		"truncated header":     func(b []byte) []byte { return b[:headerLen-3] },
+		"appended":             func(b []byte) []byte { return append(b, 0) },
+		"no data":              func(b []byte) []byte { return b[:headerLen] },
+	} {
+		encrypted := encryptTemp(t, key, content)
+		data, err := os.ReadFile(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(encrypted, tamper(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decryptTemp(key, encrypted); err == nil {
+			t.Errorf("%s: expected decryption to fail", name)
+		}
+		if entries, _ := os.ReadDir(filepath.Dir(encrypted)); len(entries) != 1 {
+			t.Errorf("%s: expected no output, got %d entries", name, len(entries))
+		}
+	}
+
+	encrypted := encryptTemp(t, key, content)
+	if _, err := decryptTemp([]byte("fedcba9876543210"), encrypted); !errors.Is(err, errStreamAuth) {
+		t.Fatalf("expected a wrong key to fail authentication, got %v", err)
+	}
+	job, run := Decryptor(encrypted, &key)
+	job.KeyRef = "backup"
+	if err := run(); err == nil || !strings.Contains(err.Error(), `"default" key`) {
+		t.Fatalf("expected the key ID to be checked, got %v", err)
+	}
+}
+
+func TestDecryptLegacyFormat(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	content := []byte("written before the versioned format")
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := bytes.Repeat([]byte{7}, aes.BlockSize)
+	legacy := make([]byte, len(content))
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(legacy, content)
+	fpath := filepath.Join(t.TempDir(), "old.txt.crypted")
+	if err := os.WriteFile(fpath, append(iv, legacy...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := CryptKeyID(fpath); err != nil || id != "" {
+		t.Fatalf("expected no key ID in a legacy file, got %q: %v", id, err)
+	}
+	decrypted, err := decryptTemp(key, fpath)
+	if err != nil || !bytes.Equal(decrypted, content) {
+		t.Fatalf("legacy file not decrypted: %q, %v", decrypted, err)
+	}
+}
+
+func TestCryptPassphrase(t *testing.T) {
+	content := bytes.Repeat([]byte("passphrase "), streamChunkSize/5)
+	passphrase := []byte("correct horse battery staple")
+	for _, params := range []KDFParams{
+		{Algorithm: "argon2id", Time: 1, Memory: 64, Threads: 2},
+		{Algorithm: "scrypt", N: 1 << 10, R: 8, P: 1},
+	} {
+		fpath := filepath.Join(t.TempDir(), "data.bin")
+		if err := os.WriteFile(fpath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, run := PassphraseEncryptor(fpath, passphrase, params)
+		if err := run(); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(fpath)
+		encrypted := fpath + ".crypted"
+
+		// the parameters come from the file, whatever the defaults are now
+		input, err := os.Open(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := readStreamHeader(input)
+		input.Close()
+		if err != nil || header.KeyID != PassphraseKeyID || header.KDF == nil || *header.KDF != params {
+			t.Fatalf("%s: unexpected header %+v: %v", params.Algorithm, header, err)
+		}
+
+		if _, err := decryptTemp(passphrase, encrypted); !strings.Contains(fmt.Sprint(err), "protected by a passphrase") {
+			t.Fatalf("%s: expected a key to be refused, got %v", params.Algorithm, err)
+		}
+		_, run = PassphraseDecryptor(encrypted, []byte("wrong"))
+		if err := run(); !errors.Is(err, errStreamAuth) {
+			t.Fatalf("%s: expected a wrong passphrase to fail, got %v", params.Algorithm, err)
+		}
+		_, run = PassphraseDecryptor(encrypted, passphrase)
+		if err := run(); err != nil {
+			t.Fatal(err)
+		}
+		if decrypted, _ := os.ReadFile(fpath); !bytes.Equal(decrypted, content) {
+			t.Fatalf("%s: passphrase file did not round trip", params.Algorithm)
+		}
+	}
+
+	// files written with a key can not be opened with a passphrase
+	encrypted := encryptTemp(t, []byte("0123456789abcdef"), content)
+	_, run := PassphraseDecryptor(encrypted, passphrase)
+	if err := run(); err == nil || !strings.Contains(err.Error(), "not a passphrase") {
+		t.Fatalf("expected a passphrase to be refused, got %v", err)
+	}
+}
+
+func TestDecryptStreamVersion1(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	content := []byte("written before passphrases")
+	h := &streamHeader{Version: 1, ChunkSize: 16, KeyID: "default", Salt: bytes.Repeat([]byte{3}, streamSaltLen)}
+	var raw bytes.Buffer
+	raw.WriteString(streamMagic)
+	raw.Write([]byte{1, 0, 0, 0, 16, byte(len(h.KeyID))})
+	raw.WriteString(h.KeyID)
+	raw.WriteByte(streamSaltLen)
+	raw.Write(h.Salt)
+	h.raw = raw.Bytes()
+
+	var encrypted bytes.Buffer
+	writer := &CryptFile{key: &key}
+	if err := writer.sealStream(bytes.NewReader(content), &encrypted, h); err != nil {
+		t.Fatal(err)
+	}
+	fpath := filepath.Join(t.TempDir(), "v1.txt.crypted")
+	if err := os.WriteFile(fpath, encrypted.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := decryptTemp(key, fpath)
+	if err != nil || !bytes.Equal(decrypted, content) {
+		t.Fatalf("version 1 file not decrypted: %q, %v", decrypted, err)
+	}
+}
+
+func TestParseKDFParams(t *testing.T) {
+	settings := map[string]string{}
+	get := func(name string) string { return settings[name] }
+	if params, err := ParseKDFParams(DefaultKDF, get); params != nil || err != nil {
+		t.Fatalf("expected no settings, got %+v, %v", params, err)
+	}
+	settings = map[string]string{"kdf": "scrypt", "scrypt_n": "65536"}
+	params, err := ParseKDFParams(DefaultKDF, get)
+	if err != nil || params.Algorithm != "scrypt" || params.N != 1<<16 || params.R != 8 {
+		t.Fatalf("unexpected params %+v: %v", params, err)
+	}
+	for _, invalid := range []map[string]string{
+		{"kdf": "bcrypt"},
+		{"kdf": "scrypt", "scrypt_n": "1000"},
+		{"argon2_time": "0"},
+		{"argon2_memory": "1"},
+		{"argon2_memory": "16777216"},
+		{"argon2_threads": "300"},
+	} {
+		settings = invalid
+		if _, err := ParseKDFParams(DefaultKDF, get); err == nil {
+			t.Errorf("expected %v to be refused", invalid)
+		}
+	}
+}
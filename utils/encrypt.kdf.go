@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key derivation functions of passphrase jobs, by the ID recorded in the
+// header of the files they write.
+const (
+	kdfNone     = 0 // the key is used as is
+	kdfArgon2id = 1
+	kdfScrypt   = 2
+)
+
+// Parameters above these limits are refused, so that a crafted header can
+// not make decryption use unbounded memory or time.
+const (
+	maxArgon2Memory  = 4 << 20 // KiB
+	maxArgon2Time    = 100
+	maxScryptLogN    = 24
+	maxScryptMemory  = 4 << 30 // bytes, 128 * N * r
+	maxScryptWorkers = 64      // p
+)
+
+// KDFParams derive the key of a passphrase job. They are recorded in each
+// file, so that files stay decryptable after the defaults change.
+type KDFParams struct {
+	Algorithm string // argon2id or scrypt
+	Time      uint32 // argon2id passes
+	Memory    uint32 // argon2id memory in KiB
+	Threads   uint8  // argon2id lanes
+	N         uint32 // scrypt cost, a power of two
+	R         uint32 // scrypt block size
+	P         uint32 // scrypt parallelism
+}
+
+// DefaultKDF follows the recommendations of RFC 9106 for Argon2id with
+// 64 MiB of memory, and the usual interactive scrypt parameters.
+var DefaultKDF = KDFParams{Algorithm: "argon2id", Time: 3, Memory: 64 << 10, Threads: 4, N: 1 << 15, R: 8, P: 1}
+
+// ParseKDFParams reads the `kdf`, `argon2_time`, `argon2_memory` (KiB),
+// `argon2_threads`, `scrypt_n`, `scrypt_r` and `scrypt_p` settings returned by
+// get on top of base. It returns nil when none is set.
+func ParseKDFParams(base KDFParams, get func(string) string) (*KDFParams, error) {
+	params := base
+	set := false
+	if value := get("kdf"); value != "" {
+		params.Algorithm, set = value, true
+	}
+	for _, field := range []struct {
+		name  string
+		value *uint32
+	}{
+		{"argon2_time", &params.Time},
+		{"argon2_memory", &params.Memory},
+		{"scrypt_n", &params.N},
+		{"scrypt_r", &params.R},
+		{"scrypt_p", &params.P},
+	} {
+		if value := get(field.name); value != "" {
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a positive number", field.name)
+			}
+			*field.value, set = uint32(n), true
+		}
+	}
+	if value := get("argon2_threads"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("argon2_threads must be a number from 1 to 255")
+		}
+		params.Threads, set = uint8(n), true
+	}
+	if !set {
+		return nil, nil
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+func (p *KDFParams) validate() error {
+	switch p.Algorithm {
+	case "argon2id":
+		if p.Time < 1 || p.Time > maxArgon2Time {
+			return fmt.Errorf("argon2 time must be from 1 to %d", maxArgon2Time)
+		}
+		if p.Threads < 1 {
+			return fmt.Errorf("argon2 threads must be at least 1")
+		}
+		if p.Memory < 8*uint32(p.Threads) || p.Memory > maxArgon2Memory {
+			return fmt.Errorf("argon2 memory must be from %d to %d KiB", 8*uint32(p.Threads), maxArgon2Memory)
+		}
+	case "scrypt":
+		if p.N < 2 || bits.OnesCount32(p.N) != 1 || bits.TrailingZeros32(p.N) > maxScryptLogN {
+			return fmt.Errorf("scrypt N must be a power of two up to 2^%d", maxScryptLogN)
+		}
+		if p.R < 1 || p.P < 1 || p.P > maxScryptWorkers || 128*uint64(p.N)*uint64(p.R) > maxScryptMemory {
+			return fmt.Errorf("scrypt r and p must be at least 1, p at most %d, and 128*N*r at most %d bytes", maxScryptWorkers, maxScryptMemory)
+		}
+	default:
+		return fmt.Errorf("kdf must be argon2id or scrypt")
+	}
+	return nil
+}
+
+// derive returns the 32 byte key of passphrase and salt.
+func (p *KDFParams) derive(passphrase, salt []byte) ([]byte, error) {
+	if p.Algorithm == "scrypt" {
+		return scrypt.Key(passphrase, salt, int(p.N), int(p.R), int(p.P), 32)
+	}
+	return argon2.IDKey(passphrase, salt, p.Time, p.Memory, p.Threads, 32), nil
+}
+
+// encode writes the ID of the function and its parameters, as recorded in
+// the header of a file.
+func (p *KDFParams) encode(w *bytes.Buffer) {
+	if p == nil {
+		w.WriteByte(kdfNone)
+		return
+	}
+	switch p.Algorithm {
+	case "argon2id":
+		w.WriteByte(kdfArgon2id)
+		binary.Write(w, binary.BigEndian, []uint32{p.Time, p.Memory})
+		w.WriteByte(p.Threads)
+	case "scrypt":
+		w.WriteByte(kdfScrypt)
+		binary.Write(w, binary.BigEndian, []uint32{p.N, p.R, p.P})
+	}
+}
+
+// readKDFParams reads the function recorded in a header, or nil when the
+// file was encrypted with a key.
+func readKDFParams(r io.Reader) (*KDFParams, error) {
+	id := make([]byte, 1)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, errTruncated
+	}
+	var p KDFParams
+	switch id[0] {
+	case kdfNone:
+		return nil, nil
+	case kdfArgon2id:
+		field := make([]byte, 9)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, errTruncated
+		}
+		p = KDFParams{Algorithm: "argon2id", Time: binary.BigEndian.Uint32(field), Memory: binary.BigEndian.Uint32(field[4:]), Threads: field[8]}
+	case kdfScrypt:
+		field := make([]byte, 12)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, errTruncated
+		}
+		p = KDFParams{Algorithm: "scrypt", N: binary.BigEndian.Uint32(field), R: binary.BigEndian.Uint32(field[4:]), P: binary.BigEndian.Uint32(field[8:])}
+	default:
+		return nil, fmt.Errorf("unknown key derivation function %d", id[0])
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid key derivation parameters: %w", err)
+	}
+	return &p, nil
+}
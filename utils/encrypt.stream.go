@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted files start with a header: the magic and version, the size of
+// the chunks, the ID of the key, a random salt and, since version 2, the
+// function and parameters deriving the key from a passphrase. The data
+// follows as chunks sealed with AES-256-GCM in the STREAM construction: the
+// nonce of each chunk holds its index and whether it is the last one, and
+// the header is authenticated with every chunk. Modified, reordered or
+// missing chunks, including a truncated end, then fail to decrypt.
+//
+// Files without the magic are the legacy format: an IV followed by the data
+// in AES-CFB, without authentication.
+const (
+	streamMagic     = "GMSE"
+	streamVersion   = 2
+	streamChunkSize = 64 << 10
+	streamMaxChunk  = 16 << 20
+	streamSaltLen   = 32
+	streamPrefixLen = 7 // nonce bytes before the chunk index and last flag
+	streamKeyInfo   = "GoMirrorServer STREAM v1"
+)
+
+var (
+	errLegacyFormat = errors.New("legacy encrypted file")
+	// errStreamAuth covers a wrong key as well as a modified file, which
+	// GCM can not tell apart.
+	errStreamAuth = errors.New("authentication failed: wrong key or modified file")
+	errTruncated  = errors.New("encrypted file is truncated")
+)
+
+type streamHeader struct {
+	Version   byte
+	ChunkSize uint32
+	KeyID     string
+	Salt      []byte
+	KDF       *KDFParams // nil when the file was encrypted with a key
+	raw       []byte     // the encoded header, authenticated with every chunk
+}
+
+func newStreamHeader(keyID string, kdf *KDFParams) (*streamHeader, error) {
+	if len(keyID) > math.MaxUint8 {
+		return nil, fmt.Errorf("key ID %q is too long", keyID)
+	}
+	h := &streamHeader{Version: streamVersion, ChunkSize: streamChunkSize, KeyID: keyID, Salt: make([]byte, streamSaltLen), KDF: kdf}
+	if _, err := io.ReadFull(rand.Reader, h.Salt); err != nil {
+		return nil, err
+	}
+	var raw bytes.Buffer
+	raw.WriteString(streamMagic)
+	raw.WriteByte(h.Version)
+	binary.Write(&raw, binary.BigEndian, h.ChunkSize)
+	raw.WriteByte(byte(len(h.KeyID)))
+	raw.WriteString(h.KeyID)
+	raw.WriteByte(byte(len(h.Salt)))
+	raw.Write(h.Salt)
+	h.KDF.encode(&raw)
+	h.raw = raw.Bytes()
+	return h, nil
+}
+
+// readStreamHeader reads the header of an encrypted file, failing with
+// errLegacyFormat when the file does not start with the magic.
+func readStreamHeader(r io.Reader) (*streamHeader, error) {
+	var raw bytes.Buffer
+	r = io.TeeReader(r, &raw)
+	start := make([]byte, len(streamMagic)+1)
+	if _, err := io.ReadFull(r, start); err != nil || string(start[:len(streamMagic)]) != streamMagic {
+		return nil, errLegacyFormat
+	}
+	h := &streamHeader{Version: start[len(streamMagic)]}
+	if h.Version < 1 || h.Version > streamVersion {
+		return nil, fmt.Errorf("unsupported encrypted file version %d", h.Version)
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &h.ChunkSize); err != nil {
+		return nil, errTruncated
+	}
+	if h.ChunkSize == 0 || h.ChunkSize > streamMaxChunk {
+		return nil, fmt.Errorf("invalid chunk size %d", h.ChunkSize)
+	}
+	keyID, err := readShortField(r)
+	if err != nil {
+		return nil, err
+	}
+	h.KeyID = string(keyID)
+	if h.Salt, err = readShortField(r); err != nil {
+		return nil, err
+	}
+	if h.Version >= 2 {
+		if h.KDF, err = readKDFParams(r); err != nil {
+			return nil, err
+		}
+	}
+	h.raw = raw.Bytes()
+	return h, nil
+}
+
+// readShortField reads a field prefixed with its one byte length.
+func readShortField(r io.Reader) ([]byte, error) {
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, errTruncated
+	}
+	field := make([]byte, size[0])
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, errTruncated
+	}
+	return field, nil
+}
+
+// aead derives the file key and nonce prefix from key and the salt, so that
+// no two files share them. With a KDF the key is the passphrase it is
+// derived from first.
+func (h *streamHeader) aead(key []byte) (cipher.AEAD, []byte, error) {
+	if h.KDF != nil {
+		derived, err := h.KDF.derive(key, h.Salt)
+		if err != nil {
+			return nil, nil, err
+		}
+		key = derived
+	}
+	material := make([]byte, 32+streamPrefixLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, h.Salt, []byte(streamKeyInfo)), material); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(material[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, material[32:], nil
+}
+
+func streamNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, streamPrefixLen+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// CryptKeyID returns the ID of the key an encrypted file was written with,
+// or "" for files in the legacy format, which do not record it.
+func CryptKeyID(fpath string) (string, error) {
+	input, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer input.Close()
+	h, err := readStreamHeader(input)
+	if errors.Is(err, errLegacyFormat) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return h.KeyID, nil
+}
+
+// sealStream writes the header and input as chunks to output.
+func (cr *CryptFile) sealStream(input io.Reader, output io.Writer, h *streamHeader) error {
+	aead, prefix, err := h.aead(*cr.key)
+	if err != nil {
+		return err
+	}
+	if _, err := output.Write(h.raw); err != nil {
+		return err
+	}
+	return cr.chunks(input, int(h.ChunkSize), func(index uint32, chunk []byte, last bool) error {
+		sealed := aead.Seal(nil, streamNonce(prefix, index, last), chunk, h.raw)
+		atomic.AddInt64(&cr.CryperdSize, int64(len(chunk)))
+		_, err := output.Write(sealed)
+		return err
+	})
+}
+
+// openStream decrypts the chunks following the header into output. Nothing
+// is trusted until the last chunk is authenticated, which is why the output
+// is only renamed into place once the job completes.
+func (cr *CryptFile) openStream(input io.Reader, output io.Writer, h *streamHeader) error {
+	aead, prefix, err := h.aead(*cr.key)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&cr.CryperdSize, int64(len(h.raw)))
+	return cr.chunks(input, int(h.ChunkSize)+aead.Overhead(), func(index uint32, chunk []byte, last bool) error {
+		if len(chunk) < aead.Overhead() {
+			return errTruncated
+		}
+		plain, err := aead.Open(nil, streamNonce(prefix, index, last), chunk, h.raw)
+		if err != nil {
+			return errStreamAuth
+		}
+		atomic.AddInt64(&cr.CryperdSize, int64(len(chunk)))
+		_, err = output.Write(plain)
+		return err
+	})
+}
+
+// chunks reads input in chunks of size and passes them to handle with their
+// index, reading one chunk ahead to tell the last one. An empty input makes
+// a single empty last chunk. It stops when the job is canceled.
+func (cr *CryptFile) chunks(input io.Reader, size int, handle func(uint32, []byte, bool) error) error {
+	buffer, spare := make([]byte, size), make([]byte, size)
+	n, err := io.ReadFull(input, buffer)
+	for index := uint32(0); ; index++ {
+		select {
+		case <-cr.cancel:
+			return errCryptCanceled
+		default:
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		var next int
+		var nextErr error
+		if !last {
+			if next, nextErr = io.ReadFull(input, spare); nextErr == io.EOF {
+				last = true
+			}
+		}
+		if err := handle(index, buffer[:n], last); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if index == math.MaxUint32 {
+			return errors.New("file is too large to encrypt")
+		}
+		buffer, spare = spare, buffer
+		n, err = next, nextErr
+	}
+}
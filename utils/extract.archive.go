@@ -0,0 +1,415 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/google/uuid"
+	"github.com/ulikunitz/xz"
+)
+
+// errUnsafePath rejects archive entries that would be written outside of the
+// extraction folder, as in zip-slip attacks.
+var errUnsafePath = errors.New("archive entry escapes the extraction folder")
+
+// archiveFormats are the supported archives by extension. Longer extensions
+// come first so that .tar.gz is not taken for .gz.
+var archiveFormats = []struct {
+	ext    string
+	unpack func(e *ExtractFile, root string) error
+}{
+	{".tar.gz", func(e *ExtractFile, root string) error { return e.unpackTar(root, gzipReader) }},
+	{".tgz", func(e *ExtractFile, root string) error { return e.unpackTar(root, gzipReader) }},
+	{".tar.xz", func(e *ExtractFile, root string) error { return e.unpackTar(root, xzReader) }},
+	{".txz", func(e *ExtractFile, root string) error { return e.unpackTar(root, xzReader) }},
+	{".tar", func(e *ExtractFile, root string) error { return e.unpackTar(root, nil) }},
+	{".zip", (*ExtractFile).unpackZip},
+	{".7z", (*ExtractFile).unpack7z},
+}
+
+func gzipReader(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+func xzReader(r io.Reader) (io.Reader, error)   { return xz.NewReader(r) }
+
+// ExtractOptions unpack the archive of a completed download.
+type ExtractOptions struct {
+	Password string `json:"password,omitempty"` // for encrypted .zip and .7z archives
+	Delete   bool   `json:"delete,omitempty"`   // remove the archive once unpacked
+}
+
+// ExtractFile is the extraction of an archive into a folder next to it.
+// ExtractedSize counts the bytes of the archive read so far and is only
+// accessed atomically; Task, Dir and Error are guarded by mu, since /status
+// reads them while the job runs.
+type ExtractFile struct {
+	mu            sync.Mutex
+	ID            string
+	Download      string // ID of the download the archive came from
+	FSize         int64
+	Fname         string
+	Dir           string
+	ExtractedSize int64
+	Task          string
+	Error         error
+	fpath         string
+	options       ExtractOptions
+}
+
+// IsArchive reports whether name has the extension of a supported archive.
+func IsArchive(name string) bool {
+	_, ok := archiveFormat(name)
+	return ok
+}
+
+func archiveFormat(name string) (string, bool) {
+	lower := strings.ToLower(name)
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(lower, format.ext) {
+			return format.ext, true
+		}
+	}
+	return "", false
+}
+
+// Extractor prepares the extraction of the archive at fpath. The job is
+// registered with the TaskManager before the returned function runs it, as
+// RunExtract does.
+func Extractor(fpath string, options ExtractOptions) (*ExtractFile, func() error) {
+	obj := &ExtractFile{
+		fpath:   fpath,
+		options: options,
+		Fname:   filepath.Base(fpath),
+	}
+	if info, err := os.Stat(fpath); err == nil {
+		obj.FSize = info.Size()
+	}
+	return obj, obj.extract
+}
+
+// AddExtract registers an extraction job and returns its ID.
+func (m *TaskManager) AddExtract(e *ExtractFile) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e.ID == "" {
+		e.ID = uuid.New().String()
+	}
+	m.extracts[e.ID] = e
+	return e.ID
+}
+
+// maxExtractHistory is the number of finished extraction jobs kept.
+const maxExtractHistory = 100
+
+// RunExtract registers an extraction job and runs it, moving it to the
+// history once done.
+func (m *TaskManager) RunExtract(e *ExtractFile, run func() error) error {
+	m.AddExtract(e)
+	err := run()
+	m.mu.Lock()
+	delete(m.extracts, e.ID)
+	m.extracted = append(m.extracted, e)
+	if len(m.extracted) > maxExtractHistory {
+		m.extracted = append([]*ExtractFile(nil), m.extracted[len(m.extracted)-maxExtractHistory:]...)
+	}
+	m.mu.Unlock()
+	return err
+}
+
+// Extracts returns the running extraction jobs.
+func (m *TaskManager) Extracts() []*ExtractFile {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	extracts := make([]*ExtractFile, 0, len(m.extracts))
+	for _, e := range m.extracts {
+		extracts = append(extracts, e)
+	}
+	return extracts
+}
+
+// ExtractHistory returns the finished extraction jobs, oldest first.
+func (m *TaskManager) ExtractHistory() []*ExtractFile {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*ExtractFile(nil), m.extracted...)
+}
+
+func (e *ExtractFile) extract() error {
+	atomic.StoreInt64(&e.ExtractedSize, 0)
+	e.setTask("Extracting")
+	err := e.unpack()
+	e.mu.Lock()
+	e.Task = ""
+	e.Error = err
+	e.mu.Unlock()
+	return err
+}
+
+// unpack extracts into a hidden .part folder and renames it into place
+// once every entry is written, keeping partial output out of listings.
+func (e *ExtractFile) unpack() error {
+	ext, ok := archiveFormat(e.fpath)
+	if !ok {
+		return fmt.Errorf("%s is not a supported archive", e.Fname)
+	}
+	dir, err := reserveDir(e.fpath[:len(e.fpath)-len(ext)])
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.Dir = filepath.Base(dir)
+	e.mu.Unlock()
+
+	part := partName(dir)
+	if err := os.RemoveAll(part); err != nil {
+		return err
+	}
+	if err := os.Mkdir(part, 0755); err != nil {
+		return err
+	}
+	for _, format := range archiveFormats {
+		if format.ext == ext {
+			err = format.unpack(e, part)
+		}
+	}
+	if err == nil {
+		if err = os.Remove(dir); err == nil {
+			err = os.Rename(part, dir)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(part)
+		os.Remove(dir)
+		return err
+	}
+	atomic.StoreInt64(&e.ExtractedSize, e.FSize)
+
+	if e.options.Delete {
+		if err := os.Remove(e.fpath); err != nil {
+			log.Println("Error deleting the archive:", err)
+		}
+	}
+	return nil
+}
+
+// reserveDir creates the folder the archive is unpacked into, numbering it
+// like the rename conflict policy when the name is taken.
+func reserveDir(dir string) (string, error) {
+	for i := 0; ; i++ {
+		candidate := dir
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)", dir, i)
+		}
+		err := os.Mkdir(candidate, 0755)
+		if err == nil {
+			return candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+	}
+}
+
+func (e *ExtractFile) unpackTar(root string, decompress func(io.Reader) (io.Reader, error)) error {
+	file, err := os.Open(e.fpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = &countingReader{r: file, n: &e.ExtractedSize}
+	if decompress != nil {
+		if r, err = decompress(r); err != nil {
+			return err
+		}
+	}
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mode := header.FileInfo().Mode()
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir {
+			mode |= fs.ModeIrregular // hard links and extended headers
+		}
+		if err := writeEntry(root, header.Name, mode, archive); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *ExtractFile) unpackZip(root string) error {
+	file, err := os.Open(e.fpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive, err := zip.NewReader(&countingReaderAt{r: file, n: &e.ExtractedSize}, e.FSize)
+	if err != nil {
+		return err
+	}
+	for _, f := range archive.File {
+		if err := e.unpackZipEntry(root, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *ExtractFile) unpackZipEntry(root string, f *zip.File) error {
+	if !f.Mode().IsRegular() {
+		return writeEntry(root, f.Name, f.Mode(), nil)
+	}
+	content, err := openZipEntry(f, e.options.Password)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return writeEntry(root, f.Name, f.Mode(), content)
+}
+
+func (e *ExtractFile) unpack7z(root string) (err error) {
+	// the reader panics on some malformed archives
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid 7z archive: %v", r)
+		}
+	}()
+	file, err := os.Open(e.fpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive, err := sevenzip.NewReaderWithPassword(&countingReaderAt{r: file, n: &e.ExtractedSize}, e.FSize, e.options.Password)
+	if err != nil {
+		return err
+	}
+	for _, f := range archive.File {
+		if err := unpack7zEntry(root, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unpack7zEntry(root string, f *sevenzip.File) error {
+	mode := f.FileInfo().Mode()
+	if !mode.IsRegular() {
+		return writeEntry(root, f.Name, mode, nil)
+	}
+	content, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return writeEntry(root, f.Name, mode, content)
+}
+
+// writeEntry writes the archive entry name under root. Names reaching
+// outside of root fail the extraction. Symbolic links, hard links and
+// special files are skipped, so that no later entry can be written through
+// a link.
+func writeEntry(root, name string, mode fs.FileMode, content io.Reader) error {
+	local := filepath.FromSlash(strings.TrimSuffix(strings.ReplaceAll(name, `\`, "/"), "/"))
+	if !filepath.IsLocal(local) {
+		return fmt.Errorf("%w: %s", errUnsafePath, name)
+	}
+	target := filepath.Join(root, local)
+
+	switch {
+	case mode.IsDir():
+		return os.MkdirAll(target, 0755)
+	case !mode.IsRegular() || content == nil:
+		log.Printf("[*] Skipping %s, not a regular file", name)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	output, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, content); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// countingReader and countingReaderAt add the bytes read to n, for the
+// progress of an extraction.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+type countingReaderAt struct {
+	r io.ReaderAt
+	n *int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// Percentage is the share of the archive read so far. Reading the index
+// of .zip and .7z archives counts as well, so it is capped below 100 until
+// the job is done.
+func (e *ExtractFile) Percentage() int {
+	if e.FSize == 0 {
+		return 0
+	}
+	percentage := int(e.Progress() * 100 / e.FSize)
+	if percentage >= 100 && e.Mode() != "" {
+		return 99
+	}
+	return min(percentage, 100)
+}
+
+func (e *ExtractFile) Progress() int64 { return atomic.LoadInt64(&e.ExtractedSize) }
+
+// Mode is "Extracting" while the job runs and empty once it is done.
+func (e *ExtractFile) Mode() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.Task
+}
+
+// Result returns the folder the archive is unpacked into and the error the
+// job failed with, if any.
+func (e *ExtractFile) Result() (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.Dir, e.Error
+}
+
+func (e *ExtractFile) setTask(task string) {
+	e.mu.Lock()
+	e.Task = task
+	e.mu.Unlock()
+}
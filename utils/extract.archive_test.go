@@ -0,0 +1,353 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var archiveFiles = map[string][]byte{
+	"readme.txt":      []byte("read me first"),
+	"docs/guide.md":   bytes.Repeat([]byte("# guide\n"), 500),
+	"docs/img/a.bin":  {0, 1, 2, 3, 4, 5},
+	"nested/deep.txt": []byte("deep"),
+}
+
+func sortedNames(files map[string][]byte) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeZip(t *testing.T, path string, files map[string][]byte) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range sortedNames(files) {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(files[name])
+	}
+	archive.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTar(t *testing.T, path string, compress func(io.Writer) io.WriteCloser, headers ...*tar.Header) {
+	var buf bytes.Buffer
+	w := compress(&buf)
+	archive := tar.NewWriter(w)
+	for _, header := range headers {
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		archive.Write(archiveFiles[header.Name])
+	}
+	archive.Close()
+	w.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tarHeaders(files map[string][]byte) []*tar.Header {
+	headers := []*tar.Header{{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0755}}
+	for _, name := range sortedNames(files) {
+		headers = append(headers, &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))})
+	}
+	return headers
+}
+
+// write7z stores files uncompressed in a single folder, the smallest part of
+// the 7z format a reader has to accept.
+func write7z(t *testing.T, path string, files map[string][]byte) {
+	names := sortedNames(files)
+	number := func(buf *bytes.Buffer, n int) {
+		buf.WriteByte(0xff) // the full 8 byte form
+		binary.Write(buf, binary.LittleEndian, uint64(n))
+	}
+	var data bytes.Buffer
+	for _, name := range names {
+		data.Write(files[name])
+	}
+
+	var header bytes.Buffer
+	header.Write([]byte{0x01, 0x04, 0x06}) // header, main streams, pack info
+	number(&header, 0)
+	number(&header, 1)
+	header.WriteByte(0x09) // sizes
+	number(&header, data.Len())
+	header.Write([]byte{0x00, 0x07, 0x0b}) // end, unpack info, folder
+	number(&header, 1)
+	header.WriteByte(0) // not external
+	number(&header, 1)
+	header.Write([]byte{0x01, 0x00, 0x0c}) // one byte coder ID, copy, unpack sizes
+	number(&header, data.Len())
+	header.Write([]byte{0x00, 0x08, 0x0d}) // end, substreams info, substream count
+	number(&header, len(names))
+	header.WriteByte(0x09)
+	for _, name := range names[:len(names)-1] {
+		number(&header, len(files[name]))
+	}
+	header.Write([]byte{0x0a, 1}) // digests, all defined
+	for _, name := range names {
+		binary.Write(&header, binary.LittleEndian, crc32.ChecksumIEEE(files[name]))
+	}
+	header.Write([]byte{0x00, 0x00, 0x05}) // end, end, files info
+	number(&header, len(names))
+	var utf bytes.Buffer
+	utf.WriteByte(0) // not external
+	for _, name := range names {
+		binary.Write(&utf, binary.LittleEndian, append(utf16.Encode([]rune(name)), 0))
+	}
+	header.WriteByte(0x11) // names
+	number(&header, utf.Len())
+	header.Write(utf.Bytes())
+	header.Write([]byte{0x00, 0x00})
+
+	start := make([]byte, 32)
+	copy(start, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c, 0, 4})
+	binary.LittleEndian.PutUint64(start[12:], uint64(data.Len()))
+	binary.LittleEndian.PutUint64(start[20:], uint64(header.Len()))
+	binary.LittleEndian.PutUint32(start[28:], crc32.ChecksumIEEE(header.Bytes()))
+	binary.LittleEndian.PutUint32(start[8:], crc32.ChecksumIEEE(start[12:]))
+	if err := os.WriteFile(path, append(append(start, data.Bytes()...), header.Bytes()...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkExtracted(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("expected %s to be extracted: %v", name, err)
+		}
+	}
+}
+
+func TestExtractFormats(t *testing.T) {
+	dir := t.TempDir()
+	archives := map[string]func(string){
+		"bundle.zip": func(path string) { writeZip(t, path, archiveFiles) },
+		"bundle.tar.gz": func(path string) {
+			writeTar(t, path, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }, tarHeaders(archiveFiles)...)
+		},
+		"bundle.tar.xz": func(path string) {
+			writeTar(t, path, func(w io.Writer) io.WriteCloser { x, _ := xz.NewWriter(w); return x }, tarHeaders(archiveFiles)...)
+		},
+		"bundle.7z": func(path string) { write7z(t, path, archiveFiles) },
+	}
+	for name, write := range archives {
+		archive := filepath.Join(dir, name)
+		write(archive)
+		job, run := Extractor(archive, ExtractOptions{})
+		if err := run(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		folder, err := job.Result()
+		if err != nil || job.Mode() != "" || job.Percentage() != 100 {
+			t.Fatalf("%s: unexpected job state %q %q %d%% %v", name, folder, job.Mode(), job.Percentage(), err)
+		}
+		checkExtracted(t, filepath.Join(dir, folder), archiveFiles)
+		if _, err := os.Stat(archive); err != nil {
+			t.Fatalf("%s: expected the archive to be kept", name)
+		}
+	}
+	// the folders are named after the archive and numbered once it is taken
+	entries, _ := os.ReadDir(dir)
+	var folders []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			folders = append(folders, entry.Name())
+		}
+	}
+	sort.Strings(folders)
+	if len(folders) != 4 || folders[0] != "bundle" || folders[3] != "bundle (3)" {
+		t.Fatalf("unexpected folders %v", folders)
+	}
+}
+
+// addZipCrypto stores an entry encrypted with the traditional PKWARE cipher.
+func addZipCrypto(t *testing.T, archive *zip.Writer, name, password string, content []byte) {
+	header := make([]byte, 12)
+	crc := crc32.ChecksumIEEE(content)
+	header[11] = byte(crc >> 24)
+	data := append(header, content...)
+	newZipCrypto([]byte(password)).encrypt(data)
+	w, err := archive.CreateRaw(&zip.FileHeader{
+		Name: name, Method: zip.Store, Flags: zipEncrypted, CRC32: crc,
+		CompressedSize64: uint64(len(data)), UncompressedSize64: uint64(len(content)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+}
+
+// addWinZipAES stores an entry encrypted with AES-256 in the AE-2 format.
+func addWinZipAES(t *testing.T, archive *zip.Writer, name, password string, content []byte) {
+	salt := bytes.Repeat([]byte{7}, 16)
+	keys := pbkdf2.Key([]byte(password), salt, 1000, 66, sha1.New)
+	block, _ := aes.NewCipher(keys[:32])
+	encrypted := make([]byte, len(content))
+	newWinZipCTR(block).XORKeyStream(encrypted, content)
+	mac := hmac.New(sha1.New, keys[32:64])
+	mac.Write(encrypted)
+	data := append(append(append(salt, keys[64:]...), encrypted...), mac.Sum(nil)[:zipAuthCodeLen]...)
+	extra := []byte{0x01, 0x99, 7, 0, 2, 0, 'A', 'E', 3, 0, 0}
+	w, err := archive.CreateRaw(&zip.FileHeader{
+		Name: name, Method: zipMethodAES, Flags: zipEncrypted, Extra: extra,
+		CompressedSize64: uint64(len(data)), UncompressedSize64: uint64(len(content)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+}
+
+func TestExtractEncryptedZip(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "secret.zip")
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	addZipCrypto(t, w, "legacy.txt", "hunter2", archiveFiles["docs/guide.md"])
+	addWinZipAES(t, w, "aes/modern.txt", "hunter2", archiveFiles["readme.txt"])
+	w.Close()
+	os.WriteFile(archive, buf.Bytes(), 0644)
+
+	for _, password := range []string{"", "wrong"} {
+		_, run := Extractor(archive, ExtractOptions{Password: password})
+		if err := run(); !errors.Is(err, errArchivePassword) {
+			t.Fatalf("expected password %q to be refused, got %v", password, err)
+		}
+	}
+	job, run := Extractor(archive, ExtractOptions{Password: "hunter2", Delete: true})
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	folder, _ := job.Result()
+	checkExtracted(t, filepath.Join(dir, folder), map[string][]byte{
+		"legacy.txt":     archiveFiles["docs/guide.md"],
+		"aes/modern.txt": archiveFiles["readme.txt"],
+	})
+	if _, err := os.Stat(archive); !os.IsNotExist(err) {
+		t.Fatal("expected the archive to be deleted")
+	}
+	// failed attempts leave nothing behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected only the extracted folder, got %v", entries)
+	}
+
+	// a modified byte fails the authentication of the AES entry
+	buf.Reset()
+	w = zip.NewWriter(&buf)
+	addWinZipAES(t, w, "modern.txt", "hunter2", archiveFiles["readme.txt"])
+	w.Close()
+	data := buf.Bytes()
+	data[30+len("modern.txt")+11+18] ^= 1 // first byte after the local header, salt and verifier
+	os.WriteFile(archive, data, 0644)
+	_, run = Extractor(archive, ExtractOptions{Password: "hunter2"})
+	if err := run(); err == nil || errors.Is(err, errArchivePassword) {
+		t.Fatalf("expected tampered data to fail authentication, got %v", err)
+	}
+}
+
+func TestExtractRejectsUnsafePaths(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "static")
+	os.Mkdir(root, 0755)
+	archives := map[string]func(string){
+		"slip.zip": func(path string) {
+			writeZip(t, path, map[string][]byte{"good.txt": []byte("ok"), "../evil.txt": []byte("pwned")})
+		},
+		"slip.tar.gz": func(path string) {
+			writeTar(t, path, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+				&tar.Header{Name: "readme.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(archiveFiles["readme.txt"]))},
+				&tar.Header{Name: "docs/../../../evil.txt", Typeflag: tar.TypeReg, Mode: 0644})
+		},
+		"abs.tar.gz": func(path string) {
+			writeTar(t, path, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+				&tar.Header{Name: filepath.Join(dir, "evil.txt"), Typeflag: tar.TypeReg, Mode: 0644})
+		},
+		"slip.7z": func(path string) { write7z(t, path, map[string][]byte{"../evil.txt": []byte("pwned")}) },
+	}
+	for name, write := range archives {
+		archive := filepath.Join(root, name)
+		write(archive)
+		if _, run := Extractor(archive, ExtractOptions{}); !errors.Is(run(), errUnsafePath) {
+			t.Fatalf("%s: expected the entry outside of the folder to be rejected", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected nothing to be written outside of the folder")
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != len(archives) {
+		t.Fatalf("expected the partial output to be removed, got %v", entries)
+	}
+
+	// links are skipped, so no later entry is written through them
+	archive := filepath.Join(root, "links.tar.gz")
+	writeTar(t, archive, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: dir, Mode: 0777},
+		&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+		&tar.Header{Name: "readme.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(archiveFiles["readme.txt"]))})
+	job, run := Extractor(archive, ExtractOptions{})
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	folder, _ := job.Result()
+	entries, _ := os.ReadDir(filepath.Join(root, folder))
+	if len(entries) != 1 || entries[0].Name() != "readme.txt" {
+		t.Fatalf("expected only the regular file, got %v", entries)
+	}
+}
+
+func TestDownloadExtractsOnCompletion(t *testing.T) {
+	dir := t.TempDir()
+	writeZip(t, filepath.Join(dir, "served.zip"), archiveFiles)
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	tasks := NewTaskManager(1)
+	target := t.TempDir()
+	download := NewDownloader(server.URL+"/served.zip", target, "release.zip")
+	download.Extract = &ExtractOptions{Delete: true}
+	tasks.Enqueue(download)
+	waitFor(t, "the extraction", func() bool { return len(tasks.ExtractHistory()) == 1 })
+	if running := tasks.Extracts(); len(running) != 0 {
+		t.Fatalf("expected the finished extraction to leave the running jobs, got %d", len(running))
+	}
+
+	job := tasks.ExtractHistory()[0]
+	if folder, err := job.Result(); err != nil || folder != "release" || job.Download != download.ID {
+		t.Fatalf("unexpected extraction %q of %s: %v", folder, job.Download, err)
+	}
+	checkExtracted(t, filepath.Join(target, "release"), archiveFiles)
+	if _, err := os.Stat(filepath.Join(target, "release.zip")); !os.IsNotExist(err) {
+		t.Fatal("expected the archive to be deleted")
+	}
+}
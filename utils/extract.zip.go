@@ -0,0 +1,275 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var errArchivePassword = errors.New("wrong or missing archive password")
+
+// Encrypted zip entries use the traditional PKWARE cipher, or WinZip AES
+// with the method and extra field below.
+const (
+	zipEncrypted   = 0x1
+	zipDescriptor  = 0x8
+	zipMethodAES   = 99
+	zipExtraAES    = 0x9901
+	zipAuthCodeLen = 10
+)
+
+// openZipEntry opens a zip entry for reading, decrypting it with password
+// when it is encrypted. Like zip.File.Open the content is checked against
+// its CRC-32 at the end.
+func openZipEntry(f *zip.File, password string) (io.ReadCloser, error) {
+	if f.Flags&zipEncrypted == 0 {
+		return f.Open()
+	}
+	if password == "" {
+		return nil, fmt.Errorf("%s: %w", f.Name, errArchivePassword)
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	method, checkCRC := f.Method, true
+	var plain io.Reader
+	if f.Method == zipMethodAES {
+		var version uint16
+		plain, method, version, err = aesZipReader(f, raw, []byte(password))
+		checkCRC = version == 1 // AE-2 leaves the CRC-32 out
+	} else {
+		plain, err = zipCryptoReader(f, raw, []byte(password))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name, err)
+	}
+
+	var content io.ReadCloser
+	switch method {
+	case zip.Store:
+		content = io.NopCloser(plain)
+	case zip.Deflate:
+		content = flate.NewReader(plain)
+	default:
+		return nil, fmt.Errorf("%s: unsupported compression method %d", f.Name, method)
+	}
+	entry := &zipEntryReader{ReadCloser: content, data: plain, want: f.CRC32, name: f.Name}
+	if checkCRC {
+		entry.hash = crc32.NewIEEE()
+	}
+	return entry, nil
+}
+
+// zipEntryReader fails the read that reaches the end of a decrypted zip
+// entry when the content does not match its CRC-32. The rest of the data
+// is read first, since deflate stops short of the AES authentication code.
+type zipEntryReader struct {
+	io.ReadCloser
+	data io.Reader
+	hash hash.Hash32 // nil when the entry has no CRC-32
+	want uint32
+	name string
+}
+
+func (r *zipEntryReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	if _, err := io.Copy(io.Discard, r.data); err != nil {
+		return n, fmt.Errorf("%s: %w", r.name, err)
+	}
+	if r.hash != nil && r.hash.Sum32() != r.want {
+		return n, fmt.Errorf("%s: checksum mismatch", r.name)
+	}
+	return n, io.EOF
+}
+
+// zipCrypto is the traditional PKWARE stream cipher.
+type zipCrypto struct{ keys [3]uint32 }
+
+func newZipCrypto(password []byte) *zipCrypto {
+	z := &zipCrypto{keys: [3]uint32{0x12345678, 0x23456789, 0x34567890}}
+	for _, b := range password {
+		z.update(b)
+	}
+	return z
+}
+
+func crc32Byte(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ crc>>8
+}
+
+func (z *zipCrypto) update(b byte) {
+	z.keys[0] = crc32Byte(z.keys[0], b)
+	z.keys[1] = (z.keys[1]+z.keys[0]&0xff)*134775813 + 1
+	z.keys[2] = crc32Byte(z.keys[2], byte(z.keys[1]>>24))
+}
+
+func (z *zipCrypto) stream() byte {
+	temp := z.keys[2] | 2
+	return byte(temp * (temp ^ 1) >> 8)
+}
+
+func (z *zipCrypto) decrypt(p []byte) {
+	for i, c := range p {
+		p[i] = c ^ z.stream()
+		z.update(p[i])
+	}
+}
+
+func (z *zipCrypto) encrypt(p []byte) {
+	for i, c := range p {
+		p[i] = c ^ z.stream()
+		z.update(c)
+	}
+}
+
+// zipCryptoReader checks password against the 12 byte header in front of
+// the data, whose last byte repeats the top of the CRC-32, or of the
+// modification time when the sizes follow the data.
+func zipCryptoReader(f *zip.File, raw io.Reader, password []byte) (io.Reader, error) {
+	z := newZipCrypto(password)
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+	z.decrypt(header)
+	check := byte(f.CRC32 >> 24)
+	if f.Flags&zipDescriptor != 0 {
+		check = byte(f.ModifiedTime >> 8)
+	}
+	if header[11] != check {
+		return nil, errArchivePassword
+	}
+	return &decryptReader{r: raw, decrypt: z.decrypt}, nil
+}
+
+type decryptReader struct {
+	r       io.Reader
+	decrypt func([]byte)
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.decrypt(p[:n])
+	return n, err
+}
+
+// aesZipReader decrypts a WinZip AES entry: a salt and password verifier,
+// the data in AES-CTR and an HMAC-SHA1 of it, keyed by PBKDF2 of the
+// password. It returns the compression method of the decrypted data and
+// the AE version.
+func aesZipReader(f *zip.File, raw io.Reader, password []byte) (io.Reader, uint16, uint16, error) {
+	var version, method uint16
+	var strength byte
+	for extra := f.Extra; len(extra) >= 4; {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if field := extra[4 : 4+size]; id == zipExtraAES && size >= 7 {
+			version, strength, method = binary.LittleEndian.Uint16(field), field[4], binary.LittleEndian.Uint16(field[5:])
+		}
+		extra = extra[4+size:]
+	}
+	if strength < 1 || strength > 3 {
+		return nil, 0, 0, errors.New("missing or invalid AES extra field")
+	}
+
+	saltLen, keyLen := 4+4*int(strength), 8+8*int(strength)
+	salt := make([]byte, saltLen+2)
+	if _, err := io.ReadFull(raw, salt); err != nil {
+		return nil, 0, 0, err
+	}
+	keys := pbkdf2.Key(password, salt[:saltLen], 1000, 2*keyLen+2, sha1.New)
+	if !bytes.Equal(keys[2*keyLen:], salt[saltLen:]) {
+		return nil, 0, 0, errArchivePassword
+	}
+	block, err := aes.NewCipher(keys[:keyLen])
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	size := int64(f.CompressedSize64) - int64(len(salt)) - zipAuthCodeLen
+	if size < 0 {
+		return nil, 0, 0, io.ErrUnexpectedEOF
+	}
+	return &aesZipData{
+		data: io.LimitReader(raw, size),
+		raw:  raw,
+		mac:  hmac.New(sha1.New, keys[keyLen:2*keyLen]),
+		ctr:  newWinZipCTR(block),
+	}, method, version, nil
+}
+
+// aesZipData decrypts the data of a WinZip AES entry and fails the read
+// that reaches its end when the authentication code does not match.
+type aesZipData struct {
+	data, raw io.Reader
+	mac       hash.Hash
+	ctr       cipher.Stream
+	checked   bool
+}
+
+func (r *aesZipData) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	r.mac.Write(p[:n])
+	r.ctr.XORKeyStream(p[:n], p[:n])
+	if err == io.EOF && !r.checked {
+		r.checked = true
+		code := make([]byte, zipAuthCodeLen)
+		if _, err := io.ReadFull(r.raw, code); err != nil {
+			return n, err
+		}
+		if !hmac.Equal(code, r.mac.Sum(nil)[:zipAuthCodeLen]) {
+			return n, errors.New("authentication failed")
+		}
+	}
+	return n, err
+}
+
+// winZipCTR is AES in counter mode with the little-endian counter, starting
+// at 1, that WinZip uses.
+type winZipCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	key     [aes.BlockSize]byte
+	used    int
+}
+
+func newWinZipCTR(block cipher.Block) *winZipCTR {
+	return &winZipCTR{block: block, used: aes.BlockSize}
+}
+
+func (c *winZipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			for j := range c.counter {
+				if c.counter[j]++; c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.key[:], c.counter[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.key[c.used]
+		c.used++
+	}
+}
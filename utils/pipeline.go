@@ -0,0 +1,467 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Steps a pipeline can run once a download completes.
+const (
+	StepVerify  = "verify"  // check the checksum, or the size without one
+	StepExtract = "extract" // unpack an archive into a folder next to it
+	StepEncrypt = "encrypt" // encrypt with Encryptor into a .crypted file
+	StepMove    = "move"    // move into a category folder of the download directory
+	StepCommand = "command" // run a program
+	StepUpload  = "upload"  // copy to an rclone remote
+)
+
+var (
+	rclonePath = "rclone"
+	// pipelineRetryDelay is the pause before a failed step is tried again.
+	pipelineRetryDelay = 5 * time.Second
+	// maxStepLog is the number of log lines kept per step.
+	maxStepLog = 100
+)
+
+var errCommandsDisabled = errors.New("command steps are disabled")
+
+// rcloneRemoteName matches the names of remotes in the rclone config. It
+// leaves out paths on the server, backends created on the fly such as
+// :local: and connection strings overriding the config, which would let any
+// client write anywhere on the server.
+var rcloneRemoteName = regexp.MustCompile(`^\w[\w.+@ -]*$`)
+
+// PipelineStep is one step of a pipeline. Each step works on the output of
+// the previous one, starting with the downloaded file.
+type PipelineStep struct {
+	Type      string   `json:"type"`
+	Checksum  string   `json:"checksum,omitempty"`   // verify: <algorithm>:<hex>, the checksum of the task by default
+	Password  string   `json:"password,omitempty"`   // extract: password of encrypted archives
+	Delete    bool     `json:"delete,omitempty"`     // extract, encrypt: remove the input once done
+	Category  string   `json:"category,omitempty"`   // move: folder under the download directory
+	Command   []string `json:"command,omitempty"`    // command: program and arguments, {file} is replaced by the current file
+	Remote    string   `json:"remote,omitempty"`     // upload: rclone destination such as remote:path
+	Timeout   string   `json:"timeout,omitempty"`    // command, upload: such as 10m, no limit by default
+	Retries   int      `json:"retries,omitempty"`    // attempts after the first one
+	OnFailure string   `json:"on_failure,omitempty"` // stop (the default) skips the remaining steps, continue runs them
+}
+
+// Pipeline is the list of steps run after a task completes. A task with an
+// empty Pipeline runs no steps, one without a Pipeline the default steps of
+// its TaskManager.
+type Pipeline struct {
+	Steps []*PipelineStep `json:"steps"`
+}
+
+// PipelineSettings are the default pipeline of a TaskManager and the key of
+// its encrypt steps.
+type PipelineSettings struct {
+	Steps []*PipelineStep
+	Key   []byte
+}
+
+// PipelineStatus reports the progress of a pipeline. File is the output of
+// the last step that completed.
+type PipelineStatus struct {
+	State string        `json:"state"` // running, completed or failed
+	File  string        `json:"file"`
+	Steps []*StepStatus `json:"steps"`
+}
+
+type StepStatus struct {
+	Type     string     `json:"type"`
+	State    string     `json:"state"` // pending, running, completed, failed or skipped
+	Attempts int        `json:"attempts"`
+	Error    string     `json:"error,omitempty"`
+	Log      []string   `json:"log,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// ParsePipeline reads a JSON list of steps. Command steps are refused unless
+// allowCommands is set, since they run any program on the server.
+func ParsePipeline(data []byte, allowCommands bool) (*Pipeline, error) {
+	pipeline := &Pipeline{}
+	if err := json.Unmarshal(data, &pipeline.Steps); err != nil {
+		return nil, fmt.Errorf("pipeline must be a JSON list of steps: %w", err)
+	}
+	for i, step := range pipeline.Steps {
+		if step == nil {
+			return nil, fmt.Errorf("pipeline step %d is empty", i+1)
+		}
+		if err := step.validate(allowCommands); err != nil {
+			return nil, fmt.Errorf("pipeline step %d: %w", i+1, err)
+		}
+	}
+	return pipeline, nil
+}
+
+func (s *PipelineStep) validate(allowCommands bool) error {
+	switch s.Type {
+	case StepVerify:
+		if s.Checksum != "" {
+			if _, err := ParseChecksum(s.Checksum); err != nil {
+				return err
+			}
+		}
+	case StepExtract, StepEncrypt:
+	case StepMove:
+		if s.Category == "" || !filepath.IsLocal(s.Category) {
+			return fmt.Errorf("category must be a folder inside the download directory")
+		}
+	case StepCommand:
+		if !allowCommands {
+			return errCommandsDisabled
+		}
+		if len(s.Command) == 0 || s.Command[0] == "" {
+			return fmt.Errorf("command is required")
+		}
+	case StepUpload:
+		if s.Remote == "" {
+			return fmt.Errorf("remote is required")
+		}
+		if name, _, ok := strings.Cut(s.Remote, ":"); !ok || !rcloneRemoteName.MatchString(name) {
+			return fmt.Errorf("remote must be a remote of the rclone config such as gdrive:backup")
+		}
+	default:
+		return fmt.Errorf("unknown step type %q", s.Type)
+	}
+	if s.Timeout != "" {
+		if timeout, err := time.ParseDuration(s.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("timeout must be a positive duration such as 10m")
+		}
+	}
+	if s.Retries < 0 {
+		return fmt.Errorf("retries can not be negative")
+	}
+	if s.OnFailure != "" && s.OnFailure != "stop" && s.OnFailure != "continue" {
+		return fmt.Errorf("on_failure must be stop or continue")
+	}
+	return nil
+}
+
+func (m *TaskManager) SetPipeline(settings *PipelineSettings) {
+	m.mu.Lock()
+	m.pipeline = settings
+	m.mu.Unlock()
+}
+
+// runPipeline runs the steps of a completed task: its own pipeline or the
+// default one, after the extraction asked for with extract=true.
+func (m *TaskManager) runPipeline(d *DownloadFile) {
+	m.mu.RLock()
+	settings := m.pipeline
+	m.mu.RUnlock()
+	var key []byte
+	var steps []*PipelineStep
+	if settings != nil {
+		key, steps = settings.Key, settings.Steps
+	}
+
+	d.mu.Lock()
+	if d.Pipeline != nil {
+		steps = d.Pipeline.Steps
+	}
+	if d.Extract != nil {
+		steps = append([]*PipelineStep{{Type: StepExtract, Password: d.Extract.Password, Delete: d.Extract.Delete}}, steps...)
+	}
+	if len(steps) == 0 {
+		d.mu.Unlock()
+		return
+	}
+	file := d.Fname
+	status := &PipelineStatus{State: "running", File: file}
+	for _, step := range steps {
+		status.Steps = append(status.Steps, &StepStatus{Type: step.Type, State: "pending"})
+	}
+	d.pipeline = status
+	d.mu.Unlock()
+
+	failed, stopped := false, false
+	for i, step := range steps {
+		if stopped {
+			d.updateStep(i, func(s *StepStatus) { s.State = "skipped" })
+			continue
+		}
+		output, err := m.runStep(d, i, step, file, key)
+		if err != nil {
+			failed, stopped = true, step.OnFailure != "continue"
+			continue
+		}
+		file = output
+		d.mu.Lock()
+		status.File = file
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	status.State = "completed"
+	if failed {
+		status.State = "failed"
+	}
+	d.mu.Unlock()
+	log.Printf("[*] Pipeline %s: %s", status.State, file)
+}
+
+// runStep runs a step, trying it again as often as it allows, and returns
+// its output.
+func (m *TaskManager) runStep(d *DownloadFile, i int, step *PipelineStep, file string, key []byte) (string, error) {
+	logf := func(format string, args ...interface{}) {
+		d.updateStep(i, func(s *StepStatus) { s.Log = appendLog(s.Log, fmt.Sprintf(format, args...)) })
+	}
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		d.updateStep(i, func(s *StepStatus) {
+			s.State, s.Attempts, s.Started, s.Error = "running", attempt, &started, ""
+		})
+		output, err := m.step(d, step, file, key, logf)
+		finished := time.Now()
+		if err == nil {
+			d.updateStep(i, func(s *StepStatus) { s.State, s.Finished = "completed", &finished })
+			return output, nil
+		}
+		logf("attempt %d failed: %v", attempt, err)
+		if attempt > step.Retries {
+			d.updateStep(i, func(s *StepStatus) { s.State, s.Finished, s.Error = "failed", &finished, err.Error() })
+			log.Printf("Error in the %s step of %s: %v", step.Type, file, err)
+			return "", err
+		}
+		time.Sleep(pipelineRetryDelay)
+	}
+}
+
+func (m *TaskManager) step(d *DownloadFile, step *PipelineStep, file string, key []byte, logf func(string, ...interface{})) (string, error) {
+	switch step.Type {
+	case StepVerify:
+		return file, d.verifyStep(step, file, logf)
+	case StepExtract:
+		job, run := Extractor(file, ExtractOptions{Password: step.Password, Delete: step.Delete})
+		job.Download = d.ID
+		if err := m.RunExtract(job, run); err != nil {
+			return "", err
+		}
+		dir, _ := job.Result()
+		logf("extracted into %s", dir)
+		return filepath.Join(filepath.Dir(file), dir), nil
+	case StepEncrypt:
+		return m.encryptStep(step, file, key, logf)
+	case StepMove:
+		return moveStep(filepath.Join(d.dir, step.Category), file, logf)
+	case StepCommand:
+		args := make([]string, len(step.Command))
+		for i, arg := range step.Command {
+			args[i] = strings.ReplaceAll(arg, "{file}", file)
+		}
+		return file, runLogged(step.Timeout, logf, args[0], args[1:], "TASK_ID="+d.ID, "PIPELINE_FILE="+file)
+	case StepUpload:
+		if err := checkRemote(step.Remote); err != nil {
+			return "", err
+		}
+		remote := step.Remote
+		if info, err := os.Stat(file); err == nil && info.IsDir() {
+			remote = strings.TrimSuffix(remote, "/") + "/" + filepath.Base(file)
+		}
+		return file, runLogged(step.Timeout, logf, rclonePath, []string{"copy", "--", file, remote})
+	}
+	return "", fmt.Errorf("unknown step type %q", step.Type)
+}
+
+// checkRemote makes sure the remote of an upload step is in the rclone
+// config, as listed by rclone listremotes.
+func checkRemote(remote string) error {
+	output, err := exec.Command(rclonePath, "listremotes").Output()
+	if err != nil {
+		return fmt.Errorf("error listing the rclone remotes: %w", err)
+	}
+	name, _, _ := strings.Cut(remote, ":")
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSuffix(strings.TrimSpace(line), ":") == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a remote of the rclone config", name)
+}
+
+// verifyStep compares the file with the checksum of the step or the task.
+// Without either it checks that the file has the size of the download.
+func (d *DownloadFile) verifyStep(step *PipelineStep, file string, logf func(string, ...interface{})) error {
+	d.mu.Lock()
+	checksum, size := d.Checksum, d.Size
+	d.mu.Unlock()
+	if step.Checksum != "" {
+		checksum, _ = ParseChecksum(step.Checksum)
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if checksum == nil {
+		if info.Mode().IsRegular() && size > 0 && info.Size() != size {
+			return fmt.Errorf("expected %d bytes, found %d", size, info.Size())
+		}
+		logf("no checksum, %s is present", filepath.Base(file))
+		return nil
+	}
+	input, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	h := checksum.New()
+	if _, err := io.Copy(h, input); err != nil {
+		return err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest != checksum.Expected {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s:%s", checksum, checksum.Algorithm, digest)
+	}
+	logf("%s matches", checksum)
+	return nil
+}
+
+func (m *TaskManager) encryptStep(step *PipelineStep, file string, key []byte, logf func(string, ...interface{})) (string, error) {
+	if len(key) == 0 {
+		return "", errors.New("no encryption key")
+	}
+	if strings.HasSuffix(file, ".crypted") {
+		logf("already encrypted")
+		return file, nil
+	}
+	if info, err := os.Stat(file); err != nil {
+		return "", err
+	} else if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a file", filepath.Base(file))
+	}
+	job, run := Encryptor(file, &key)
+	job.KeyRef = "default" // the ENCRYPT_KEY key
+	if err := m.RunCrypt(job, run); err != nil {
+		return "", err
+	}
+	logf("encrypted into %s.crypted", filepath.Base(file))
+	if step.Delete {
+		if err := os.Remove(file); err != nil {
+			return "", err
+		}
+	}
+	return file + ".crypted", nil
+}
+
+// moveStep moves file into dir, numbering it when the name is taken.
+func moveStep(dir, file string, logf func(string, ...interface{})) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, filepath.Base(file))
+	if target == file {
+		return file, nil
+	}
+	// reserve the name so that concurrent pipelines do not pick it too
+	if info.IsDir() {
+		if target, err = reserveDir(target); err == nil {
+			err = os.Remove(target)
+		}
+	} else if target, err = resolveConflict(target, ConflictRename); err == nil {
+		defer os.Remove(partName(target))
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(file, target); err != nil {
+		return "", err
+	}
+	logf("moved to %s", target)
+	return target, nil
+}
+
+// runLogged runs a program with the output going to the step log.
+func runLogged(timeout string, logf func(string, ...interface{}), name string, args []string, env ...string) error {
+	ctx := context.Background()
+	if timeout != "" {
+		limit, _ := time.ParseDuration(timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), env...)
+	output := &lineWriter{logf: logf}
+	cmd.Stdout, cmd.Stderr = output, output
+	err := cmd.Run()
+	output.flush()
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
+
+// lineWriter passes the lines written to it to logf.
+type lineWriter struct {
+	logf    func(string, ...interface{})
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.logf("%s", strings.TrimRight(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+}
+
+func (w *lineWriter) flush() {
+	if len(w.partial) > 0 {
+		w.logf("%s", w.partial)
+		w.partial = nil
+	}
+}
+
+func appendLog(lines []string, line string) []string {
+	lines = append(lines, line)
+	if len(lines) > maxStepLog {
+		lines = lines[len(lines)-maxStepLog:]
+	}
+	return lines
+}
+
+func (d *DownloadFile) updateStep(i int, update func(*StepStatus)) {
+	d.mu.Lock()
+	update(d.pipeline.Steps[i])
+	d.mu.Unlock()
+}
+
+// pipelineStatus copies the pipeline status for /status. The caller holds
+// d.mu.
+func (d *DownloadFile) pipelineStatus() *PipelineStatus {
+	if d.pipeline == nil {
+		return nil
+	}
+	status := *d.pipeline
+	status.Steps = make([]*StepStatus, len(d.pipeline.Steps))
+	for i, step := range d.pipeline.Steps {
+		copied := *step
+		copied.Log = append([]string(nil), step.Log...)
+		status.Steps[i] = &copied
+	}
+	return &status
+}
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePipeline(t *testing.T) {
+	pipeline, err := ParsePipeline([]byte(`[{"type":"verify","checksum":"sha256:`+sha256Hex+`"},{"type":"move","category":"movies/new"},{"type":"upload","remote":"gdrive:backup","timeout":"10m","retries":2,"on_failure":"continue"}]`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pipeline.Steps) != 3 || pipeline.Steps[1].Category != "movies/new" || pipeline.Steps[2].Retries != 2 {
+		t.Fatalf("unexpected pipeline %+v", pipeline.Steps)
+	}
+	if _, err := ParsePipeline([]byte(`[{"type":"command","command":["true"]}]`), false); !errors.Is(err, errCommandsDisabled) {
+		t.Fatalf("expected command steps to be refused, got %v", err)
+	}
+	if _, err := ParsePipeline([]byte(`[{"type":"command","command":["true"]}]`), true); err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []string{
+		`{"type":"verify"}`,
+		`[{"type":"compress"}]`,
+		`[{"type":"move","category":"../outside"}]`,
+		`[{"type":"upload"}]`,
+		`[{"type":"upload","remote":"--password-command=sh -c id"}]`,
+		`[{"type":"upload","remote":"/tmp/x"}]`,
+		`[{"type":"upload","remote":":local:/x"}]`,
+		`[{"type":"upload","remote":"./x"}]`,
+		`[{"type":"upload","remote":"/etc/cron.d:x"}]`,
+		`[{"type":"upload","remote":"gdrive,type=local:/x"}]`,
+		`[{"type":"verify","checksum":"sha256:zz"}]`,
+		`[{"type":"verify","retries":-1}]`,
+		`[{"type":"verify","on_failure":"retry"}]`,
+		`[{"type":"command","command":["true"],"timeout":"soon"}]`,
+	} {
+		if _, err := ParsePipeline([]byte(invalid), true); err == nil {
+			t.Errorf("expected %s to be refused", invalid)
+		}
+	}
+}
+
+// waitPipeline waits for the pipeline of d to finish and returns its status.
+func waitPipeline(t *testing.T, d *DownloadFile) *PipelineStatus {
+	t.Helper()
+	waitFor(t, "the pipeline", func() bool {
+		status := d.Status().Pipeline
+		return status != nil && status.State != "running"
+	})
+	return d.Status().Pipeline
+}
+
+func TestPipelineRunsOnCompletion(t *testing.T) {
+	dir := t.TempDir()
+	writeZip(t, filepath.Join(dir, "served.zip"), archiveFiles)
+	content, err := os.ReadFile(filepath.Join(dir, "served.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(content)
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	// rclone is stood in for by a script that records its arguments
+	uploads := filepath.Join(t.TempDir(), "uploads")
+	rclone := filepath.Join(t.TempDir(), "rclone")
+	script := "#!/bin/sh\nif [ \"$1\" = listremotes ]; then echo remote:; exit 0; fi\necho \"$@\" >> " + uploads + "\necho copied\n"
+	if err := os.WriteFile(rclone, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { rclonePath = path }(rclonePath)
+	rclonePath = rclone
+
+	tasks := NewTaskManager(1)
+	target := t.TempDir()
+	download := NewDownloader(server.URL+"/served.zip", target, "release.zip")
+	download.Pipeline, err = ParsePipeline([]byte(`[
+		{"type":"verify","checksum":"sha256:`+hex.EncodeToString(digest[:])+`"},
+		{"type":"extract","delete":true},
+		{"type":"move","category":"archives"},
+		{"type":"command","command":["sh","-c","echo task $TASK_ID; ls \"{file}\""]},
+		{"type":"upload","remote":"remote:backup"}
+	]`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks.Enqueue(download)
+
+	status := waitPipeline(t, download)
+	moved := filepath.Join(target, "archives", "release")
+	if status.State != "completed" || status.File != moved {
+		t.Fatalf("unexpected pipeline %+v", status)
+	}
+	for _, step := range status.Steps {
+		if step.State != "completed" || step.Attempts != 1 || step.Started == nil || step.Finished == nil {
+			t.Fatalf("unexpected %s step %+v", step.Type, step)
+		}
+	}
+	checkExtracted(t, moved, archiveFiles)
+	if _, err := os.Stat(filepath.Join(target, "release.zip")); !os.IsNotExist(err) {
+		t.Fatal("expected the archive to be deleted")
+	}
+	if log := strings.Join(status.Steps[3].Log, "\n"); !strings.Contains(log, "task "+download.ID) || !strings.Contains(log, "readme.txt") {
+		t.Fatalf("expected the command output in the log, got %q", log)
+	}
+	if log := status.Steps[4].Log; len(log) != 1 || log[0] != "copied" {
+		t.Fatalf("expected the rclone output in the log, got %q", log)
+	}
+	if args, _ := os.ReadFile(uploads); string(args) != "copy -- "+moved+" remote:backup/release\n" {
+		t.Fatalf("unexpected rclone arguments %q", args)
+	}
+	if err := checkRemote("other:backup"); err == nil {
+		t.Fatal("expected a remote missing from the rclone config to be refused")
+	}
+}
+
+func TestPipelineFailureHandling(t *testing.T) {
+	defer func(delay time.Duration) { pipelineRetryDelay = delay }(pipelineRetryDelay)
+	pipelineRetryDelay = time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("payload"))
+	}))
+	defer server.Close()
+
+	tasks := NewTaskManager(2)
+	target := t.TempDir()
+	wrong := `{"type":"verify","checksum":"sha256:` + sha256Hex + `","retries":1`
+	stop, _ := ParsePipeline([]byte(`[`+wrong+`},{"type":"move","category":"done"}]`), false)
+	carryOn, _ := ParsePipeline([]byte(`[`+wrong+`,"on_failure":"continue"},{"type":"move","category":"done"}]`), false)
+
+	stopped := NewDownloader(server.URL+"/a", target, "stopped.bin")
+	stopped.Pipeline = stop
+	continued := NewDownloader(server.URL+"/b", target, "continued.bin")
+	continued.Pipeline = carryOn
+	tasks.Enqueue(stopped)
+	tasks.Enqueue(continued)
+
+	status := waitPipeline(t, stopped)
+	if status.State != "failed" || status.Steps[0].State != "failed" || status.Steps[0].Attempts != 2 || status.Steps[1].State != "skipped" {
+		t.Fatalf("unexpected pipeline %+v %+v", status.Steps[0], status.Steps[1])
+	}
+	if !strings.Contains(status.Steps[0].Error, "checksum mismatch") || len(status.Steps[0].Log) != 2 {
+		t.Fatalf("unexpected error %q and log %q", status.Steps[0].Error, status.Steps[0].Log)
+	}
+	if _, err := os.Stat(filepath.Join(target, "stopped.bin")); err != nil {
+		t.Fatal("expected the file to stay in place:", err)
+	}
+
+	status = waitPipeline(t, continued)
+	if status.State != "failed" || status.Steps[1].State != "completed" || status.File != filepath.Join(target, "done", "continued.bin") {
+		t.Fatalf("unexpected pipeline %+v %+v", status, status.Steps[1])
+	}
+}
+
+func TestDefaultPipelineEncrypts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret payload"))
+	}))
+	defer server.Close()
+
+	tasks := NewTaskManager(1)
+	tasks.SetPipeline(&PipelineSettings{
+		Steps: []*PipelineStep{{Type: StepVerify}, {Type: StepEncrypt, Delete: true}},
+		Key:   []byte("0123456789abcdef0123456789abcdef"),
+	})
+	target := t.TempDir()
+	download := NewDownloader(server.URL+"/secret", target, "secret.txt")
+	tasks.Enqueue(download)
+
+	status := waitPipeline(t, download)
+	encrypted := filepath.Join(target, "secret.txt.crypted")
+	if status.State != "completed" || status.File != encrypted {
+		t.Fatalf("unexpected pipeline %+v %+v", status, status.Steps[1])
+	}
+	if history := tasks.CryptHistory(); len(history) != 1 || history[0].Fname != "secret.txt" || history[0].State() != "completed" {
+		t.Fatalf("expected the encryption in the crypt history, got %d jobs", len(history))
+	}
+	if _, err := os.Stat(encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "secret.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected the plain file to be deleted")
+	}
+
+	// an empty pipeline of its own opts a task out of the default one
+	plain := NewDownloader(server.URL+"/plain", target, "plain.txt")
+	plain.Pipeline = &Pipeline{}
+	tasks.Enqueue(plain)
+	waitFor(t, "the download", func() bool { return plain.State() == "completed" })
+	time.Sleep(50 * time.Millisecond)
+	if plain.Status().Pipeline != nil {
+		t.Fatal("expected no pipeline")
+	}
+}
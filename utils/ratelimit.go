@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ParseRate reads a transfer rate in bytes per second such as "2MB", "500K"
+// or "1048576". An empty string, "0" or "unlimited" means no limit.
+func ParseRate(value string) (int64, error) {
+	value = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "/S")
+	if value == "" || value == "UNLIMITED" {
+		return 0, nil
+	}
+	value = strings.TrimSuffix(value, "B")
+	multiplier := float64(1)
+	for suffix, size := range map[string]float64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = size
+			value = strings.TrimSuffix(value, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected something like 2MB or 500K", value)
+	}
+	return int64(n * multiplier), nil
+}
+
+// newLimiter returns a token bucket for limit bytes per second, 0 meaning unlimited.
+func newLimiter(limit int64) *rate.Limiter {
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	setLimit(limiter, limit)
+	return limiter
+}
+
+func setLimit(limiter *rate.Limiter, limit int64) {
+	if limit <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	// allow a second worth of data in one go, but never less than a read buffer
+	burst := int(limit)
+	if burst < copyBufferSize {
+		burst = copyBufferSize
+	}
+	limiter.SetBurst(burst)
+	limiter.SetLimit(rate.Limit(limit))
+}
+
+// waitN blocks until n bytes are allowed through limiter.
+func waitN(limiter *rate.Limiter, n int) {
+	for n > 0 {
+		chunk := n
+		if limiter.Limit() != rate.Inf && chunk > limiter.Burst() {
+			chunk = limiter.Burst()
+		}
+		limiter.WaitN(context.Background(), chunk)
+		n -= chunk
+	}
+}
+
+// RateRule limits the global bandwidth between two times of the day. The
+// window may wrap past midnight.
+type RateRule struct {
+	Start time.Duration // offset from midnight
+	End   time.Duration
+	Limit int64
+}
+
+func (r RateRule) String() string {
+	clock := func(offset time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(offset.Hours()), int(offset.Minutes())%60)
+	}
+	return fmt.Sprintf("%s-%s=%d", clock(r.Start), clock(r.End), r.Limit)
+}
+
+func (r RateRule) contains(now time.Time) bool {
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if r.Start <= r.End {
+		return offset >= r.Start && offset < r.End
+	}
+	return offset >= r.Start || offset < r.End
+}
+
+// ParseSchedule reads rules like "09:00-18:00=2MB,18:00-09:00=unlimited".
+// "none" clears the schedule.
+func ParseSchedule(value string) ([]RateRule, error) {
+	var rules []RateRule
+	if strings.TrimSpace(value) == "none" {
+		return nil, nil
+	}
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+		window, limit, ok := strings.Cut(strings.TrimSpace(field), "=")
+		start, end, ok2 := strings.Cut(window, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid schedule rule %q, expected HH:MM-HH:MM=rate", field)
+		}
+		var rule RateRule
+		var err error
+		if rule.Start, err = parseClock(start); err != nil {
+			return nil, err
+		}
+		if rule.End, err = parseClock(end); err != nil {
+			return nil, err
+		}
+		if rule.Limit, err = ParseRate(limit); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseClock(value string) (time.Duration, error) {
+	clock, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+// Bandwidth is the global limit shared by every running download. Readers
+// take tokens from the same bucket one buffer at a time and waiters are
+// served in order, so every connection gets a fair share of it.
+type Bandwidth struct {
+	mu        sync.Mutex
+	limiter   *rate.Limiter
+	limit     int64
+	schedule  []RateRule
+	effective int64
+}
+
+func NewBandwidth() *Bandwidth {
+	return &Bandwidth{limiter: newLimiter(0)}
+}
+
+// Set changes the default global limit and the time-of-day schedule that overrides it.
+func (b *Bandwidth) Set(limit int64, schedule []RateRule) {
+	b.mu.Lock()
+	b.limit = limit
+	b.schedule = schedule
+	b.mu.Unlock()
+	b.Current()
+}
+
+// Limits returns the default global limit and the schedule.
+func (b *Bandwidth) Limits() (int64, []RateRule) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit, b.schedule
+}
+
+// Current returns the global limit in effect right now, applying the schedule.
+func (b *Bandwidth) Current() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	limit := b.limit
+	now := time.Now()
+	for _, rule := range b.schedule {
+		if rule.contains(now) {
+			limit = rule.Limit
+			break
+		}
+	}
+	if limit != b.effective {
+		b.effective = limit
+		setLimit(b.limiter, limit)
+	}
+	return limit
+}
+
+func (b *Bandwidth) wait(n int) {
+	b.Current()
+	waitN(b.limiter, n)
+}
+
+// SetRateLimit changes the bandwidth limit of the task, also while it runs.
+func (d *DownloadFile) SetRateLimit(limit int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.RateLimit = limit
+	if d.limiter == nil {
+		d.limiter = newLimiter(limit)
+	} else {
+		setLimit(d.limiter, limit)
+	}
+}
+
+// throttle blocks until n more bytes may be read under the task and global limits.
+func (d *DownloadFile) throttle(n int) {
+	d.mu.Lock()
+	if d.limiter == nil {
+		d.limiter = newLimiter(d.RateLimit)
+	}
+	limiter, bandwidth := d.limiter, d.bandwidth
+	d.mu.Unlock()
+
+	waitN(limiter, n)
+	if bandwidth != nil {
+		bandwidth.wait(n)
+	}
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for value, want := range map[string]int64{
+		"":          0,
+		"unlimited": 0,
+		"1024":      1024,
+		"500K":      500 << 10,
+		"2MB":       2 << 20,
+		"1.5m/s":    3 << 19,
+	} {
+		got, err := ParseRate(value)
+		if err != nil || got != want {
+			t.Fatalf("ParseRate(%q) = %d, %v; want %d", value, got, err, want)
+		}
+	}
+	if _, err := ParseRate("fast"); err == nil {
+		t.Fatal("expected an error for an invalid rate")
+	}
+}
+
+func TestScheduleWrapsMidnight(t *testing.T) {
+	rules, err := ParseSchedule("09:00-18:00=2MB, 18:00-09:00=unlimited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(clock string) time.Time {
+		parsed, _ := time.Parse("15:04", clock)
+		return parsed
+	}
+	if !rules[0].contains(at("12:30")) || rules[0].contains(at("18:00")) {
+		t.Fatal("work hours rule matched the wrong times")
+	}
+	if !rules[1].contains(at("23:00")) || !rules[1].contains(at("03:00")) || rules[1].contains(at("10:00")) {
+		t.Fatal("night rule matched the wrong times")
+	}
+	if rules[0].String() != "09:00-18:00=2097152" {
+		t.Fatalf("unexpected rule string %s", rules[0])
+	}
+}
+
+func TestRateLimitedDownload(t *testing.T) {
+	server := slowServer(64 * 1024)
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	download.SetRateLimit(32 * 1024)
+	started := time.Now()
+	download.Resume()
+
+	if download.State() != "completed" {
+		t.Fatalf("expected completed, got %s (%v)", download.State(), download.Error)
+	}
+	// the first 32KB fit in the burst, the rest takes about a second
+	if elapsed := time.Since(started); elapsed < 700*time.Millisecond {
+		t.Fatalf("download finished in %s, faster than the rate limit allows", elapsed)
+	}
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRequestOptionsAreSent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := r.Cookie("session")
+		if r.Header.Get("Referer") != "http://example.com/" || r.UserAgent() != "Mirror/1.0" || err != nil || session.Value != "abc" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("secret file"))
+	}))
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.txt")
+	download.Request = &RequestOptions{
+		Header:    http.Header{"Referer": {"http://example.com/"}},
+		Cookies:   ParseCookieString("session=abc; theme=dark"),
+		UserAgent: "Mirror/1.0",
+	}
+	download.Resume()
+	if download.State() != "completed" {
+		t.Fatalf("expected the download to complete, got %+v", download.Status())
+	}
+}
+
+func TestParseCookiesFile(t *testing.T) {
+	cookies, err := ParseCookiesFile(strings.NewReader(strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		".example.com\tTRUE\t/\tTRUE\t0\tsid\t123",
+		"#HttpOnly_files.example.com\tFALSE\t/dl\tFALSE\t2000000000\ttoken\txyz",
+		"",
+	}, "\n")))
+	if err != nil || len(cookies) != 2 {
+		t.Fatalf("expected 2 cookies, got %v %v", cookies, err)
+	}
+	if c := cookies[0]; c.Domain != "example.com" || c.HostOnly || !c.Secure || !c.Expires.IsZero() {
+		t.Fatalf("unexpected domain cookie %+v", c)
+	}
+	if c := cookies[1]; c.Domain != "files.example.com" || !c.HostOnly || c.Path != "/dl" || c.Expires.Unix() != 2000000000 {
+		t.Fatalf("unexpected host cookie %+v", c)
+	}
+	if _, err := ParseCookiesFile(strings.NewReader("example.com\tTRUE\t/")); err == nil {
+		t.Fatal("expected an error for a short line")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "bob" || pass != "hunter2" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="files"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("private"))
+	}))
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.txt")
+	download.Request = &RequestOptions{Username: "bob", Password: "hunter2"}
+	download.Resume()
+	if got, _ := os.ReadFile(download.Fname); string(got) != "private" {
+		t.Fatalf("expected the protected file, got %q (%+v)", got, download.Status())
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	const realm, nonce = "files", "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Digest ")
+		params := parseChallenge(auth)
+		ha1 := md5hex("bob:" + realm + ":hunter2")
+		ha2 := md5hex(r.Method + ":" + params["uri"])
+		want := md5hex(strings.Join([]string{ha1, nonce, params["nc"], params["cnonce"], "auth", ha2}, ":"))
+		if !ok || params["response"] != want || params["uri"] != r.URL.RequestURI() {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm=%q, qop="auth,auth-int", nonce=%q, opaque="5ccc"`, realm, nonce))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("private"))
+	}))
+	defer server.Close()
+
+	download := NewDownloader(server.URL+"/file?id=1", t.TempDir(), "file.txt")
+	download.Request = &RequestOptions{Username: "bob", Password: "hunter2"}
+	download.Resume()
+	if got, _ := os.ReadFile(download.Fname); string(got) != "private" {
+		t.Fatalf("expected the protected file, got %q (%+v)", got, download.Status())
+	}
+}
+
+func TestRequestStatusRedactsSecrets(t *testing.T) {
+	options := &RequestOptions{
+		Header:   http.Header{"Referer": {"http://example.com/"}, "Authorization": {"Bearer abc"}, "X-Api-Key": {"k"}},
+		Cookies:  ParseCookieString("session=abc"),
+		Username: "bob",
+		Password: "hunter2",
+	}
+	status := options.Status()
+	if status.Header["Referer"] != "http://example.com/" || status.Header["Authorization"] != redacted || status.Header["X-Api-Key"] != redacted {
+		t.Fatalf("unexpected headers %v", status.Header)
+	}
+	if status.Password != redacted || len(status.Cookies) != 1 || status.Cookies[0] != "session" {
+		t.Fatalf("expected secrets to be redacted, got %+v", status)
+	}
+}
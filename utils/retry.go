@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// StatusError is returned when the origin answers with an unexpected HTTP status.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string { return "unexpected status " + e.Status }
+
+// RetryPolicy decides whether and when a failed download is tried again.
+type RetryPolicy struct {
+	MaxAttempts int           `json:"max_attempts"`
+	BaseDelay   time.Duration `json:"base_delay"`
+	MaxDelay    time.Duration `json:"max_delay"`
+	Jitter      float64       `json:"jitter"` // fraction of the delay added or removed at random
+	RetryStatus []int         `json:"retry_status"`
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    5 * time.Minute,
+	Jitter:      0.2,
+	RetryStatus: []int{408, 425, 429, 500, 502, 503, 504},
+}
+
+// ParseRetryPolicy returns a copy of base with the settings found by get
+// applied: retry_attempts, retry_delay, retry_max_delay and retry_status (a
+// comma separated list of HTTP status codes). It returns nil when none of
+// them are set.
+func ParseRetryPolicy(base RetryPolicy, get func(string) string) (*RetryPolicy, error) {
+	if get("retry_attempts") == "" && get("retry_delay") == "" && get("retry_max_delay") == "" && get("retry_status") == "" {
+		return nil, nil
+	}
+	policy := base
+	if value := get("retry_attempts"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("retry_attempts must be a positive number")
+		}
+		policy.MaxAttempts = n
+	}
+	for name, target := range map[string]*time.Duration{"retry_delay": &policy.BaseDelay, "retry_max_delay": &policy.MaxDelay} {
+		if value := get(name); value != "" {
+			delay, err := time.ParseDuration(value)
+			if err != nil || delay <= 0 {
+				return nil, fmt.Errorf("%s must be a positive duration such as 5s", name)
+			}
+			*target = delay
+		}
+	}
+	if value := get("retry_status"); value != "" {
+		policy.RetryStatus = nil
+		for _, field := range strings.Split(value, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return nil, fmt.Errorf("retry_status must be a list of HTTP status codes")
+			}
+			policy.RetryStatus = append(policy.RetryStatus, code)
+		}
+	}
+	return &policy, nil
+}
+
+// Backoff returns the delay before the given retry attempt, doubling from
+// BaseDelay up to MaxDelay with random jitter.
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	return time.Duration(delay)
+}
+
+// Retryable reports whether err looks transient: a network failure or one
+// of the retryable HTTP statuses.
+func (p *RetryPolicy) Retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		for _, code := range p.RetryStatus {
+			if code == statusErr.Code {
+				return true
+			}
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, ErrContentChanged) ||
+		errors.Is(err, ErrSlowMirror) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func (m *TaskManager) SetRetryPolicy(policy RetryPolicy) {
+	m.mu.Lock()
+	m.retry = policy
+	m.mu.Unlock()
+}
+
+func (m *TaskManager) RetryPolicy() RetryPolicy {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.retry
+}
+
+// scheduleRetry queues a failed task again after its backoff delay when the
+// failure is transient and it has attempts left.
+func (m *TaskManager) scheduleRetry(d *DownloadFile) {
+	policy := m.RetryPolicy()
+
+	d.mu.Lock()
+	if d.Retry != nil {
+		policy = *d.Retry
+	}
+	if d.Error == nil || d.paused || d.canceled || d.Completed || d.Attempts >= policy.MaxAttempts || !policy.Retryable(d.Error) {
+		d.mu.Unlock()
+		return
+	}
+	delay := policy.Backoff(d.Attempts)
+	d.NextRetry = time.Now().Add(delay)
+	log.Printf("[*] Retrying %s in %s (attempt %d of %d)", redactURL(d.Url), delay.Round(time.Millisecond), d.Attempts+1, policy.MaxAttempts)
+	d.mu.Unlock()
+
+	time.AfterFunc(delay, func() {
+		if current, ok := m.Get(d.ID); !ok || current != d || d.State() != "retrying" {
+			return
+		}
+		m.Enqueue(d)
+	})
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.5}
+	for attempt, base := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+		delay := policy.Backoff(attempt)
+		if delay < base/2 || delay > base*3/2 {
+			t.Fatalf("attempt %d: delay %s outside of %s +/- 50%%", attempt, delay, base)
+		}
+	}
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("finally"))
+	}))
+	defer server.Close()
+
+	tasks := NewTaskManager(1)
+	tasks.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second, RetryStatus: []int{503}})
+	download := NewDownloader(server.URL, t.TempDir(), "file.txt")
+	tasks.Enqueue(download)
+
+	waitFor(t, "download to complete", func() bool { return download.State() == "completed" })
+	if status := download.Status(); status.Attempts != 3 || status.NextRetry != nil {
+		t.Fatalf("expected 3 attempts and no pending retry, got %+v", status)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	tasks := NewTaskManager(1)
+	download := NewDownloader(server.URL, t.TempDir(), "file.txt")
+	download.Retry = &RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, RetryStatus: []int{503}}
+	tasks.Enqueue(download)
+
+	waitFor(t, "download to fail", func() bool { return download.State() == "failed" })
+	time.Sleep(20 * time.Millisecond)
+	if status := download.Status(); status.State != "failed" || status.Attempts != 1 {
+		t.Fatalf("expected a single failed attempt for a 404, got %+v", status)
+	}
+}
@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SpeedInterval = time.Second     // length of one throughput sample
+	speedSamples  = 300             // samples kept, five minutes
+	speedWindow   = 5 * time.Second // window of the current speed
+)
+
+// SpeedSample is the number of bytes transferred during one interval ending at Time.
+type SpeedSample struct {
+	Time  time.Time `json:"time"`
+	Bytes int64     `json:"bytes"`
+}
+
+// speedHistory is a ring buffer of throughput samples. Intervals in which
+// nothing arrived are recorded as zero, time spent paused is skipped.
+type speedHistory struct {
+	mu      sync.Mutex
+	samples [speedSamples]SpeedSample
+	next    int // slot of the next sample
+	count   int
+	start   time.Time // start of the open interval, zero while stopped
+	pending int64     // bytes of the open interval
+	total   int64     // bytes transferred while running
+	active  time.Duration
+}
+
+// resume starts sampling when a transfer starts.
+func (h *speedHistory) resume(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.start.IsZero() {
+		h.start = now
+	}
+}
+
+// pause closes the open interval when a transfer stops.
+func (h *speedHistory) pause(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.start.IsZero() {
+		return
+	}
+	h.roll(now)
+	if h.pending > 0 {
+		h.push(SpeedSample{Time: now, Bytes: h.pending})
+	}
+	h.active += now.Sub(h.start)
+	h.start, h.pending = time.Time{}, 0
+}
+
+func (h *speedHistory) add(n int, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.start.IsZero() {
+		h.start = now
+	}
+	h.roll(now)
+	h.pending += int64(n)
+	h.total += int64(n)
+}
+
+// roll records the intervals that ended before now.
+func (h *speedHistory) roll(now time.Time) {
+	if h.start.IsZero() {
+		return
+	}
+	elapsed := int(now.Sub(h.start) / SpeedInterval)
+	if elapsed > speedSamples {
+		// nothing arrived for longer than the buffer covers
+		h.active += time.Duration(elapsed-speedSamples) * SpeedInterval
+		h.start = h.start.Add(time.Duration(elapsed-speedSamples) * SpeedInterval)
+		elapsed = speedSamples
+	}
+	for i := 0; i < elapsed; i++ {
+		h.start = h.start.Add(SpeedInterval)
+		h.active += SpeedInterval
+		h.push(SpeedSample{Time: h.start, Bytes: h.pending})
+		h.pending = 0
+	}
+}
+
+func (h *speedHistory) push(sample SpeedSample) {
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % speedSamples
+	if h.count < speedSamples {
+		h.count++
+	}
+}
+
+// list returns the recorded samples, oldest first.
+func (h *speedHistory) list(now time.Time) []SpeedSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.roll(now)
+	samples := make([]SpeedSample, 0, h.count)
+	for i := h.count; i > 0; i-- {
+		samples = append(samples, h.samples[(h.next-i+speedSamples)%speedSamples])
+	}
+	return samples
+}
+
+// current returns the speed in bytes per second over the last speedWindow.
+func (h *speedHistory) current(now time.Time) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.start.IsZero() {
+		return 0
+	}
+	h.roll(now)
+	bytes, span := h.pending, now.Sub(h.start)
+	for i := 1; i <= h.count && span < speedWindow; i++ {
+		sample := h.samples[(h.next-i+speedSamples)%speedSamples]
+		if now.Sub(sample.Time)+SpeedInterval > speedWindow {
+			break
+		}
+		bytes += sample.Bytes
+		span += SpeedInterval
+	}
+	if span <= 0 {
+		return 0
+	}
+	return float64(bytes) / span.Seconds()
+}
+
+// average returns the speed in bytes per second over the time spent running.
+func (h *speedHistory) average(now time.Time) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	active := h.active
+	if !h.start.IsZero() {
+		active += now.Sub(h.start)
+	}
+	if active <= 0 {
+		return 0
+	}
+	return float64(h.total) / active.Seconds()
+}
+
+// addProgress counts n more downloaded bytes.
+func (d *DownloadFile) addProgress(n int) {
+	atomic.AddInt64(&d.DownloadedSize, int64(n))
+	d.history.add(n, time.Now())
+}
+
+// SpeedHistory returns the throughput samples of the task, oldest first.
+func (d *DownloadFile) SpeedHistory() []SpeedSample {
+	return d.history.list(time.Now())
+}
+
+// eta estimates the time left of a running task from the current speed,
+// falling back to the average one. It returns -1 when unknown.
+func (d *DownloadFile) eta(now time.Time) time.Duration {
+	remaining := d.Size - d.downloaded()
+	if !d.running || d.Size <= 0 || remaining < 0 {
+		return -1
+	}
+	speed := d.history.current(now)
+	if speed <= 0 {
+		speed = d.history.average(now)
+	}
+	if speed <= 0 {
+		return -1
+	}
+	return time.Duration(float64(remaining) / speed * float64(time.Second))
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpeedHistory(t *testing.T) {
+	var h speedHistory
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(offset time.Duration) time.Time { return start.Add(offset) }
+
+	h.resume(start)
+	h.add(1000, at(100*time.Millisecond))
+	h.add(1000, at(900*time.Millisecond))
+	h.add(4000, at(1500*time.Millisecond))
+	// nothing arrives for two seconds
+	h.add(500, at(4200*time.Millisecond))
+
+	samples := h.list(at(4500 * time.Millisecond))
+	want := []int64{2000, 4000, 0, 0}
+	if len(samples) != len(want) {
+		t.Fatalf("expected %d samples, got %+v", len(want), samples)
+	}
+	for i, sample := range samples {
+		if sample.Bytes != want[i] || !sample.Time.Equal(at(time.Duration(i+1)*time.Second)) {
+			t.Fatalf("sample %d: got %+v, want %d bytes", i, sample, want[i])
+		}
+	}
+
+	// the window reaches back past the first sample
+	if got := h.current(at(4500 * time.Millisecond)); got != 6500/4.5 {
+		t.Fatalf("expected a current speed of %v B/s, got %v", 6500/4.5, got)
+	}
+	// samples starting more than five seconds ago are left out
+	if got := h.current(at(6500 * time.Millisecond)); got != 500.0/4.5 {
+		t.Fatalf("expected a current speed of %v B/s, got %v", 500.0/4.5, got)
+	}
+
+	// a pause does not count towards the average
+	h.pause(at(5 * time.Second))
+	h.resume(at(60 * time.Second))
+	h.add(500, at(61*time.Second))
+	if got := h.average(at(61 * time.Second)); got != 7000.0/6 {
+		t.Fatalf("expected 7000 bytes over 6 running seconds, got %v B/s", got)
+	}
+	if got := h.current(at(10 * time.Minute)); got != 0 {
+		t.Fatalf("expected the speed to drop to 0 after a stall, got %v", got)
+	}
+	if got := len(h.list(at(20 * time.Minute))); got != speedSamples {
+		t.Fatalf("expected the ring buffer to hold %d samples, got %d", speedSamples, got)
+	}
+}
+
+func TestStatusReportsProgress(t *testing.T) {
+	server := slowServer(256 * 1024)
+	defer server.Close()
+
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	download.SetRateLimit(128 * 1024)
+	done := make(chan bool)
+	go func() { done <- download.Resume() }()
+
+	waitFor(t, "download to progress", func() bool { return download.Status().DownloadedBytes >= 64*1024 })
+	status := download.Status()
+	if status.Speed <= 0 || status.AverageSpeed <= 0 || status.ETA == nil || *status.ETA <= 0 || status.Percentage <= 0 {
+		t.Fatalf("expected speed, ETA and percentage while downloading, got %+v", status)
+	}
+	download.Pause()
+	<-done
+	if status := download.Status(); status.Speed != 0 || status.ETA != nil || len(download.SpeedHistory()) == 0 {
+		t.Fatalf("expected no speed or ETA while paused and a history, got %+v", status)
+	}
+}
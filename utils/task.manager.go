@@ -0,0 +1,277 @@
+package utils
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrTaskNotFound = errors.New("task not found")
+
+// TaskManager owns every download and crypt task and hands them out by ID.
+// It is safe for use by the HTTP handlers and the download goroutines at the
+// same time. At most slots downloads run at once, the rest wait in queue.
+type TaskManager struct {
+	mu        sync.RWMutex
+	downloads map[string]*DownloadFile
+	crypts    map[string]*CryptFile
+	history   []*CryptFile // finished crypt jobs, oldest first
+	extracts  map[string]*ExtractFile
+	extracted []*ExtractFile // finished extraction jobs, oldest first
+	queue     []*DownloadFile
+	slots     int
+	active    int
+	retry     RetryPolicy
+	bandwidth *Bandwidth
+	proxy     *Proxy
+	ssh       *SSHSettings
+
+	torrentSettings *TorrentSettings
+	torrent         *torrentClient
+	pipeline        *PipelineSettings
+}
+
+func NewTaskManager(slots int) *TaskManager {
+	if slots < 1 {
+		slots = 1
+	}
+	return &TaskManager{
+		downloads: make(map[string]*DownloadFile),
+		crypts:    make(map[string]*CryptFile),
+		extracts:  make(map[string]*ExtractFile),
+		slots:     slots,
+		retry:     DefaultRetryPolicy,
+		bandwidth: NewBandwidth(),
+	}
+}
+
+// Add registers a download task, assigning it an ID if it has none yet.
+func (m *TaskManager) Add(d *DownloadFile) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.add(d)
+}
+
+func (m *TaskManager) add(d *DownloadFile) string {
+	if d.ID == "" {
+		d.ID = uuid.New().String()
+		d.added = time.Now()
+	}
+	d.mu.Lock()
+	d.bandwidth = m.bandwidth
+	d.defaultProxy = m.Proxy
+	d.defaultSSH = m.SSH
+	d.torrents = m.torrentClient
+	d.defaultSeed = m.SeedLimits
+	d.mu.Unlock()
+	m.downloads[d.ID] = d
+	return d.ID
+}
+
+// Bandwidth returns the global limit shared by the downloads of this manager.
+func (m *TaskManager) Bandwidth() *Bandwidth { return m.bandwidth }
+
+func (m *TaskManager) Get(id string) (*DownloadFile, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.downloads[id]
+	return d, ok
+}
+
+// FindByUrl returns a task downloading url, for the endpoints that predate task IDs.
+func (m *TaskManager) FindByUrl(url string) (*DownloadFile, bool) {
+	for _, d := range m.Downloads() {
+		if d.Url == url {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// FindByFname returns an unfinished task writing to fname.
+func (m *TaskManager) FindByFname(fname string) (*DownloadFile, bool) {
+	for _, d := range m.Downloads() {
+		d.mu.Lock()
+		state := d.state()
+		match := d.Fname == fname && state != "completed" && state != "canceled"
+		d.mu.Unlock()
+		if match {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+func (m *TaskManager) Remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.downloads, id)
+	m.unqueue(id)
+}
+
+// Downloads returns the download tasks in the order they were added.
+func (m *TaskManager) Downloads() []*DownloadFile {
+	m.mu.RLock()
+	downloads := make([]*DownloadFile, 0, len(m.downloads))
+	for _, d := range m.downloads {
+		downloads = append(downloads, d)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(downloads, func(i, j int) bool { return downloads[i].added.Before(downloads[j].added) })
+	return downloads
+}
+
+func (m *TaskManager) Pause(id string) (string, error) {
+	d, ok := m.Get(id)
+	if !ok {
+		return "", ErrTaskNotFound
+	}
+	if d.Kind == KindYtDlp {
+		return "", errors.New("yt-dlp downloads can not be paused")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unqueue(id)
+	return d.Pause(), nil
+}
+
+// Resume puts a paused or failed task back in the queue with a fresh set of retry attempts.
+func (m *TaskManager) Resume(id string) error {
+	d, ok := m.Get(id)
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if state := d.State(); state == "downloading" || state == "queued" || state == "completed" {
+		return nil
+	}
+	d.mu.Lock()
+	d.Attempts = 0
+	d.mu.Unlock()
+	m.Enqueue(d)
+	return nil
+}
+
+// Cancel stops a task, or the seeding of a completed torrent, and forgets it.
+func (m *TaskManager) Cancel(id string) error {
+	d, ok := m.Get(id)
+	if !ok {
+		return ErrTaskNotFound
+	}
+	d.Cancel()
+	d.stopSeeding()
+	m.Remove(id)
+	return nil
+}
+
+// AddCrypt registers a crypt task and returns its ID.
+func (m *TaskManager) AddCrypt(c *CryptFile) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c.ID == "" {
+		c.ID = uuid.New().String()
+	}
+	m.crypts[c.ID] = c
+	return c.ID
+}
+
+func (m *TaskManager) Crypts() []*CryptFile {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	crypts := make([]*CryptFile, 0, len(m.crypts))
+	for _, c := range m.crypts {
+		crypts = append(crypts, c)
+	}
+	return crypts
+}
+
+// maxCryptHistory is the number of finished crypt jobs kept.
+const maxCryptHistory = 100
+
+// StartCrypt registers a crypt job and runs it in the background. The job
+// moves to the history once done.
+func (m *TaskManager) StartCrypt(c *CryptFile, run func() error) string {
+	id := m.AddCrypt(c)
+	go func() {
+		if err := m.finishCrypt(c, run); err != nil {
+			log.Printf("Error in crypt task %s: %v", c.Fname, err)
+		}
+	}()
+	return id
+}
+
+// RunCrypt registers a crypt job and runs it, moving it to the history
+// once done.
+func (m *TaskManager) RunCrypt(c *CryptFile, run func() error) error {
+	m.AddCrypt(c)
+	return m.finishCrypt(c, run)
+}
+
+func (m *TaskManager) finishCrypt(c *CryptFile, run func() error) error {
+	err := run()
+	m.mu.Lock()
+	delete(m.crypts, c.ID)
+	m.addHistory(c)
+	m.mu.Unlock()
+	return err
+}
+
+// addHistory appends finished crypt jobs to the history, dropping the oldest
+// beyond maxCryptHistory. The caller holds m.mu.
+func (m *TaskManager) addHistory(jobs ...*CryptFile) {
+	m.history = append(m.history, jobs...)
+	if len(m.history) > maxCryptHistory {
+		m.history = append([]*CryptFile(nil), m.history[len(m.history)-maxCryptHistory:]...)
+	}
+}
+
+// RestoreCryptHistory adds the finished crypt jobs loaded from the journal
+// to the history.
+func (m *TaskManager) RestoreCryptHistory(jobs []*CryptFile) {
+	m.mu.Lock()
+	m.addHistory(jobs...)
+	m.mu.Unlock()
+}
+
+// CryptHistory returns the finished crypt jobs, oldest first.
+func (m *TaskManager) CryptHistory() []*CryptFile {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*CryptFile(nil), m.history...)
+}
+
+// CancelCrypt stops a running crypt job.
+func (m *TaskManager) CancelCrypt(id string) error {
+	m.mu.RLock()
+	c, ok := m.crypts[id]
+	m.mu.RUnlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
+	c.Cancel()
+	return nil
+}
+
+// Sync writes the current tasks to the journal.
+func (m *TaskManager) Sync(store *TaskStore) error {
+	m.mu.RLock()
+	downloads := make(map[string]*DownloadFile, len(m.downloads))
+	for id, d := range m.downloads {
+		downloads[id] = d
+	}
+	crypts := make(map[string]*CryptFile, len(m.crypts)+len(m.history))
+	for id, c := range m.crypts {
+		crypts[id] = c
+	}
+	for _, c := range m.history {
+		crypts[c.ID] = c
+	}
+	m.mu.RUnlock()
+
+	return store.Sync(downloads, crypts)
+}
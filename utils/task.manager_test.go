@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// slowServer serves size bytes in small flushed chunks and honours Range
+// requests, so a download stays in flight long enough to be controlled.
+func slowServer(size int) *httptest.Server {
+	content := bytes.Repeat([]byte("x"), size)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := 0
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ = strconv.Atoi(rng[len("bytes=") : len(rng)-1])
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(size-1)+"/"+strconv.Itoa(size))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(size-start))
+		if start > 0 {
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		for i := start; i < size; i += 512 {
+			end := i + 512
+			if end > size {
+				end = size
+			}
+			if _, err := w.Write(content[i:end]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond)
+		}
+	}))
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTaskManagerSameUrlTwice(t *testing.T) {
+	server := slowServer(4096)
+	defer server.Close()
+
+	tasks := NewTaskManager(2)
+	dir := t.TempDir()
+	first := NewDownloader(server.URL, dir, "first.bin")
+	second := NewDownloader(server.URL, dir, "second.bin")
+	if tasks.Enqueue(first) == tasks.Enqueue(second) {
+		t.Fatal("expected distinct task IDs")
+	}
+
+	// read the status concurrently with the downloads
+	waitFor(t, "downloads to complete", func() bool {
+		for _, d := range tasks.Downloads() {
+			if d.Status().State != "completed" {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestTaskManagerPauseResumeCancel(t *testing.T) {
+	server := slowServer(256 * 1024)
+	defer server.Close()
+
+	tasks := NewTaskManager(1)
+	download := NewDownloader(server.URL, t.TempDir(), "file.bin")
+	id := tasks.Enqueue(download)
+
+	waitFor(t, "download to start", func() bool { return download.Status().DownloadedBytes > 0 })
+	if _, err := tasks.Pause(id); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "download to pause", func() bool { return download.State() == "paused" })
+
+	if err := tasks.Resume(id); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "download to resume", func() bool { return download.State() == "downloading" })
+
+	if err := tasks.Cancel(id); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "download to cancel", func() bool { return download.State() == "canceled" })
+	if _, ok := tasks.Get(id); ok {
+		t.Fatal("cancelled task still tracked")
+	}
+	if err := tasks.Cancel(id); err != ErrTaskNotFound {
+		t.Fatalf("expected ErrTaskNotFound, got %v", err)
+	}
+
+	waitFor(t, "the partial file to be removed", func() bool {
+		_, err := os.Stat(download.partName())
+		return os.IsNotExist(err)
+	})
+	if _, err := os.Stat(download.Fname); !os.IsNotExist(err) {
+		t.Fatal("expected nothing at the final name after cancel")
+	}
+}
+
+func TestTaskQueue(t *testing.T) {
+	server := slowServer(64 * 1024)
+	defer server.Close()
+
+	tasks := NewTaskManager(1)
+	dir := t.TempDir()
+	running := NewDownloader(server.URL, dir, "running.bin")
+	tasks.Enqueue(running)
+	waitFor(t, "first download to start", func() bool { return running.State() == "downloading" })
+
+	low := NewDownloader(server.URL, dir, "low.bin")
+	high := NewDownloader(server.URL, dir, "high.bin")
+	high.Priority = 10
+	other := NewDownloader(server.URL, dir, "other.bin")
+	tasks.Enqueue(low)
+	tasks.Enqueue(high)
+	tasks.Enqueue(other)
+
+	order := func() []string {
+		var ids []string
+		for _, d := range tasks.Queue() {
+			ids = append(ids, d.ID)
+		}
+		return ids
+	}
+	assertOrder := func(want ...*DownloadFile) {
+		t.Helper()
+		got := order()
+		if len(got) != len(want) {
+			t.Fatalf("expected %d queued tasks, got %d", len(want), len(got))
+		}
+		for i, d := range want {
+			if got[i] != d.ID {
+				t.Fatalf("queue position %d: expected %s, got %s", i, d.Fname, got[i])
+			}
+		}
+	}
+
+	assertOrder(high, low, other)
+	if low.State() != "queued" {
+		t.Fatalf("expected queued, got %s", low.State())
+	}
+
+	if err := tasks.MoveToFront(other.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(other, high, low)
+
+	if err := tasks.Reorder([]string{low.ID}); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(low, other, high)
+
+	if err := tasks.SetPriority(high.ID, 20); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(high, low, other)
+
+	if err := tasks.MoveToFront(running.ID); err != ErrTaskNotQueued {
+		t.Fatalf("expected ErrTaskNotQueued, got %v", err)
+	}
+
+	tasks.SetSlots(4)
+	waitFor(t, "queue to drain", func() bool { return len(tasks.Queue()) == 0 })
+	waitFor(t, "downloads to complete", func() bool {
+		for _, d := range tasks.Downloads() {
+			if d.State() != "completed" {
+				return false
+			}
+		}
+		return true
+	})
+}
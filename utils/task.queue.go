@@ -0,0 +1,144 @@
+package utils
+
+import "errors"
+
+var ErrTaskNotQueued = errors.New("task is not queued")
+
+// Enqueue registers a download task and queues it behind the tasks of the
+// same or higher priority. It starts as soon as a slot is free.
+func (m *TaskManager) Enqueue(d *DownloadFile) string {
+	m.mu.Lock()
+	id := m.add(d)
+	if !d.IsQueued() {
+		d.setQueued(true)
+		m.insert(d)
+	}
+	m.mu.Unlock()
+
+	m.dispatch()
+	return id
+}
+
+// insert places d after the last queued task with the same or higher priority.
+func (m *TaskManager) insert(d *DownloadFile) {
+	i := len(m.queue)
+	for i > 0 && m.queue[i-1].Priority < d.Priority {
+		i--
+	}
+	m.queue = append(m.queue, nil)
+	copy(m.queue[i+1:], m.queue[i:])
+	m.queue[i] = d
+}
+
+// unqueue drops the task id from the queue, reporting whether it was queued.
+func (m *TaskManager) unqueue(id string) bool {
+	for i, d := range m.queue {
+		if d.ID == id {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			d.setQueued(false)
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch starts queued tasks while there are free slots.
+func (m *TaskManager) dispatch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.active < m.slots && len(m.queue) > 0 {
+		d := m.queue[0]
+		m.queue = m.queue[1:]
+		d.setQueued(false)
+		m.active++
+		go m.doDownload(d)
+	}
+}
+
+// Queue returns the waiting tasks in the order they will start.
+func (m *TaskManager) Queue() []*DownloadFile {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*DownloadFile(nil), m.queue...)
+}
+
+// Slots returns the number of downloads allowed to run at once and how many are running.
+func (m *TaskManager) Slots() (int, int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.slots, m.active
+}
+
+func (m *TaskManager) SetSlots(slots int) {
+	if slots < 1 {
+		slots = 1
+	}
+	m.mu.Lock()
+	m.slots = slots
+	m.mu.Unlock()
+
+	m.dispatch()
+}
+
+// SetPriority changes the priority of a task and moves it to its new place in the queue.
+func (m *TaskManager) SetPriority(id string, priority int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.downloads[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	d.mu.Lock()
+	d.Priority = priority
+	d.mu.Unlock()
+
+	if m.unqueue(id) {
+		d.setQueued(true)
+		m.insert(d)
+	}
+	return nil
+}
+
+// MoveToFront makes a queued task the next one to start.
+func (m *TaskManager) MoveToFront(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.downloads[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if !m.unqueue(id) {
+		return ErrTaskNotQueued
+	}
+	d.setQueued(true)
+	m.queue = append([]*DownloadFile{d}, m.queue...)
+	return nil
+}
+
+// Reorder puts the listed queued tasks at the front of the queue in the
+// given order. Tasks not listed keep their relative order behind them.
+func (m *TaskManager) Reorder(ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	queued := make(map[string]*DownloadFile, len(m.queue))
+	for _, d := range m.queue {
+		queued[d.ID] = d
+	}
+	order := make([]*DownloadFile, 0, len(m.queue))
+	for _, id := range ids {
+		d, ok := queued[id]
+		if !ok {
+			return ErrTaskNotQueued
+		}
+		order = append(order, d)
+		delete(queued, id)
+	}
+	for _, d := range m.queue {
+		if _, ok := queued[d.ID]; ok {
+			order = append(order, d)
+		}
+	}
+	m.queue = order
+	return nil
+}
@@ -0,0 +1,329 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	downloadsBucket = []byte("downloads")
+	cryptsBucket    = []byte("crypts")
+)
+
+// TaskStore is an on-disk journal of download and crypt tasks, used to
+// restore the queue after a restart.
+type TaskStore struct {
+	db *bolt.DB
+}
+
+type downloadRecord struct {
+	Key            string          `json:"key"`
+	Url            string          `json:"url"`
+	Mirrors        []string        `json:"mirrors,omitempty"`
+	Source         int             `json:"source,omitempty"`
+	Origin         string          `json:"origin,omitempty"`
+	MinSpeed       int64           `json:"min_speed,omitempty"`
+	HLS            *HLSOptions     `json:"hls,omitempty"`
+	Torrent        *TorrentOptions `json:"torrent,omitempty"`
+	Extract        *ExtractOptions `json:"extract,omitempty"`
+	Pipeline       *Pipeline       `json:"pipeline,omitempty"`
+	Kind           string          `json:"kind"`
+	Dir            string          `json:"dir"`
+	Priority       int             `json:"priority"`
+	Fname          string          `json:"fname"`
+	Conflict       string          `json:"conflict,omitempty"`
+	Request        *RequestOptions `json:"request,omitempty"`
+	Proxy          *Proxy          `json:"proxy,omitempty"`
+	Size           int64           `json:"size"`
+	DownloadedSize int64           `json:"downloaded"`
+	Connections    int             `json:"connections"`
+	Segments       []*Segment      `json:"segments"`
+	Checksum       string          `json:"checksum"`
+	Digest         string          `json:"digest"`
+	Verified       bool            `json:"verified"`
+	Retry          *RetryPolicy    `json:"retry,omitempty"`
+	RateLimit      int64           `json:"rate_limit"`
+	ETag           string          `json:"etag"`
+	LastModified   string          `json:"last_modified"`
+	State          string          `json:"state"`
+	Error          string          `json:"error"`
+}
+
+type cryptRecord struct {
+	Key         string    `json:"key"`
+	Path        string    `json:"path"`
+	FSize       int64     `json:"fsize"`
+	CryptedSize int64     `json:"crypted"`
+	Task        string    `json:"task"`
+	Operation   string    `json:"operation,omitempty"`
+	KeyRef      string    `json:"key_ref,omitempty"`
+	State       string    `json:"state,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+}
+
+func OpenTaskStore(path string) (*TaskStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{downloadsBucket, cryptsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &TaskStore{db: db}, nil
+}
+
+func (s *TaskStore) Close() error { return s.db.Close() }
+
+// Sync replaces the journal with the current content of the task maps.
+func (s *TaskStore) Sync(downloads map[string]*DownloadFile, crypts map[string]*CryptFile) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{downloadsBucket, cryptsBucket} {
+			if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+
+		bucket, err := tx.CreateBucket(downloadsBucket)
+		if err != nil {
+			return err
+		}
+		for key, d := range downloads {
+			if err := putJSON(bucket, key, d.record(key)); err != nil {
+				return err
+			}
+		}
+
+		bucket, err = tx.CreateBucket(cryptsBucket)
+		if err != nil {
+			return err
+		}
+		for key, c := range crypts {
+			record := &cryptRecord{
+				Key:         key,
+				Path:        c.fpath,
+				FSize:       c.FSize,
+				CryptedSize: c.Progress(),
+				Task:        c.Mode(),
+				Operation:   c.Operation,
+				KeyRef:      c.KeyRef,
+				State:       c.State(),
+			}
+			var err error
+			record.Started, record.Finished, err = c.Result()
+			if err != nil {
+				record.Error = err.Error()
+			}
+			if err := putJSON(bucket, key, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadDownloads rebuilds the download tasks saved by Sync. The returned map
+// is keyed like the map passed to Sync.
+func (s *TaskStore) LoadDownloads() (map[string]*DownloadFile, error) {
+	downloads := make(map[string]*DownloadFile)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(downloadsBucket).ForEach(func(_, value []byte) error {
+			var record downloadRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+
+			d := &DownloadFile{
+				ID:             record.Key,
+				added:          time.Now(),
+				Url:            record.Url,
+				Mirrors:        record.Mirrors,
+				Source:         record.Source,
+				Origin:         record.Origin,
+				MinSpeed:       record.MinSpeed,
+				HLS:            record.HLS,
+				Torrent:        record.Torrent,
+				Extract:        record.Extract,
+				Pipeline:       record.Pipeline,
+				Kind:           record.Kind,
+				dir:            record.Dir,
+				Priority:       record.Priority,
+				Fname:          record.Fname,
+				Conflict:       record.Conflict,
+				Request:        record.Request,
+				Proxy:          record.Proxy,
+				Size:           record.Size,
+				DownloadedSize: record.DownloadedSize,
+				Connections:    record.Connections,
+				Segments:       record.Segments,
+				Retry:          record.Retry,
+				RateLimit:      record.RateLimit,
+				ETag:           record.ETag,
+				LastModified:   record.LastModified,
+				Started:        time.Now(),
+				CancelChan:     make(chan bool, 1),
+				PauseChan:      make(chan bool, 1),
+			}
+			if record.Checksum != "" {
+				d.Checksum, _ = ParseChecksum(record.Checksum)
+				d.Digest = record.Digest
+				d.Verified = record.Verified
+			}
+			switch record.State {
+			case "completed":
+				d.Completed = true
+			case "paused":
+				d.paused = true
+			case "failed", "retrying":
+				d.Error = errors.New(record.Error)
+			}
+			downloads[record.Key] = d
+			return nil
+		})
+	})
+	return downloads, err
+}
+
+// LoadCrypts rebuilds the crypt jobs saved by Sync that had not finished.
+// Their output is incomplete, so they have to be run again from the start
+// with RestartCrypt.
+func (s *TaskStore) LoadCrypts() (map[string]*CryptFile, error) {
+	crypts := make(map[string]*CryptFile)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(cryptsBucket).ForEach(func(_, value []byte) error {
+			var record cryptRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			if record.Task == "" {
+				return nil
+			}
+			crypts[record.Key] = record.crypt()
+			return nil
+		})
+	})
+	return crypts, err
+}
+
+// LoadCryptHistory rebuilds the finished crypt jobs saved by Sync, oldest
+// first.
+func (s *TaskStore) LoadCryptHistory() ([]*CryptFile, error) {
+	var history []*CryptFile
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(cryptsBucket).ForEach(func(_, value []byte) error {
+			var record cryptRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			if record.Task != "" || record.Finished.IsZero() {
+				return nil
+			}
+			history = append(history, record.crypt())
+			return nil
+		})
+	})
+	sort.Slice(history, func(i, j int) bool { return history[i].Finished.Before(history[j].Finished) })
+	return history, err
+}
+
+func (record *cryptRecord) crypt() *CryptFile {
+	c := &CryptFile{
+		ID:          record.Key,
+		fpath:       record.Path,
+		Fname:       filepath.Base(record.Path),
+		FSize:       record.FSize,
+		CryperdSize: record.CryptedSize,
+		Task:        record.Task,
+		Operation:   record.Operation,
+		KeyRef:      record.KeyRef,
+		Started:     record.Started,
+		Finished:    record.Finished,
+	}
+	switch {
+	case record.State == "canceled":
+		c.Canceled, c.Error = true, errCryptCanceled
+	case record.Error != "":
+		c.Error = errors.New(record.Error)
+	}
+	return c
+}
+
+func (d *DownloadFile) record(key string) *downloadRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	record := &downloadRecord{
+		Key:            key,
+		Url:            d.Url,
+		Mirrors:        d.Mirrors,
+		Source:         d.Source,
+		Origin:         d.Origin,
+		MinSpeed:       d.MinSpeed,
+		Extract:        d.Extract,
+		Pipeline:       d.Pipeline,
+		Kind:           d.Kind,
+		Dir:            d.dir,
+		Priority:       d.Priority,
+		Fname:          d.Fname,
+		Conflict:       d.Conflict,
+		Request:        d.Request,
+		Proxy:          d.Proxy,
+		Size:           d.Size,
+		DownloadedSize: d.downloaded(),
+		Connections:    d.Connections,
+		State:          d.state(),
+		Retry:          d.Retry,
+		RateLimit:      d.RateLimit,
+		ETag:           d.ETag,
+		LastModified:   d.LastModified,
+	}
+	for _, seg := range d.Segments {
+		record.Segments = append(record.Segments, &Segment{
+			Index:      seg.Index,
+			Start:      seg.Start,
+			End:        seg.End,
+			Downloaded: seg.Progress(),
+		})
+	}
+	if d.HLS != nil {
+		hls := *d.HLS
+		record.HLS = &hls
+	}
+	if d.Torrent != nil {
+		torrent := *d.Torrent
+		record.Torrent = &torrent
+	}
+	if d.Error != nil {
+		record.Error = d.Error.Error()
+	}
+	if d.Checksum != nil {
+		record.Checksum = d.Checksum.String()
+		record.Digest = d.Digest
+		record.Verified = d.Verified
+	}
+	return record
+}
+
+func putJSON(bucket *bolt.Bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTaskStoreRoundTrip(t *testing.T) {
+	store, err := OpenTaskStore(filepath.Join(t.TempDir(), "tasks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	paused := NewDownloader("http://example.com/a.bin", "static", "a.bin")
+	paused.paused = true
+	paused.Size = 100
+	paused.DownloadedSize = 40
+	paused.Connections = 2
+	paused.Segments = splitSegments(100, 2)
+	paused.Segments[0].Downloaded = 40
+	paused.Request = &RequestOptions{Cookies: ParseCookieString("session=abc"), Username: "bob", Password: "hunter2"}
+
+	completed := NewDownloader("http://example.com/b.bin", "static", "b.bin")
+	completed.Completed = true
+
+	downloads := map[string]*DownloadFile{paused.Url: paused, completed.Url: completed}
+	crypts := map[string]*CryptFile{
+		"done.txt":    {fpath: "static/done.txt"},
+		"running.txt": {fpath: "static/running.txt", Task: "Encrypting", FSize: 10},
+	}
+	if err := store.Sync(downloads, crypts); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := store.LoadDownloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 {
+		t.Fatalf("expected 2 downloads, got %d", len(loaded))
+	}
+	if got := loaded[paused.Url]; got.State() != "paused" || got.DownloadedSize != 40 || got.Segments[0].Downloaded != 40 {
+		t.Fatalf("paused task not restored: %+v", got)
+	}
+	if got := loaded[paused.Url].Request; got == nil || got.Password != "hunter2" || got.Cookies[0].Value != "abc" {
+		t.Fatalf("request options not restored: %+v", got)
+	}
+	if got := loaded[completed.Url]; got.State() != "completed" {
+		t.Fatalf("completed task not restored: %+v", got)
+	}
+
+	loadedCrypts, err := store.LoadCrypts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loadedCrypts) != 1 || loadedCrypts["running.txt"].fpath != "static/running.txt" {
+		t.Fatalf("expected only the unfinished crypt task, got %v", loadedCrypts)
+	}
+
+	// a second sync drops tasks that are no longer tracked
+	delete(downloads, completed.Url)
+	if err := store.Sync(downloads, nil); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ := store.LoadDownloads(); len(loaded) != 1 {
+		t.Fatalf("expected 1 download after sync, got %d", len(loaded))
+	}
+}
@@ -2,31 +2,67 @@ package utils
 
 import (
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	KindDirect  = "direct"
+	KindYtDlp   = "yt-dlp"
+	KindHLS     = "hls"
+	KindTorrent = "torrent"
 )
 
+// NewDownloader creates a direct download task. With an empty fname the
+// name is detected from the response when the task first runs.
 func NewDownloader(url, dir, fname string) *DownloadFile {
+	if fname != "" {
+		fname = dir + "/" + fname
+	}
 	return &DownloadFile{
 		Url:      url,
-		Fname:    dir + "/" + fname,
+		Kind:     KindDirect,
+		dir:      dir,
+		Fname:    fname,
 		Size:     0,
 		paused:   false,
 		canceled: false, Completed: false, DownloadedSize: 0,
 		Started:    time.Now(),
-		CancelChan: make(chan bool),
-		PauseChan:  make(chan bool),
+		CancelChan: make(chan bool, 1),
+		PauseChan:  make(chan bool, 1),
 	}
 }
 
+// DownloadFile is a single download task. Its state is shared between the
+// goroutine running the download and the HTTP handlers, so fields other than
+// the ones fixed at creation are guarded by mu, and DownloadedSize is only
+// accessed atomically.
 type DownloadFile struct {
+	mu             sync.Mutex
+	ID             string
+	added          time.Time
 	Url            string
+	Mirrors        []string // other URLs serving the same file
+	Source         int      // index of the source in use, 0 for Url
+	Origin         string   // source the validators were read from
+	MinSpeed       int64    // bytes per second below which a source is dropped, 0 to keep slow sources
+	Kind           string
+	dir            string
+	Priority       int // higher priorities leave the queue first
+	queued         bool
 	paused         bool
+	running        bool
 	Fname          string
+	Conflict       string // policy applied to Fname on the first run
 	Size           int64
 	Completed      bool
 	canceled       bool
@@ -35,134 +71,588 @@ type DownloadFile struct {
 	CancelChan     chan bool
 	PauseChan      chan bool
 	Error          error
+	Connections    int // number of parallel range requests, 0 or 1 for a single stream
+	Segments       []*Segment
+	Checksum       *Checksum // expected digest, checked once the download completes
+	Digest         string
+	Verified       bool
+	Retry          *RetryPolicy // overrides the TaskManager retry policy when set
+	Attempts       int
+	NextRetry      time.Time
+	ETag           string // validators of the remote file, checked on resume
+	LastModified   string
+	RateLimit      int64 // bytes per second, 0 for no limit
+	limiter        *rate.Limiter
+	bandwidth      *Bandwidth
+	Request        *RequestOptions // headers, cookies and credentials, fixed at creation
+	Proxy          *Proxy          // overrides the TaskManager proxy when set
+	defaultProxy   func() *Proxy
+	defaultSSH     func() *SSHSettings
+	HLS            *HLSOptions // variant choice of HLS tasks
+	hlsDone        int         // segments of HLS tasks saved so far
+	hlsTotal       int
+	Torrent        *TorrentOptions // torrent and file selection of torrent tasks
+	torrents       func() (*torrentClient, error)
+	defaultSeed    func() SeedLimits
+	torrentStatus  *TorrentStatus
+	seedStop       chan struct{}   // closed to stop seeding a completed torrent
+	Extract        *ExtractOptions // unpacks the download once complete when set
+	Pipeline       *Pipeline       // steps run once complete, the TaskManager ones when nil
+	pipeline       *PipelineStatus
+	httpClient     *http.Client
+	history        speedHistory
 }
 
+// DownloadStatus is the JSON view of a DownloadFile reported by /status.
+type DownloadStatus struct {
+	ID              string           `json:"id"`
+	Size            int64            `json:"size"`
+	DownloadedBytes int64            `json:"downloaded"`
+	Fname           string           `json:"fname"`
+	Speed           float64          `json:"speed"` // bytes per second over the last few seconds
+	AverageSpeed    float64          `json:"average_speed"`
+	ETA             *float64         `json:"eta,omitempty"` // seconds
+	Percentage      float64          `json:"percentage"`
+	Url             string           `json:"url"`
+	Mirrors         []string         `json:"mirrors,omitempty"`
+	Source          string           `json:"source,omitempty"`
+	Paused          bool             `json:"paused"`
+	State           string           `json:"state"`
+	Priority        int              `json:"priority"`
+	Error           string           `json:"error,omitempty"`
+	Checksum        string           `json:"checksum,omitempty"`
+	Digest          string           `json:"digest,omitempty"`
+	Verified        bool             `json:"verified"`
+	Attempts        int              `json:"attempts"`
+	NextRetry       *time.Time       `json:"next_retry,omitempty"`
+	RateLimit       int64            `json:"rate_limit"`
+	ETag            string           `json:"etag,omitempty"`
+	LastModified    string           `json:"last_modified,omitempty"`
+	Segments        []*SegmentStatus `json:"segments,omitempty"`
+	Request         *RequestStatus   `json:"request,omitempty"`
+	Proxy           string           `json:"proxy,omitempty"`
+	HLS             *HLSStatus       `json:"hls,omitempty"`
+	Torrent         *TorrentStatus   `json:"torrent,omitempty"`
+	Pipeline        *PipelineStatus  `json:"pipeline,omitempty"`
+}
+
+type SegmentStatus struct {
+	Start      int64  `json:"start"`
+	End        int64  `json:"end"`
+	Downloaded int64  `json:"downloaded"`
+	Source     string `json:"source,omitempty"`
+}
+
+func (d *DownloadFile) Status() *DownloadStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := &DownloadStatus{
+		ID:              d.ID,
+		Size:            d.Size,
+		DownloadedBytes: d.downloaded(),
+		Fname:           d.Fname,
+		Speed:           d.speed(),
+		AverageSpeed:    d.history.average(time.Now()),
+		Percentage:      float64(d.percentage()),
+		Url:             redactURL(d.Url),
+		Paused:          d.paused,
+		State:           d.state(),
+		Priority:        d.Priority,
+		Attempts:        d.Attempts,
+		RateLimit:       d.RateLimit,
+		ETag:            d.ETag,
+		LastModified:    d.LastModified,
+	}
+	for _, mirror := range d.Mirrors {
+		status.Mirrors = append(status.Mirrors, redactURL(mirror))
+	}
+	if len(d.Mirrors) > 0 {
+		status.Source = redactURL(d.sources()[d.Source%(len(d.Mirrors)+1)])
+	}
+	if eta := d.eta(time.Now()); eta >= 0 {
+		seconds := eta.Seconds()
+		status.ETA = &seconds
+	}
+	if d.Request != nil {
+		status.Request = d.Request.Status()
+	}
+	if d.Proxy != nil {
+		status.Proxy = d.Proxy.Redacted()
+		if d.Proxy.URL == "" {
+			status.Proxy = "direct"
+		}
+	}
+	if !d.NextRetry.IsZero() {
+		nextRetry := d.NextRetry
+		status.NextRetry = &nextRetry
+	}
+	if d.Error != nil {
+		status.Error = d.Error.Error()
+	}
+	if d.Checksum != nil {
+		status.Checksum = d.Checksum.String()
+		status.Digest = d.Digest
+		status.Verified = d.Verified
+	}
+	if d.Kind == KindHLS {
+		status.HLS = &HLSStatus{SegmentsDone: d.hlsDone, SegmentsTotal: d.hlsTotal}
+		if d.HLS != nil {
+			status.HLS.Variant = d.HLS.Variant
+		}
+	}
+	status.Torrent = d.torrentStatus
+	status.Pipeline = d.pipelineStatus()
+	for _, seg := range d.Segments {
+		status.Segments = append(status.Segments, &SegmentStatus{
+			Start:      seg.Start,
+			End:        seg.End,
+			Downloaded: seg.Progress(),
+			Source:     redactURL(seg.Source),
+		})
+	}
+	return status
+}
+
+func (d *DownloadFile) downloaded() int64 { return atomic.LoadInt64(&d.DownloadedSize) }
+
 func (d *DownloadFile) Speed() float64 {
-	elapsedTime := time.Since(d.Started)
-	downloadedSize := float64(d.DownloadedSize)
-	return downloadedSize / elapsedTime.Seconds()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.speed()
+}
+
+// speed is the current transfer rate in bytes per second, measured over a
+// short window so that pauses and stalls do not skew it.
+func (d *DownloadFile) speed() float64 {
+	return d.history.current(time.Now())
 }
 
 func (d *DownloadFile) Percentage() float32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.percentage()
+}
+
+func (d *DownloadFile) percentage() float32 {
+	if d.Kind == KindHLS && !d.Completed {
+		// the size of a stream is only known once it is joined
+		if d.hlsTotal == 0 {
+			return 0.0
+		}
+		return float32(d.hlsDone) / float32(d.hlsTotal) * 100.0
+	}
 	if d.Size == 0 {
 		return 0.0
 	}
-	return (float32(d.DownloadedSize) / float32(d.Size)) * 100.0
+	return (float32(d.downloaded()) / float32(d.Size)) * 100.0
+}
+
+func (d *DownloadFile) IsPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+func (d *DownloadFile) IsQueued() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queued
 }
 
-func (d *DownloadFile) IsPaused() bool   { return !d.paused }
-func (d *DownloadFile) IsCanceled() bool { return d.canceled }
+func (d *DownloadFile) IsCanceled() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.canceled
+}
+
+func (d *DownloadFile) State() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state()
+}
+
+func (d *DownloadFile) state() string {
+	switch {
+	case d.Completed:
+		return "completed"
+	case d.canceled:
+		return "canceled"
+	case d.queued:
+		return "queued"
+	case d.paused:
+		return "paused"
+	case !d.NextRetry.IsZero():
+		return "retrying"
+	case d.Error != nil:
+		return "failed"
+	default:
+		return "downloading"
+	}
+}
 
 func (d *DownloadFile) Pause() string {
-	if !d.paused {
-		d.PauseChan <- true
-		return "Task Paused"
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.paused || d.Completed || d.canceled {
+		return "Task Already Paused"
+	}
+	if d.running {
+		signal(d.PauseChan)
+	} else {
+		d.paused = true
+		d.queued = false
+		d.NextRetry = time.Time{}
 	}
-	return "Task Already Paused"
+	return "Task Paused"
 }
 
 func (d *DownloadFile) Cancel() bool {
-	if !d.canceled && !d.Completed { // if not already cancelled and not completed then cancel download progress
-		d.CancelChan <- true
-		return true
+	d.mu.Lock()
+	if d.canceled || d.Completed { // already cancelled or completed, nothing to stop
+		d.mu.Unlock()
+		return false
 	}
-	return false
+	running := d.running
+	if running {
+		signal(d.CancelChan)
+	} else {
+		d.canceled = true
+	}
+	d.mu.Unlock()
+	// a running task removes its partial file when it stops
+	if !running {
+		d.finishPart()
+	}
+	return true
+}
+
+// signal notifies the download loop without blocking when a signal is already pending.
+func signal(ch chan bool) {
+	select {
+	case ch <- true:
+	default:
+	}
+}
+
+// start marks the task as running and drops control signals left over from
+// an earlier run. It reports false when the task is already running or has
+// been cancelled.
+func (d *DownloadFile) start() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running || d.canceled {
+		return false
+	}
+	d.running = true
+	d.paused = false
+	d.Error = nil
+	d.Attempts++
+	d.NextRetry = time.Time{}
+	d.Digest = ""
+	d.Verified = false
+	d.history.resume(time.Now())
+	for _, ch := range []chan bool{d.CancelChan, d.PauseChan} {
+		select {
+		case <-ch:
+		default:
+		}
+	}
+	return true
+}
+
+func (d *DownloadFile) setQueued(queued bool) {
+	d.mu.Lock()
+	d.queued = queued
+	if queued {
+		d.paused = false
+	}
+	d.mu.Unlock()
+}
+
+func (d *DownloadFile) stop() {
+	d.mu.Lock()
+	d.running = false
+	d.history.pause(time.Now())
+	d.mu.Unlock()
+}
+
+func (d *DownloadFile) setPaused() {
+	d.mu.Lock()
+	d.paused = true
+	d.mu.Unlock()
+	log.Printf("[*] Download paused: %s", redactURL(d.Url))
+}
+
+func (d *DownloadFile) setCanceled() {
+	d.mu.Lock()
+	d.canceled = true
+	d.mu.Unlock()
+	log.Println("[X] Download canceled.")
+}
+
+func (d *DownloadFile) setCompleted() {
+	d.mu.Lock()
+	d.Completed = true
+	d.mu.Unlock()
 }
 
 func (d *DownloadFile) Resume() bool {
 
-	if !d.IsPaused() {
+	if !d.start() {
 		return true
 	}
+	defer d.stop()
+	defer d.finishPart()
+
+	if d.Kind == KindYtDlp {
+		return d.resumeYtDlp()
+	}
+	if d.Kind == KindTorrent {
+		return d.resumeTorrent()
+	}
+
+	if err := d.prepareName(); err != nil {
+		log_and_set_error(d, "error choosing the output file", err)
+		return true
+	}
+	if d.Kind == KindHLS {
+		return d.resumeHLS()
+	}
+	d.adoptPartial()
+
+	if d.Connections > 1 {
+		if size, sources := d.probeSources(); len(sources) > 0 {
+			return d.resumeSegmented(size, sources)
+		}
+		log.Printf("[*] Range requests not supported, using a single connection: %s", redactURL(d.Url))
+	}
+
+	// switch to the next mirror when one fails, keeping the data downloaded so far
+	sources := d.sources()
+	for tried := 1; ; tried++ {
+		keep := d.resumeStream(sources[d.source(len(sources))], tried == len(sources))
+		if !d.failOver(tried, sources) {
+			return keep
+		}
+	}
+}
+
+// resumeStream downloads the rest of the file from link over a single
+// connection. last is set when no other source is left to try.
+func (d *DownloadFile) resumeStream(link string, last bool) bool {
+	if isFTP(link) {
+		return d.resumeFTP(link)
+	}
+	if isSFTP(link) {
+		return d.resumeSFTP(link)
+	}
+	part := d.partName()
 
 	// create request
-	req, err := http.NewRequest("GET", d.Url, nil)
+	req, err := d.newRequest("GET", link)
 	if err != nil {
 		log_and_set_error(d, "error creating HTTP request", err)
 		return true
 	}
-	info, err := os.Stat(d.Fname)
+	ranged := false
+	info, err := os.Stat(part)
 	if err != nil {
 		log.Println("Error getting file info:", err)
-	} else {
+	}
+	atomic.StoreInt64(&d.DownloadedSize, 0)
+	if err == nil && info.Size() > 0 {
 		req.Header.Set("Range", "bytes="+strconv.FormatInt(info.Size(), 10)+"-")
-		d.DownloadedSize = info.Size()
+		if validator := d.ifRange(link); validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+		atomic.StoreInt64(&d.DownloadedSize, info.Size())
+		ranged = true
 	}
 
 	// send the HTTP request
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := d.client().Do(req)
 	if err != nil {
 		log_and_set_error(d, "error making HTTP request", err)
 		return true
 	}
-	if resp.StatusCode != 200 {
-		if resp.StatusCode == 416 {
-			d.Completed = true
-			return false
+	defer resp.Body.Close()
+	slow := d.watchSpeed(resp.Body)
+	defer slow.Stop()
+
+	flags := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+	var size int64
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// the origin must send exactly the part we asked for
+		start, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err == nil && (!ranged || start != d.downloaded()) {
+			err = fmt.Errorf("got bytes from %d, asked for %d", start, d.downloaded())
+		}
+		if err == nil && !d.sameFile(link, total) {
+			err = ErrMirrorMismatch
 		}
-		log_and_set_error(d, resp.Status, err)
+		if err != nil {
+			log_and_set_error(d, "invalid partial response", err)
+			return true
+		}
+		// an origin ignoring If-Range sends the bytes of another version
+		if d.validatorsChanged(resp.Header, link) {
+			d.restart("Remote file changed")
+			if err := os.Truncate(part, 0); err != nil {
+				log_and_set_error(d, "error truncating the partial file", err)
+				return true
+			}
+			log_and_set_error(d, "error resuming download", ErrContentChanged)
+			return true
+		}
+		size = total
+	case http.StatusOK:
+		// a full response to a ranged request means the file changed (If-Range
+		// failed) or the origin ignored the range, so the partial file is useless
+		if ranged && !d.validatedBy(link) && !last {
+			// another mirror may still be able to continue the download
+			log_and_set_error(d, "error resuming download", ErrMirrorMismatch)
+			return true
+		}
+		if ranged {
+			d.restart("Remote file changed or range ignored")
+			atomic.StoreInt64(&d.DownloadedSize, 0)
+			flags |= os.O_TRUNC
+		}
+		size = resp.ContentLength
+	case http.StatusRequestedRangeNotSatisfiable:
+		// nothing left to download, unless the partial file is larger than the remote one
+		if _, _, total, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil && total != d.downloaded() && d.validatedBy(link) {
+			d.restart("Partial file does not match the remote size")
+			if err := os.Truncate(part, 0); err != nil {
+				log_and_set_error(d, "error truncating the partial file", err)
+				return true
+			}
+			log_and_set_error(d, "error resuming download", ErrContentChanged)
+			return true
+		}
+		if !d.verify(nil) {
+			return true
+		}
+		if err := d.commitPart(); err != nil {
+			log_and_set_error(d, "error moving the file into place", err)
+			return true
+		}
+		d.setCompleted()
+		return false
+	default:
+		log_and_set_error(d, "error making HTTP request", &StatusError{Code: resp.StatusCode, Status: resp.Status})
 		return true
 	}
-	defer resp.Body.Close()
-	d.paused = false
+	d.setValidators(resp.Header, link)
 
 	// update file total size and started time
-	d.Size = resp.ContentLength + d.DownloadedSize // total size with downloaded part
+	if size < 0 {
+		size = 0 // unknown
+	}
+	d.mu.Lock()
+	d.Size = size
 	d.Started = time.Now()
+	d.mu.Unlock()
 
-	// create buffer chunk size
-	buffer := make([]byte, 1024)
+	return d.receive(resp.Body, flags, slow)
+}
+
+// receive appends body to the .part file, opened with flags, until it ends
+// or the task is paused or canceled, then verifies and commits the file.
+func (d *DownloadFile) receive(body io.Reader, flags int, slow *speedWatch) bool {
+	part := d.partName()
+
+	// hash the part downloaded by earlier runs, then everything written from here on
+	var hasher hash.Hash
+	if d.Checksum != nil {
+		hasher = d.Checksum.New()
+		if d.downloaded() > 0 {
+			if err := hashPrefix(hasher, part, d.downloaded()); err != nil {
+				log_and_set_error(d, "error hashing the partial file", err)
+				return true
+			}
+		}
+	}
 
 	//open output file
-	outputFile, err := os.OpenFile(d.Fname, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	outputFile, err := os.OpenFile(part, flags, 0644)
 	if err != nil {
 		log_and_set_error(d, "error opening the output file", err)
 		return true
 	}
 	defer outputFile.Close()
+	var out io.Writer = outputFile
+	if hasher != nil {
+		out = io.MultiWriter(outputFile, hasher)
+	}
+	if !d.transfer(body, out, slow) {
+		return true
+	}
+
+	if !d.verify(hasher) {
+		return true
+	}
+	if err := d.commitPart(); err != nil {
+		log_and_set_error(d, "error moving the file into place", err)
+		return true
+	}
+	d.setCompleted()
+	return true
+}
+
+// copyBufferSize is the size of the reads of every download.
+const copyBufferSize = 32 * 1024
+
+// transfer copies body to out, counting the progress of the task. It
+// returns false when the task was paused, canceled or failed before body
+// ended.
+func (d *DownloadFile) transfer(body io.Reader, out io.Writer, slow *speedWatch) bool {
+	buffer := make([]byte, copyBufferSize)
 	for {
 		select {
 		case <-d.CancelChan:
-			log.Println("[X] Download canceled.")
-			close(d.CancelChan)
-			close(d.PauseChan)
-			d.canceled = true
-			return true
+			d.setCanceled()
+			return false
 		case <-d.PauseChan:
-			log.Printf("[*] Download paused: %s", d.Url)
-			return true
+			d.setPaused()
+			return false
 		default:
-			n, err := resp.Body.Read(buffer)
+			n, err := body.Read(buffer)
 			if err != nil && err != io.EOF {
+				if slow.Tripped() {
+					err = ErrSlowMirror
+				}
 				log_and_set_error(d, "error reading from response", err)
-				return true
+				return false
 			}
 
 			if n > 0 {
+				d.throttle(n)
+
 				// Write the chunk to the output file
-				_, err := outputFile.Write(buffer[:n])
+				_, err := out.Write(buffer[:n])
 				if err != nil {
 					log_and_set_error(d, "error writing to the output file", err)
-					return true
+					return false
 				}
 
 				// Update DownloadedSize
-				d.DownloadedSize += int64(n)
+				d.addProgress(n)
 			}
 
 			if err == io.EOF {
-				d.Completed = true
-				close(d.CancelChan)
-				close(d.PauseChan)
 				return true
 			}
 		}
 	}
-
 }
 
 func log_and_set_error(d *DownloadFile, msg string, err error) {
-	err = fmt.Errorf("%s: %s", msg, err)
+	err = fmt.Errorf("%s: %w", msg, err)
+	d.mu.Lock()
 	d.Error = err
+	d.mu.Unlock()
 	log.Println(err)
 }